@@ -0,0 +1,31 @@
+package cmd
+
+import (
+	"github.com/openGemini/dataMigrate/src"
+	"github.com/spf13/cobra"
+)
+
+func newInspectCmd() *cobra.Command {
+	var inspectOpt src.InspectOptions
+	inspectCmd := &cobra.Command{
+		Use:           "inspect",
+		Short:         "Reports the schema and size of the TSM files per database, retention policy and measurement",
+		SilenceUsage:  true,
+		SilenceErrors: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return src.NewInspectCommand(&inspectOpt).Run()
+		},
+	}
+
+	inspectCmd.Flags().StringVarP(&inspectOpt.DataDir, "from", "f", "/var/lib/influxdb/data", "Influxdb Data storage path. See your influxdb config item: data.dir. Or the engine dir of InfluxDB 2.x")
+	inspectCmd.Flags().StringVarP(&inspectOpt.BoltPath, "bolt-path", "", "", "Optional: influxd.bolt of InfluxDB 2.x to read the bucket names from, next to the engine dir by default")
+	inspectCmd.Flags().StringVarP(&inspectOpt.Database, "database", "", "", "Optional: the source database to inspect")
+	inspectCmd.Flags().StringVarP(&inspectOpt.RetentionPolicy, "retention", "", "", "Optional: the retention policy to inspect (required -database)")
+	inspectCmd.Flags().StringArrayVarP(&inspectOpt.Measurements, "measurement", "", nil, "Optional: the measurement to inspect, can be repeated")
+	inspectCmd.Flags().StringArrayVarP(&inspectOpt.Tags, "tag", "", nil, "Optional: inspect only the series with the tag, format: 'key=value', can be repeated")
+	inspectCmd.Flags().StringVarP(&inspectOpt.Format, "format", "", "table", "Optional: the output format: table or json")
+	inspectCmd.Flags().BoolVarP(&inspectOpt.Exact, "exact", "", false, "Optional: count the points exactly by reading every block, instead of estimating them from the index")
+	inspectCmd.Flags().BoolVarP(&inspectOpt.IgnoreIndex, "ignore-index", "", false, "Optional: do not read the TSI index of the shards, which skips the series dropped by DROP SERIES or DELETE")
+	inspectCmd.Flags().BoolVarP(&inspectOpt.IndexOnly, "index-only", "", false, "Optional: read the measurements, series and tags from the TSI index of the shards without reading the TSM files")
+	return inspectCmd
+}
@@ -1,17 +1,38 @@
 package cmd
 
 import (
+	"compress/gzip"
+
 	"github.com/openGemini/dataMigrate/src"
 	"github.com/spf13/cobra"
 )
 
 var (
 	RootCmd *cobra.Command // represents the cluster command
+	RunCmd  *cobra.Command // migrates the data
 	opt     src.DataMigrateOptions
+	logCfg  src.LogConfig
 )
 
 func init() {
 	RootCmd = &cobra.Command{
+		Use:           "dataMigrate",
+		Short:         "Migrate InfluxDB data to openGemini",
+		SilenceUsage:  true,
+		SilenceErrors: true,
+		// the log file is opened once the flags are parsed
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			return src.Logger.Configure(logCfg)
+		},
+	}
+	RootCmd.PersistentFlags().StringVarP(&logCfg.Dir, "log-dir", "", "./logs", "Optional: the dir to write the log file to")
+	RootCmd.PersistentFlags().StringVarP(&logCfg.Level, "log-level", "", "info", "Optional: the lowest level of the messages to log: debug, info, warning or error")
+	RootCmd.PersistentFlags().StringVarP(&logCfg.Format, "log-format", "", src.LogFormatText, "Optional: the format of the logs: text or json, the json logs have the shard, file and series of the messages as fields")
+	RootCmd.PersistentFlags().IntVarP(&logCfg.MaxSize, "log-max-size", "", 100, "Optional: the size (MB) to rotate the log file at, 0 means never")
+	RootCmd.PersistentFlags().IntVarP(&logCfg.MaxBackups, "log-max-backups", "", 10, "Optional: the rotated log files to keep, 0 means all")
+	RootCmd.PersistentFlags().BoolVarP(&logCfg.NoFile, "no-log-file", "", false, "Optional: log to the console only, e.g. if the working dir is read-only")
+
+	RunCmd = &cobra.Command{
 		Use:           "run",
 		Short:         "Reads TSM files into InfluxDB line protocol format and write into openGemini",
 		SilenceUsage:  true,
@@ -25,19 +46,59 @@ func init() {
 		},
 	}
 
-	RootCmd.Flags().StringVarP(&opt.Username, "username", "u", "", "Optional: The username to connect to the openGemini cluster.")
-	RootCmd.Flags().StringVarP(&opt.Password, "password", "p", "", "Optional: The password to connect to the openGemini cluster.")
-	RootCmd.Flags().StringVarP(&opt.DataDir, "from", "f", "/var/lib/influxdb/data", "Influxdb Data storage path. See your influxdb config item: data.dir")
-	RootCmd.Flags().StringVarP(&opt.Out, "to", "t", "127.0.0.1:8086", "Destination host to write data to")
-	RootCmd.Flags().StringVarP(&opt.Database, "database", "", "", "Optional: the source database to read")
-	RootCmd.Flags().StringVarP(&opt.DestDatabase, "dest_database", "", "", "Optional: the database to write")
-	RootCmd.Flags().StringVarP(&opt.RetentionPolicy, "retention", "", "", "Optional: the retention policy to read (required -database)")
-	RootCmd.Flags().StringVarP(&opt.Start, "start", "", "", "Optional: the start time to read (RFC3339 format)")
-	RootCmd.Flags().StringVarP(&opt.End, "end", "", "", "Optional: the end time to read (RFC3339 format)")
-	RootCmd.Flags().IntVarP(&opt.BatchSize, "batch", "", 1000, "Optional: specify batch size for inserting lines")
-	RootCmd.Flags().BoolVarP(&opt.Debug, "debug", "", false, "Optional: whether to enable debug log or not")
-	RootCmd.Flags().BoolVarP(&opt.Ssl, "ssl", "", false, "Optional: Use https for requests.")
-	RootCmd.Flags().BoolVarP(&opt.UnsafeSsl, "unsafeSsl", "", false, "Optional: Set this when connecting to the cluster using https and not use SSL verification.")
+	RunCmd.Flags().StringVarP(&opt.Username, "username", "u", "", "Optional: The username to connect to the openGemini cluster.")
+	RunCmd.Flags().StringVarP(&opt.Password, "password", "p", "", "Optional: The password to connect to the openGemini cluster.")
+	RunCmd.Flags().StringVarP(&opt.DataDir, "from", "f", "/var/lib/influxdb/data", "Influxdb Data storage path. See your influxdb config item: data.dir. Or the engine dir of InfluxDB 2.x, or the dir of 'influxd backup -portable'")
+	RunCmd.Flags().StringVarP(&opt.BoltPath, "bolt-path", "", "", "Optional: influxd.bolt of InfluxDB 2.x to read the bucket names from, next to the engine dir by default")
+	RunCmd.Flags().StringVarP(&opt.TmpDir, "tmp-dir", "", "", "Optional: the dir to extract the shards of a backup to, the system temp dir by default")
+	RunCmd.Flags().StringVarP(&opt.Out, "to", "t", "127.0.0.1:8086", "Destination hosts to write data to, separated by commas, e.g. 'host1:8086,host2:8086'")
+	RunCmd.Flags().StringVarP(&opt.Balance, "balance", "", "round-robin", "Optional: how to balance the write requests among the destination hosts: round-robin or least-inflight")
+	RunCmd.Flags().StringVarP(&opt.Database, "database", "", "", "Optional: the source database to read")
+	RunCmd.Flags().StringVarP(&opt.DestDatabase, "dest_database", "", "", "Optional: the database to write")
+	RunCmd.Flags().StringArrayVarP(&opt.Mappings, "mapping", "", nil, "Optional: map source db/rp to destination db/rp, format: 'src_db[.src_rp] -> dst_db[.dst_rp]', '*' is a wildcard, can be repeated")
+	RunCmd.Flags().StringVarP(&opt.MappingFile, "mapping-file", "", "", "Optional: a file with one mapping rule per line, see --mapping")
+	RunCmd.Flags().StringVarP(&opt.RetentionPolicy, "retention", "", "", "Optional: the retention policy to read (required -database)")
+	RunCmd.Flags().StringVarP(&opt.Start, "start", "", "", "Optional: the start time to read (RFC3339 format)")
+	RunCmd.Flags().StringVarP(&opt.End, "end", "", "", "Optional: the end time to read (RFC3339 format)")
+	RunCmd.Flags().StringArrayVarP(&opt.Measurements, "measurement", "", nil, "Optional: the measurement to migrate, can be repeated. All the measurements are migrated by default")
+	RunCmd.Flags().StringArrayVarP(&opt.Tags, "tag", "", nil, "Optional: migrate only the series with the tag, format: 'key=value', can be repeated. A series is migrated if it has one of the values of every key")
+	RunCmd.Flags().BoolVarP(&opt.IgnoreIndex, "ignore-index", "", false, "Optional: do not read the TSI index of the shards, which skips the series dropped by DROP SERIES or DELETE")
+	RunCmd.Flags().StringArrayVarP(&opt.Downsamples, "downsample", "", nil, "Optional: aggregate the data older than age into windows of interval, format: 'age:interval:aggs[:rp]', e.g. '90d:5m:mean,max,last:rp_cold', aggs: mean,max,min,sum,count,first,last, can be repeated")
+	RunCmd.Flags().StringVarP(&opt.TimeShift, "time-shift", "", "", "Optional: shift all timestamps by the duration, e.g. '-24h', '30d'")
+	RunCmd.Flags().StringVarP(&opt.Precision, "precision", "", "ns", "Optional: the precision to write timestamps with: ns, us, ms or s. Timestamps are truncated")
+	RunCmd.Flags().StringVarP(&opt.DedupPolicy, "dedup", "", "last", "Optional: which field value to keep when points collide after truncating timestamps: first or last")
+	RunCmd.Flags().IntVarP(&opt.BatchSize, "batch", "", 1000, "Optional: specify batch size for inserting lines")
+	RunCmd.Flags().StringArrayVarP(&opt.Fanouts, "fanout", "", nil, "Optional: write the same data to another destination as well, format: 'http[s]://[user:password@]host:port[,host:port...][?on-error=fail|skip|dead-letter]' or 'file:/path/to/file[?on-error=...]', can be repeated")
+	RunCmd.Flags().StringVarP(&opt.DeadLetterDir, "dead-letter-dir", "", "./dead-letter", "Optional: the dir to write the batches which fail to write to the destinations with on-error=dead-letter")
+	RunCmd.Flags().IntVarP(&opt.MaxRetries, "max-retries", "", 0, "Optional: the retries of a batch failed to write before the on-error policy of the destination applies, 0 means retrying until it succeeds")
+	RunCmd.Flags().StringVarP(&opt.Compress, "compress", "", "none", "Optional: compress the bodies of write requests: none or gzip")
+	RunCmd.Flags().IntVarP(&opt.CompressLevel, "compress-level", "", gzip.DefaultCompression, "Optional: the gzip compression level, from 1 (best speed) to 9 (best compression), -1 is the default level")
+	RunCmd.Flags().BoolVarP(&opt.Stream, "stream", "", false, "Optional: iterate the series of every shard by merging the sorted TSM indexes, which takes constant memory")
+	RunCmd.Flags().IntVarP(&opt.SeriesMemLimit, "series-mem-limit", "", 1024, "Optional: the memory (MB) to collect the series of a shard, streaming is used once exceeded, 0 means no limit")
+	RunCmd.Flags().StringVarP(&opt.OnError, "on-error", "", "fail", "Optional: what to do with a shard or a TSM file which cannot be migrated: fail aborts the migration, skip-shard skips the shard, skip-file skips the unreadable TSM files and the other failed shards")
+	RunCmd.Flags().StringVarP(&opt.Report, "report", "", "", "Optional: the JSON file to write the statistics of the migration and the shards and the files skipped to")
+	RunCmd.Flags().StringVarP(&opt.Verify, "verify", "", "", "Optional: verify the block checksums and the index of the TSM files first, as influx_inspect verify does: fail aborts the migration on any corrupt block, skip-block migrates without the corrupt blocks")
+	RunCmd.Flags().Lookup("verify").NoOptDefVal = src.VerifyFail
+	RunCmd.Flags().StringVarP(&opt.Incremental, "incremental", "", "", "Optional: the file to record the TSM files migrated of every shard, a later run with the same file migrates only the files of new generations")
+	RunCmd.Flags().BoolVarP(&opt.CheckSchema, "check-schema", "", false, "Optional: compare the field types of the data to migrate with the ones in openGemini first, and abort on any conflict")
+	RunCmd.Flags().StringVarP(&opt.MetaDir, "meta", "", "", "Optional: InfluxDB meta dir (see your influxdb config item: meta.dir), meta.db file or the .meta file of a portable backup to read meta data from")
+	RunCmd.Flags().StringVarP(&opt.SrcHost, "src-host", "", "", "Optional: the running source InfluxDB host:port to read meta data from, used if --meta is not set")
+	RunCmd.Flags().BoolVarP(&opt.Online, "online", "", false, "Optional: read the data from the running InfluxDB of --src-host through its HTTP API instead of --from")
+	RunCmd.Flags().StringVarP(&opt.Window, "window", "", "1h", "Optional: the time range of every query with --online, the points of a measurement in a window are held in memory")
+	RunCmd.Flags().IntVarP(&opt.ChunkSize, "chunk-size", "", 10000, "Optional: the points per chunk of the query responses with --online")
+	RunCmd.Flags().StringVarP(&opt.Checkpoint, "checkpoint", "", "", "Optional: the file to record the windows migrated with --online, a migration restarted with the same file skips them")
+	RunCmd.Flags().StringVarP(&opt.SrcUsername, "src-username", "", "", "Optional: The username to connect to the source InfluxDB.")
+	RunCmd.Flags().StringVarP(&opt.SrcPassword, "src-password", "", "", "Optional: The password to connect to the source InfluxDB.")
+	RunCmd.Flags().BoolVarP(&opt.SrcSsl, "src-ssl", "", false, "Optional: Use https for requests to the source InfluxDB.")
+	RunCmd.Flags().BoolVarP(&opt.MigrateCQ, "migrate-cq", "", false, "Optional: recreate the continuous queries of InfluxDB in openGemini after migrating data (requires --meta or --src-host)")
+	RunCmd.Flags().BoolVarP(&opt.MigrateUsers, "migrate-users", "", false, "Optional: recreate the users and privileges of InfluxDB in openGemini after migrating data (requires --meta or --src-host)")
+	RunCmd.Flags().StringVarP(&opt.UserPasswordFile, "user-passwords", "", "", "Optional: a file with the passwords to set for migrated users, one 'user:password' per line. Other users get generated passwords")
+	RunCmd.Flags().StringVarP(&opt.UsersOutput, "users-output", "", "./migrated_users.txt", "Optional: the file to append the passwords of the migrated users to, readable only by the owner")
+	RunCmd.Flags().BoolVarP(&opt.Debug, "debug", "", false, "Optional: whether to enable debug log or not, the same as --log-level debug")
+	RunCmd.Flags().BoolVarP(&opt.Ssl, "ssl", "", false, "Optional: Use https for requests.")
+	RunCmd.Flags().BoolVarP(&opt.UnsafeSsl, "unsafeSsl", "", false, "Optional: Set this when connecting to the cluster using https and not use SSL verification.")
+
+	RootCmd.AddCommand(RunCmd, newInspectCmd())
 }
 
 func Execute() error {
@@ -6,8 +6,10 @@ require (
 	github.com/golang/groupcache v0.0.0-20210331224755-41bb18bfe9da
 	github.com/influxdata/influxdb v1.8.0
 	github.com/influxdata/influxdb1-client v0.0.0-20200827194710-b269163b24ab
+	github.com/influxdata/influxql v1.1.0
 	github.com/pkg/errors v0.8.1
 	github.com/spf13/cobra v0.0.3
+	go.etcd.io/bbolt v1.3.6
 	go.uber.org/atomic v1.3.2
 	golang.org/x/sync v0.0.0-20190911185100-cd5d95a43a6e
 	golang.org/x/sys v0.8.0 // indirect
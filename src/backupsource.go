@@ -0,0 +1,284 @@
+package src
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+
+	"github.com/influxdata/influxdb/cmd/influxd/backup_util"
+	"github.com/influxdata/influxdb/services/meta"
+	"github.com/influxdata/influxdb/tsdb/engine/tsm1"
+	"github.com/pkg/errors"
+)
+
+// isBackupDir reports whether dir holds the output of `influxd backup -portable`.
+func isBackupDir(dir string) bool {
+	manifests, _ := filepath.Glob(filepath.Join(dir, "*.manifest"))
+	return len(manifests) > 0
+}
+
+// readBackupMeta reads the meta data of the .meta file of a portable backup.
+func readBackupMeta(path string) (*meta.Data, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	var packer backup_util.PortablePacker
+	if err := packer.UnmarshalBinary(buf); err != nil {
+		return nil, fmt.Errorf("dataMigrate: unmarshal backup meta from %s: %s", path, err)
+	}
+	data := &meta.Data{}
+	if err := data.UnmarshalBinary(packer.Data); err != nil {
+		return nil, fmt.Errorf("dataMigrate: unmarshal meta data from %s: %s", path, err)
+	}
+	return data, nil
+}
+
+type BackupSourceConfig struct {
+	// the dir of `influxd backup -portable`, with the .manifest, .meta and .tar.gz files
+	Dir string
+	// only the shards of the database and retention policy are read if set
+	Database        string
+	RetentionPolicy string
+	// the dir to extract the shards to, the default dir for temporary files if empty
+	TmpDir string
+	// see TSMSourceConfig
+	Stream         bool
+	SeriesMemLimit int64
+	Filter         *SeriesFilter
+	SkipFiles      bool
+}
+
+// BackupSource reads the shard archives of a portable backup. A shard is extracted to a temp dir
+// when it is opened, and the dir is removed once the shard is closed, so the disk space taken
+// is bounded by the shards being migrated.
+type BackupSource struct {
+	cfg BackupSourceConfig
+	// the meta data of the latest backup, nil if there is no .meta file
+	meta   *meta.Data
+	shards []ShardInfo
+	// shard key to the archives of the shard, in the order of backups
+	archives map[string][]string
+}
+
+// NewBackupSource reads the manifests of the backups in the dir. The backups taken incrementally
+// into the same dir are merged, the TSM files in the later archives overwrite the earlier ones.
+func NewBackupSource(cfg BackupSourceConfig) (*BackupSource, error) {
+	manifests, err := filepath.Glob(filepath.Join(cfg.Dir, "*.manifest"))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if len(manifests) == 0 {
+		return nil, fmt.Errorf("dataMigrate: no .manifest file in backup dir %s", cfg.Dir)
+	}
+	// the manifests are named after the time of the backups
+	sort.Strings(manifests)
+
+	s := &BackupSource{
+		cfg:      cfg,
+		archives: make(map[string][]string),
+	}
+	var metaFile string
+	for _, path := range manifests {
+		buf, err := os.ReadFile(path)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		var manifest backup_util.Manifest
+		if err := json.Unmarshal(buf, &manifest); err != nil {
+			return nil, fmt.Errorf("dataMigrate: invalid manifest %s: %s", path, err)
+		}
+		if manifest.Meta.FileName != "" {
+			metaFile = filepath.Join(cfg.Dir, manifest.Meta.FileName)
+		}
+		for _, e := range manifest.Files {
+			if (cfg.Database != "" && e.Database != cfg.Database) ||
+				(cfg.RetentionPolicy != "" && e.Policy != cfg.RetentionPolicy) {
+				continue
+			}
+			shard := ShardInfo{Database: e.Database, RetentionPolicy: e.Policy, ID: strconv.FormatUint(e.ShardID, 10)}
+			key := shard.key()
+			if len(s.archives[key]) == 0 {
+				s.shards = append(s.shards, shard)
+			}
+			s.archives[key] = append(s.archives[key], filepath.Join(cfg.Dir, e.FileName))
+		}
+	}
+	sortShards(s.shards)
+
+	if metaFile != "" {
+		if s.meta, err = readBackupMeta(metaFile); err != nil {
+			return nil, err
+		}
+		s.logRetentionPolicies()
+	}
+	return s, nil
+}
+
+// logRetentionPolicies logs the definitions of the retention policies to migrate, which are to be
+// created in openGemini.
+func (s *BackupSource) logRetentionPolicies() {
+	logged := make(map[string]struct{})
+	for _, shard := range s.shards {
+		key := joinDbRp(shard.Database, shard.RetentionPolicy)
+		if _, ok := logged[key]; ok {
+			continue
+		}
+		logged[key] = struct{}{}
+		rpi, err := s.meta.RetentionPolicy(shard.Database, shard.RetentionPolicy)
+		if err != nil || rpi == nil {
+			logger.LogString("Backup has no definition of retention policy "+key, TOCONSOLE|TOLOGFILE, LEVEL_WARNING)
+			continue
+		}
+		logger.LogString(fmt.Sprintf("Backup retention policy %s: duration %s, shard group duration %s, replication %d",
+			key, rpi.Duration, rpi.ShardGroupDuration, rpi.ReplicaN), TOCONSOLE|TOLOGFILE, LEVEL_INFO)
+	}
+}
+
+func (s *BackupSource) Shards() ([]ShardInfo, error) {
+	return s.shards, nil
+}
+
+// TimeRange returns the time range of the shard group of the shard in the meta data, the TSM files
+// are extracted to read the time range only if the shard is not found.
+func (s *BackupSource) TimeRange(shard ShardInfo) (min, max int64, err error) {
+	if s.meta != nil {
+		id, _ := strconv.ParseUint(shard.ID, 10, 64)
+		groups, _ := s.meta.ShardGroups(shard.Database, shard.RetentionPolicy)
+		for _, sg := range groups {
+			for _, sh := range sg.Shards {
+				if sh.ID == id {
+					return sg.StartTime.UnixNano(), sg.EndTime.UnixNano() - 1, nil
+				}
+			}
+		}
+	}
+
+	dir, files, err := s.extract(shard)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer os.RemoveAll(dir)
+	if len(files) == 0 {
+		return 0, 0, fmt.Errorf("dataMigrate: no TSM file in shard %s", shard.key())
+	}
+	return filesTimeRange(files, s.cfg.SkipFiles)
+}
+
+func (s *BackupSource) Open(shard ShardInfo, start, end int64) (ShardReader, error) {
+	dir, files, err := s.extract(shard)
+	if err != nil {
+		return nil, err
+	}
+	// the backups have no index, the series dropped before are tombstoned in the TSM files
+	r, err := openTSMShard(files, start, end, shardReadOptions{
+		stream:         s.cfg.Stream,
+		seriesMemLimit: s.cfg.SeriesMemLimit,
+		filter:         s.cfg.Filter,
+		skipFiles:      s.cfg.SkipFiles,
+	})
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	return &backupShardReader{tsmShardReader: r, dir: dir}, nil
+}
+
+func (s *BackupSource) Close() error {
+	return nil
+}
+
+// extract extracts the TSM files and their tombstones of the shard to a temp dir.
+func (s *BackupSource) extract(shard ShardInfo) (dir string, files []string, err error) {
+	dir, err = os.MkdirTemp(s.cfg.TmpDir, "dataMigrate-"+shard.Database+"-"+shard.ID+"-")
+	if err != nil {
+		return "", nil, errors.WithStack(err)
+	}
+	extracted := make(map[string]struct{})
+	for _, archive := range s.archives[shard.key()] {
+		logger.LogString("Extracting shard "+shard.key()+" from "+archive, TOLOGFILE, LEVEL_INFO, ShardField(shard.key()), FileField(archive))
+		if err := extractArchive(archive, dir, extracted); err != nil {
+			os.RemoveAll(dir)
+			return "", nil, err
+		}
+	}
+	for name := range extracted {
+		files = append(files, name)
+	}
+	sort.Strings(files)
+	return dir, files, nil
+}
+
+// extractArchive extracts the TSM and tombstone files in the .tar.gz archive of a shard into dir,
+// and adds the TSM files to extracted.
+func extractArchive(archive, dir string, extracted map[string]struct{}) error {
+	f, err := os.Open(archive)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		return fmt.Errorf("dataMigrate: invalid shard archive %s: %s", archive, err)
+	}
+	defer zr.Close()
+
+	tr := tar.NewReader(zr)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("dataMigrate: invalid shard archive %s: %s", archive, err)
+		}
+		if h.Typeflag != tar.TypeReg {
+			continue
+		}
+		// the files are named db/rp/shard id/file, the index of the shard is not needed
+		name := filepath.Base(filepath.FromSlash(h.Name))
+		ext := filepath.Ext(name)
+		if ext != "."+tsm1.TSMFileExtension && ext != "."+tsm1.TombstoneFileExtension {
+			continue
+		}
+		path := filepath.Join(dir, name)
+		if err := writeFile(path, tr); err != nil {
+			return err
+		}
+		if ext == "."+tsm1.TSMFileExtension {
+			extracted[path] = struct{}{}
+		}
+	}
+}
+
+func writeFile(path string, r io.Reader) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(f.Close())
+}
+
+// backupShardReader removes the files extracted once the shard is closed.
+type backupShardReader struct {
+	*tsmShardReader
+	dir string
+}
+
+func (r *backupShardReader) Close() error {
+	err := r.tsmShardReader.Close()
+	if rerr := os.RemoveAll(r.dir); err == nil {
+		err = errors.WithStack(rerr)
+	}
+	return err
+}
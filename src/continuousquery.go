@@ -0,0 +1,120 @@
+package src
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/influxdata/influxql"
+)
+
+// the aggregate functions the continuous queries of openGemini support
+var supportedCQFunctions = map[string]bool{
+	"count": true,
+	"sum":   true,
+	"mean":  true,
+	"min":   true,
+	"max":   true,
+	"first": true,
+	"last":  true,
+}
+
+// translateContinuousQuery rewrites the continuous query for openGemini, the databases and retention
+// policies it refers to are mapped by the mapping table. An error is returned if it cannot be translated.
+func translateContinuousQuery(cq continuousQueryInfo, mapping mappingTable) (database string, query string, err error) {
+	stmt, err := influxql.ParseStatement(cq.query)
+	if err != nil {
+		return "", "", fmt.Errorf("parse query: %s", err)
+	}
+	cqStmt, ok := stmt.(*influxql.CreateContinuousQueryStatement)
+	if !ok {
+		return "", "", fmt.Errorf("not a CREATE CONTINUOUS QUERY statement")
+	}
+
+	// resolve returns the destination of db/rp, the rp is kept empty if it is still the default one
+	resolve := func(db, rp string) (string, string) {
+		if db == "" {
+			db = cqStmt.Database
+		}
+		srcRP := rp
+		if srcRP == "" {
+			srcRP = cq.defaultRP
+		}
+		dstDB, dstRP := mapping.resolve(db, srcRP)
+		if rp == "" && dstRP == srcRP {
+			dstRP = ""
+		}
+		return dstDB, dstRP
+	}
+
+	var reasons []string
+	influxql.WalkFunc(cqStmt.Source.Fields, func(n influxql.Node) {
+		if call, ok := n.(*influxql.Call); ok && !supportedCQFunctions[strings.ToLower(call.Name)] {
+			reasons = append(reasons, "unsupported function "+call.Name+"()")
+		}
+	})
+	influxql.WalkFunc(cqStmt.Source, func(n influxql.Node) {
+		switch n := n.(type) {
+		case *influxql.SubQuery:
+			reasons = append(reasons, "subqueries are not supported")
+		case *influxql.Measurement:
+			if n.Regex != nil {
+				reasons = append(reasons, "regular expression sources are not supported")
+			}
+			if n.Database == "" && n.RetentionPolicy == "" {
+				// keep the measurement relative to the database of the query if possible
+				if _, rp := resolve("", ""); rp == "" {
+					return
+				}
+			}
+			n.Database, n.RetentionPolicy = resolve(n.Database, n.RetentionPolicy)
+		}
+	})
+	if len(reasons) > 0 {
+		return "", "", fmt.Errorf("%s", strings.Join(reasons, ", "))
+	}
+
+	cqStmt.Database, _ = resolve(cqStmt.Database, "")
+	return cqStmt.Database, cqStmt.String(), nil
+}
+
+// migrateContinuousQueries recreates the continuous queries of the source InfluxDB in openGemini.
+// The queries which cannot be translated or created are reported, but do not fail the run.
+func (cmd *DataMigrateCommand) migrateContinuousQueries() error {
+	logger.LogString("Migrating continuous queries", TOCONSOLE|TOLOGFILE, LEVEL_INFO)
+	is, err := NewInfluxService(cmd)
+	if err != nil {
+		return err
+	}
+	cqs, err := is.GetContinuousQueries()
+	if err != nil {
+		return err
+	}
+
+	var migrated, failed int
+	for _, cq := range cqs {
+		if cmd.opt.Database != "" && cq.database != cmd.opt.Database {
+			continue
+		}
+		name := cq.database + "." + cq.name
+		db, query, err := translateContinuousQuery(cq, cmd.mapping)
+		if err != nil {
+			failed++
+			logger.LogString("Continuous query "+name+" cannot be translated: "+err.Error()+", query: "+cq.query,
+				TOCONSOLE|TOLOGFILE, LEVEL_WARNING)
+			continue
+		}
+		if err := cmd.gs.CreateContinuousQuery(db, query); err != nil {
+			failed++
+			logger.LogString("Continuous query "+name+" cannot be created: "+err.Error()+", query: "+query,
+				TOCONSOLE|TOLOGFILE, LEVEL_WARNING)
+			continue
+		}
+		migrated++
+		logger.LogString("Continuous query "+name+" migrated: "+query, TOLOGFILE, LEVEL_INFO)
+	}
+
+	logger.LogString("Continuous queries: "+strconv.Itoa(migrated)+" migrated, "+strconv.Itoa(failed)+" failed.",
+		TOCONSOLE|TOLOGFILE, LEVEL_INFO)
+	return nil
+}
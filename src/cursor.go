@@ -19,11 +19,8 @@ import (
 	"fmt"
 	"math"
 	"sort"
-	"strings"
-	"time"
 
 	"github.com/influxdata/influxdb/tsdb/engine/tsm1"
-	client "github.com/influxdata/influxdb1-client/v2"
 )
 
 type location struct {
@@ -151,6 +148,10 @@ func (c *Cursor) readBlock() (tsm1.Values, error) {
 			logger.LogString("Read block failed: "+err.Error(), TOLOGFILE, LEVEL_ERROR)
 			return nil, err
 		}
+		// the tombstones are inclusive, and may cover only part of the block
+		for _, tomb := range tombstones {
+			values = tsm1.Values(values).Exclude(tomb.Min, tomb.Max)
+		}
 		for _, v := range values {
 			ts := v.UnixNano()
 			if ts <= c.readTs {
@@ -159,11 +160,6 @@ func (c *Cursor) readBlock() (tsm1.Values, error) {
 			if ts > upperBound {
 				break
 			}
-			for _, tomb := range tombstones {
-				if ts > tomb.Min && ts < tomb.Max {
-					continue
-				}
-			}
 			buf = append(buf, v)
 		}
 		e.readMax = upperBound
@@ -191,7 +187,7 @@ func (c *Cursor) readBlock() (tsm1.Values, error) {
 	return sortAndDeduplicateValues(&buf), nil
 }
 
-func (c *Cursor) peek() (tsm1.Value, error) {
+func (c *Cursor) Peek() (tsm1.Value, error) {
 	if len(c.buf) > 0 && c.pos < len(c.buf) {
 		return c.buf[c.pos], nil
 	}
@@ -204,10 +200,10 @@ func (c *Cursor) peek() (tsm1.Value, error) {
 	if c.buf == nil {
 		return nil, nil
 	}
-	return c.peek()
+	return c.Peek()
 }
 
-func (c *Cursor) next() (tsm1.Value, error) {
+func (c *Cursor) Next() (tsm1.Value, error) {
 	if len(c.buf) > 0 && c.pos < len(c.buf) {
 		c.pos++
 		return c.buf[c.pos-1], nil
@@ -221,7 +217,7 @@ func (c *Cursor) next() (tsm1.Value, error) {
 	if c.buf == nil {
 		return nil, nil
 	}
-	return c.next()
+	return c.Next()
 }
 
 // referenced from https://github.com/influxdata/influxdb/tree/v1.8.2/tsdb/engine/tsm1/encoding.gen.go
@@ -246,7 +242,7 @@ func sortAndDeduplicateValues(buf *[]tsm1.Value) []tsm1.Value {
 }
 
 type heapCursor struct {
-	items []*Cursor
+	items []FieldCursor
 }
 
 func (h *heapCursor) Len() int {
@@ -255,8 +251,8 @@ func (h *heapCursor) Len() int {
 
 func (h *heapCursor) Less(i, j int) bool {
 	x, y := h.items[i], h.items[j]
-	xv, _ := x.peek()
-	yv, _ := y.peek()
+	xv, _ := x.Peek()
+	yv, _ := y.Peek()
 	if xv == nil {
 		return false
 	}
@@ -271,7 +267,7 @@ func (h *heapCursor) Swap(i, j int) {
 }
 
 func (h *heapCursor) Push(x interface{}) {
-	h.items = append(h.items, x.(*Cursor))
+	h.items = append(h.items, x.(FieldCursor))
 }
 
 func (h *heapCursor) Pop() interface{} {
@@ -282,31 +278,56 @@ func (h *heapCursor) Pop() interface{} {
 	return item
 }
 
+// fieldValue is the value of a field at some time.
+type fieldValue struct {
+	key   string
+	value tsm1.Value
+}
+
+// row is a point of a series, assembled from the values of the field cursors at the same time.
+type row struct {
+	ts     int64
+	fields []fieldValue
+}
+
 type Scanner struct {
+	// the escaped series key
+	series      string
 	measurement string
 	tags        map[string]string
-	fields      map[string]*Cursor
+	fields      map[string]FieldCursor
 	heapCursor  *heapCursor
+
+	row         row
+	aggregators []*aggregator
+	// retention policy to the batch being assembled
+	batches map[string]*Batch
+	// retention policy to the last row, which is held back to merge the rows colliding after truncation
+	pending map[string]*row
 }
 
-func (s *Scanner) nextPoint(cmd Migrator) (*client.Point, error) {
+// nextRow assembles the next row of the series, the returned row is only valid until the next call.
+// nil is returned if all the field cursors are exhausted.
+func (s *Scanner) nextRow(cmd Migrator) (*row, error) {
 	// determine the current timestamp
 	var curTs int64 = math.MaxInt64
-	// min heap
-	currItem := heap.Pop(s.heapCursor).(*Cursor) // min heap
-	currVal, _ := currItem.peek()
-	if currVal != nil {
-		curTs = currVal.UnixNano()
-		heap.Push(s.heapCursor, currItem)
+	// the cursors advanced by the last call, so the min heap has to be rebuilt
+	heap.Init(s.heapCursor)
+	if len(s.heapCursor.items) > 0 {
+		currVal, _ := s.heapCursor.items[0].Peek()
+		if currVal != nil {
+			curTs = currVal.UnixNano()
+		}
 	}
 
 	if curTs == math.MaxInt64 {
 		return nil, nil
 	}
 	// assembles points here
-	fields := map[string]interface{}{}
+	s.row.ts = curTs
+	s.row.fields = s.row.fields[:0]
 	for field, cursor := range s.fields {
-		v, err := cursor.peek()
+		v, err := cursor.Peek()
 		if err != nil {
 			return nil, err
 		}
@@ -314,81 +335,166 @@ func (s *Scanner) nextPoint(cmd Migrator) (*client.Point, error) {
 			continue
 		}
 		if curTs == v.UnixNano() {
-			_, err := cursor.next()
+			_, err := cursor.Next()
 			if err != nil {
 				return nil, err
 			}
-			fields[field] = v.Value()
+			s.row.fields = append(s.row.fields, fieldValue{key: field, value: v})
 		}
 	}
 
 	// statistics
 	for t := range s.tags {
-		cmd.getStat().tagsRead[s.measurement+t] = struct{}{}
-		cmd.getGStat().tagsTotal.Store(s.measurement+t, struct{}{})
+		key := measurementKey(s.measurement, t)
+		cmd.getStat().tagsRead[key] = struct{}{}
+		cmd.getGStat().tagsTotal.Store(key, struct{}{})
 	}
-	for f := range fields {
-		cmd.getStat().fieldsRead[s.measurement+f] = struct{}{}
-		cmd.getGStat().fieldTotal.Store(s.measurement+f, struct{}{})
+	for _, f := range s.row.fields {
+		key := measurementKey(s.measurement, f.key)
+		cmd.getStat().fieldsRead[key] = struct{}{}
+		cmd.getGStat().fieldTotal.Store(key, struct{}{})
 	}
+	cmd.getStat().rowsRead++
 
-	return client.NewPoint(s.measurement, s.tags, fields, time.Unix(0, curTs))
+	return &s.row, nil
 }
 
-func (s *Scanner) writeBatches(c client.Client, cmd Migrator) error {
-	count := 0
-	var bp client.BatchPoints
-	flag := true
-	for {
-		if flag {
-			bp, _ = client.NewBatchPoints(client.BatchPointsConfig{
-				Database:        cmd.getDatabase(),
-				RetentionPolicy: cmd.getRetentionPolicy(),
-				Precision:       "ns",
-			})
-			flag = false
+// aggregatorOf returns the aggregator which the row at ts should be downsampled by,
+// or nil if the row should be written as it is.
+func (s *Scanner) aggregatorOf(ts int64) *aggregator {
+	for _, agg := range s.aggregators {
+		if ts < agg.rule.cutoff {
+			return agg
+		}
+	}
+	return nil
+}
+
+func (s *Scanner) writeBatches(sink Sink, cmd Migrator) error {
+	if rules := cmd.getDownsampleRules(); len(s.aggregators) != len(rules) {
+		s.aggregators = s.aggregators[:0]
+		for _, rule := range rules {
+			s.aggregators = append(s.aggregators, newAggregator(rule))
 		}
+	}
 
-		pt, err := s.nextPoint(cmd)
+	for {
+		r, err := s.nextRow(cmd)
 		if err != nil {
-			logger.LogString("point read error: "+err.Error(), TOLOGFILE|TOCONSOLE, LEVEL_ERROR)
+			logger.LogString("point read error: "+err.Error(), TOLOGFILE|TOCONSOLE, LEVEL_ERROR, SeriesField(s.series))
 			return err
 		}
-
-		if pt == nil {
-			rowsNum := len(bp.Points())
-			s.retryWrite(c, bp)
-			cmd.getStat().rowsRead += rowsNum
+		if r == nil {
 			break
 		}
 
-		bp.AddPoint(pt)
-		count = count + 1
-		if count == cmd.getBatchSize() {
-			s.retryWrite(c, bp)
-			cmd.getStat().rowsRead += cmd.getBatchSize()
-			flag = true
-			count = 0
+		if agg := s.aggregatorOf(r.ts); agg != nil {
+			cmd.getStat().rowsDownsampled++
+			if out := agg.add(r); out != nil {
+				cmd.getStat().rowsAggregated++
+				if err := s.addRow(sink, cmd, agg.rule.rp, out); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		if err := s.addRow(sink, cmd, "", r); err != nil {
+			return err
 		}
 	}
-	return nil
-}
 
-func (s *Scanner) retryWrite(c client.Client, bp client.BatchPoints) {
-	for {
-		err := c.Write(bp)
-		if err == nil {
-			break
+	for _, agg := range s.aggregators {
+		if out := agg.flush(); out != nil {
+			cmd.getStat().rowsAggregated++
+			if err := s.addRow(sink, cmd, agg.rule.rp, out); err != nil {
+				return err
+			}
 		}
-		logger.LogString("insert error: "+err.Error(), TOLOGFILE|TOCONSOLE, LEVEL_ERROR)
-		if strings.Contains(err.Error(), "point time is expired") {
-			logger.LogString("point time is expired : Skiped", TOLOGFILE|TOCONSOLE, LEVEL_ERROR)
-			break
+	}
+	for rp, p := range s.pending {
+		if len(p.fields) > 0 {
+			if err := s.appendRow(sink, cmd, rp, p); err != nil {
+				return err
+			}
+		}
+		p.fields = p.fields[:0]
+	}
+	for rp, b := range s.batches {
+		delete(s.batches, rp)
+		if err := s.writeBatch(sink, cmd, b); err != nil {
+			return err
 		}
-		points := bp.Points()
-		if len(points) > 0 {
-			logger.LogString("retry for points like:"+points[0].String(), TOLOGFILE|TOCONSOLE, LEVEL_ERROR)
+	}
+	return nil
+}
+
+// addRow transforms the timestamp of the row and adds it to the batch of the retention policy.
+// An empty rp means the destination retention policy of the migrator.
+func (s *Scanner) addRow(sink Sink, cmd Migrator, rp string, r *row) error {
+	if rp == "" {
+		rp = cmd.getRetentionPolicy()
+	}
+	t := cmd.getTimeTransform()
+	r.ts = t.apply(r.ts)
+	if !t.truncates() {
+		return s.appendRow(sink, cmd, rp, r)
+	}
+
+	// the rows are in ascending order of time, so only the adjacent rows can collide
+	if s.pending == nil {
+		s.pending = make(map[string]*row)
+	}
+	p, ok := s.pending[rp]
+	if !ok {
+		p = &row{}
+		s.pending[rp] = p
+	}
+	if len(p.fields) > 0 && p.ts == r.ts {
+		t.mergeRow(p, r)
+		cmd.getStat().rowsDeduplicated++
+		return nil
+	}
+	if len(p.fields) > 0 {
+		if err := s.appendRow(sink, cmd, rp, p); err != nil {
+			return err
 		}
-		time.Sleep(3 * time.Second)
 	}
+	p.ts = r.ts
+	p.fields = append(p.fields[:0], r.fields...)
+	return nil
+}
+
+// appendRow adds the row to the batch of the retention policy, and writes the batch once it is full.
+func (s *Scanner) appendRow(sink Sink, cmd Migrator, rp string, r *row) error {
+	if s.batches == nil {
+		s.batches = make(map[string]*Batch)
+	}
+	b, ok := s.batches[rp]
+	if !ok {
+		b = getBatch(cmd.getDatabase(), rp, cmd.getTimeTransform().getPrecision())
+		s.batches[rp] = b
+	}
+
+	sortFields(r.fields)
+	b.Lines = appendLine(b.Lines, s.series, r.fields, r.ts, cmd.getTimeTransform().getUnit())
+	b.Points++
+	if b.Points >= cmd.getBatchSize() {
+		delete(s.batches, rp)
+		return s.writeBatch(sink, cmd, b)
+	}
+	return nil
+}
+
+func (s *Scanner) writeBatch(sink Sink, cmd Migrator, b *Batch) error {
+	defer putBatch(b)
+	if b.Points == 0 {
+		return nil
+	}
+	if err := sink.Write(b); err != nil {
+		return &sinkError{err: err}
+	}
+	cmd.getStat().rowsWritten += b.Points - b.Rejected
+	cmd.getStat().rowsRejected += b.Rejected
+	cmd.getStat().bytesWritten += int64(len(b.Lines))
+	return nil
 }
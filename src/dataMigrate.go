@@ -22,16 +22,13 @@ import (
 	"net/http"
 	_ "net/http/pprof"
 	"os"
-	"path/filepath"
 	"runtime"
-	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/influxdata/influxdb/models"
-	"github.com/influxdata/influxdb/tsdb/engine/tsm1"
 	"github.com/pkg/errors"
 	"go.uber.org/atomic"
 	"golang.org/x/sync/errgroup"
@@ -51,16 +48,10 @@ var (
 	}
 )
 
-type fileGroupInfo struct {
-	db  string
-	rp  string
-	sid string
-}
-
 type shardGroupInfo struct {
 	db       string
 	rp       string
-	sids     []string
+	shards   []ShardInfo
 	min, max time.Time
 }
 
@@ -68,11 +59,50 @@ func (sgi *shardGroupInfo) Contains(t time.Time) bool {
 	return !t.Before(sgi.min) && t.Before(sgi.max)
 }
 
+// globalStatInfo is the statistics of all the shards, see statInfo. The series are counted per
+// shard, so a series in several shards is counted several times.
 type globalStatInfo struct {
 	progress   atomic.Int64
 	tagsTotal  sync.Map
 	fieldTotal sync.Map
 	rowsTotal  atomic.Int64
+
+	rowsWritten      atomic.Int64
+	rowsDeduplicated atomic.Int64
+	rowsDownsampled  atomic.Int64
+	rowsAggregated   atomic.Int64
+	rowsRejected     atomic.Int64
+	seriesTotal      atomic.Int64
+	seriesSkipped    atomic.Int64
+	bytesWritten     atomic.Int64
+}
+
+// add adds the statistics of a shard.
+func (g *globalStatInfo) add(s *statInfo) {
+	g.rowsTotal.Add(int64(s.rowsRead))
+	g.rowsWritten.Add(int64(s.rowsWritten))
+	g.rowsDeduplicated.Add(int64(s.rowsDeduplicated))
+	g.rowsDownsampled.Add(int64(s.rowsDownsampled))
+	g.rowsAggregated.Add(int64(s.rowsAggregated))
+	g.rowsRejected.Add(int64(s.rowsRejected))
+	g.seriesTotal.Add(int64(s.seriesRead))
+	g.seriesSkipped.Add(int64(s.seriesSkipped))
+	g.bytesWritten.Add(s.bytesWritten)
+}
+
+// total returns the statistics of all the shards, without the tags and the fields.
+func (g *globalStatInfo) total() *statInfo {
+	return &statInfo{
+		rowsRead:         int(g.rowsTotal.Load()),
+		rowsWritten:      int(g.rowsWritten.Load()),
+		rowsDeduplicated: int(g.rowsDeduplicated.Load()),
+		rowsDownsampled:  int(g.rowsDownsampled.Load()),
+		rowsAggregated:   int(g.rowsAggregated.Load()),
+		rowsRejected:     int(g.rowsRejected.Load()),
+		seriesRead:       int(g.seriesTotal.Load()),
+		seriesSkipped:    int(g.seriesSkipped.Load()),
+		bytesWritten:     g.bytesWritten.Load(),
+	}
 }
 
 type DataMigrateCommand struct {
@@ -82,12 +112,31 @@ type DataMigrateCommand struct {
 
 	opt *DataMigrateOptions
 
-	manifest []fileGroupInfo
-	tsmFiles map[string][]string
-
-	shardGroupDuration time.Duration
-	shardGroups        []shardGroupInfo
-	gstat              *globalStatInfo
+	// Source is where the data is read from. It is built from the options if not set,
+	// which allows the migration to be embedded with other sources.
+	Source Source
+	// whether the source is built from the options, so it is closed after migrating
+	ownSource bool
+	shards    []ShardInfo
+	mapping   mappingTable
+
+	downsampleRules []*downsampleRule
+	timeTransform   *timeTransform
+
+	gs GeminiService
+	// Sink receives the data of all the shards. It is built from the options if not set,
+	// which allows the migration to be embedded with other sinks.
+	Sink Sink
+	// whether the sink is built from the options, so it is closed after migrating
+	ownSink bool
+	// destination db/rp to shard group duration
+	shardGroupDurations map[string]time.Duration
+	shardGroups         []shardGroupInfo
+	gstat               *globalStatInfo
+	// the shards and the files skipped by --on-error
+	skipped skippedUnits
+	// the corrupt blocks found by --verify
+	corrupt []CorruptBlock
 }
 
 // NewDataMigrateCommand returns a new instance of DataMigrateCommand.
@@ -98,10 +147,9 @@ func NewDataMigrateCommand(opt *DataMigrateOptions) *DataMigrateCommand {
 
 		opt: opt,
 
-		manifest:    make([]fileGroupInfo, 0),
-		tsmFiles:    make(map[string][]string),
-		shardGroups: make([]shardGroupInfo, 0),
-		gstat:       &globalStatInfo{},
+		shardGroupDurations: make(map[string]time.Duration),
+		shardGroups:         make([]shardGroupInfo, 0),
+		gstat:               &globalStatInfo{},
 	}
 }
 
@@ -131,29 +179,53 @@ func (cmd *DataMigrateCommand) Run() error {
 	if err := cmd.validate(); err != nil {
 		return err
 	}
+	if err := cmd.loadMapping(); err != nil {
+		return err
+	}
+	downsampleRules, err := parseDownsampleRules(cmd.opt.Downsamples, time.Now())
+	if err != nil {
+		return err
+	}
+	cmd.downsampleRules = downsampleRules
+	timeTransform, err := newTimeTransform(cmd.opt.TimeShift, cmd.opt.Precision, cmd.opt.DedupPolicy)
+	if err != nil {
+		return err
+	}
+	cmd.timeTransform = timeTransform
 
 	logger.LogString("Data migrate tool starting", TOCONSOLE, LEVEL_INFO)
 
 	// write params to log
 	logger.LogString("Got param \"from\": "+cmd.opt.DataDir, TOLOGFILE, LEVEL_INFO)
 	logger.LogString("Got param \"to\": "+cmd.opt.Out, TOLOGFILE, LEVEL_INFO)
+	logger.LogString("Got param \"balance\": "+cmd.opt.Balance, TOLOGFILE, LEVEL_INFO)
 	logger.LogString("Got param \"database\": "+cmd.opt.Database, TOLOGFILE, LEVEL_INFO)
 	logger.LogString("Got param \"dest_database\": "+cmd.opt.DestDatabase, TOLOGFILE, LEVEL_INFO)
 	logger.LogString("Got param \"retention\": "+cmd.opt.RetentionPolicy, TOLOGFILE, LEVEL_INFO)
+	for _, rule := range cmd.mapping {
+		logger.LogString("Got mapping rule: "+rule.String(), TOLOGFILE, LEVEL_INFO)
+	}
+	for _, rule := range cmd.downsampleRules {
+		logger.LogString("Got downsample rule: "+rule.String(), TOLOGFILE, LEVEL_INFO)
+	}
+	logger.LogString("Got time transform: "+cmd.timeTransform.String(), TOLOGFILE, LEVEL_INFO)
 	logger.LogString("Got param \"start\": "+cmd.opt.Start, TOLOGFILE, LEVEL_INFO)
 	logger.LogString("Got param \"end\": "+cmd.opt.End, TOLOGFILE, LEVEL_INFO)
 	logger.LogString("Got param \"batch\": "+strconv.Itoa(cmd.opt.BatchSize), TOLOGFILE, LEVEL_INFO)
 
-	gs := NewGeminiService(cmd)
-	db := cmd.opt.Database
-	if cmd.opt.DestDatabase != "" {
-		db = cmd.opt.DestDatabase
+	cmd.gs = NewGeminiService(cmd)
+	if cmd.Source == nil {
+		if cmd.Source, err = newSource(cmd.opt); err != nil {
+			return err
+		}
+		cmd.ownSource = true
 	}
-	shardGroupDuration, err := gs.GetShardGroupDuration(db)
-	if err != nil {
-		return err
+	if cmd.Sink == nil {
+		if cmd.Sink, err = newSink(cmd.opt); err != nil {
+			return err
+		}
+		cmd.ownSink = true
 	}
-	cmd.shardGroupDuration = shardGroupDuration
 
 	if cmd.opt.Debug {
 		logger.SetDebug()
@@ -168,7 +240,18 @@ func (cmd *DataMigrateCommand) Run() error {
 		}
 	}()
 
-	return cmd.runMigrate()
+	if err := cmd.runMigrate(); err != nil {
+		return err
+	}
+	if cmd.opt.MigrateCQ {
+		if err := cmd.migrateContinuousQueries(); err != nil {
+			return err
+		}
+	}
+	if cmd.opt.MigrateUsers {
+		return cmd.migrateUsers()
+	}
+	return nil
 }
 
 func (cmd *DataMigrateCommand) setOutput(url string) {
@@ -186,15 +269,86 @@ func (cmd *DataMigrateCommand) validate() error {
 	if cmd.opt.StartTime != 0 && cmd.opt.EndTime != 0 && cmd.opt.EndTime < cmd.opt.StartTime {
 		return fmt.Errorf("dataMigrate: end time before start time")
 	}
+	if cmd.opt.MigrateCQ && cmd.opt.MetaDir == "" && cmd.opt.SrcHost == "" {
+		return fmt.Errorf("dataMigrate: --migrate-cq requires --meta or --src-host")
+	}
+	if cmd.opt.MigrateUsers && cmd.opt.MetaDir == "" && cmd.opt.SrcHost == "" {
+		return fmt.Errorf("dataMigrate: --migrate-users requires --meta or --src-host")
+	}
+	if cmd.opt.Online && cmd.opt.SrcHost == "" {
+		return fmt.Errorf("dataMigrate: --online requires --src-host")
+	}
+	if cmd.opt.MigrateUsers && cmd.opt.UsersOutput == "" {
+		return fmt.Errorf("dataMigrate: --migrate-users requires --users-output")
+	}
+	if err := checkCompression(cmd.opt.Compress, cmd.opt.CompressLevel); err != nil {
+		return err
+	}
+	if err := checkOnError(cmd.opt.OnError); err != nil {
+		return err
+	}
+	if err := checkVerify(cmd.opt.Verify); err != nil {
+		return err
+	}
+	if cmd.opt.Incremental != "" && cmd.opt.Online {
+		return fmt.Errorf("dataMigrate: --incremental is not supported with --online, use --checkpoint instead")
+	}
+	// the files recorded are not read again, so all the data of them must be migrated
+	if cmd.opt.Incremental != "" && (cmd.opt.Start != "" || cmd.opt.End != "") {
+		return fmt.Errorf("dataMigrate: --incremental cannot be used with --start or --end")
+	}
+	if cmd.opt.Incremental != "" && (len(cmd.opt.Measurements) > 0 || len(cmd.opt.Tags) > 0) {
+		return fmt.Errorf("dataMigrate: --incremental cannot be used with --measurement or --tag")
+	}
+
 	return nil
 }
 
+// compressionRatio describes the size of the line protocol against the size sent.
+func compressionRatio(written, sent int64) string {
+	if sent == 0 {
+		return "no bytes sent"
+	}
+	return fmt.Sprintf("%d bytes compressed to %d, ratio %.2f", written, sent, float64(written)/float64(sent))
+}
+
 func (cmd *DataMigrateCommand) runMigrate() error {
 	st := time.Now()
-	if err := cmd.walkTSMFiles(); err != nil {
+	logger.LogString("Searching for shards to migrate", TOCONSOLE|TOLOGFILE, LEVEL_INFO)
+	shards, err := cmd.Source.Shards()
+	if err != nil {
 		return err
 	}
-	if err := cmd.migrate(); err != nil {
+	cmd.shards = shards
+	// nothing is written if the verification fails
+	err = cmd.verify()
+	if err == nil && cmd.opt.CheckSchema {
+		err = cmd.checkSchema()
+	}
+	if err == nil {
+		err = cmd.migrate()
+	}
+	// write out the data buffered
+	if ferr := cmd.Sink.Flush(); err == nil {
+		err = ferr
+	}
+	if cmd.ownSink {
+		if cerr := cmd.Sink.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if cmd.ownSource {
+		if cerr := cmd.Source.Close(); err == nil {
+			err = cerr
+		}
+	}
+	// the report is written for the failed migrations as well
+	if cmd.opt.Report != "" {
+		if rerr := cmd.writeReport(st, err); err == nil {
+			err = rerr
+		}
+	}
+	if err != nil {
 		return err
 	}
 	eclipse := time.Since(st)
@@ -209,118 +363,53 @@ func (cmd *DataMigrateCommand) runMigrate() error {
 		fieldTotal++
 		return true
 	})
-	logger.LogString("Total: takes "+eclipse.String()+" to migrate, with "+
-		strconv.Itoa(tagsTotal)+" tags, "+strconv.Itoa(fieldTotal)+
-		" fields, "+strconv.Itoa(int(cmd.gstat.rowsTotal.Load()))+" rows read.", TOCONSOLE|TOLOGFILE, LEVEL_INFO)
-	return nil
-}
-
-func (cmd *DataMigrateCommand) walkTSMFiles() error {
-	logger.LogString("Searching for tsm files to migrate", TOCONSOLE|TOLOGFILE, LEVEL_INFO)
-	err := filepath.Walk(cmd.opt.DataDir, func(path string, f os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-		// check to see if this is a tsm file
-		if filepath.Ext(path) != "."+tsm1.TSMFileExtension {
-			return nil
-		}
-
-		relPath, err := filepath.Rel(cmd.opt.DataDir, path)
-		if err != nil {
-			return err
-		}
-		dirs := strings.Split(relPath, string(byte(os.PathSeparator)))
-		if len(dirs) < 4 {
-			return fmt.Errorf("invalid directory structure for %s", path)
-		}
-
-		if (dirs[0] == cmd.opt.Database || cmd.opt.Database == "") &&
-			(dirs[1] == cmd.opt.RetentionPolicy || cmd.opt.RetentionPolicy == "") {
-			key := filepath.Join(dirs[0], dirs[1], dirs[2])
-			cmd.tsmFiles[key] = append(cmd.tsmFiles[key], path)
-			if len(cmd.tsmFiles[key]) == 1 {
-				cmd.manifest = append(cmd.manifest, fileGroupInfo{
-					db:  dirs[0],
-					rp:  dirs[1],
-					sid: dirs[2],
-				})
-			}
-		}
-		return nil
-	})
-	if err != nil {
-		return err
+	msg := "Total: takes " + eclipse.String() + " to migrate, with " + cmd.gstat.total().summary(tagsTotal, fieldTotal) +
+		cmd.skipped.summary()
+	if cmd.opt.Compress == compressGzip {
+		stats := cmd.Sink.Stats()
+		msg += ", " + compressionRatio(stats.BytesWritten, stats.BytesSent)
 	}
-	// sort by db first, then by rp, then by sid
-	sort.Slice(cmd.manifest, func(i, j int) bool {
-		dbCmp := strings.Compare(cmd.manifest[i].db, cmd.manifest[j].db)
-		if dbCmp != 0 {
-			return dbCmp < 0
-		}
-		rpCmp := strings.Compare(cmd.manifest[i].rp, cmd.manifest[j].rp)
-		if rpCmp != 0 {
-			return rpCmp < 0
+	logger.LogString(msg+".", TOCONSOLE|TOLOGFILE, LEVEL_INFO)
+	if f, ok := cmd.Sink.(*FanoutSink); ok && len(f.targets) > 1 {
+		for _, line := range f.report() {
+			logger.LogString(line, TOCONSOLE|TOLOGFILE, LEVEL_INFO)
 		}
-		sid_i, _ := strconv.Atoi(cmd.manifest[i].sid)
-		sid_j, _ := strconv.Atoi(cmd.manifest[j].sid)
-		return sid_i < sid_j
-	})
-	return nil
-}
-
-func (cmd *DataMigrateCommand) fileTimeRange(file string) (min, max int64, err error) {
-	f, err := os.Open(file)
-	if err != nil {
-		return 0, 0, errors.WithStack(err)
-	}
-	defer f.Close()
-
-	r, err := tsm1.NewTSMReader(f)
-	if err != nil {
-		logger.LogString(fmt.Sprintf("unable to read %s, skipping: %s", file, err.Error()), TOLOGFILE|TOCONSOLE, LEVEL_ERROR)
-		return 0, 0, errors.WithStack(err)
 	}
-	defer r.Close()
-
-	min, max = r.TimeRange()
-	return
+	return nil
 }
 
-func (cmd *DataMigrateCommand) shardTimeRange(files []string) (min, max int64, err error) {
-	sort.Strings(files)
-	if len(files) == 1 {
-		return cmd.fileTimeRange(files[0])
+// shardGroupDuration returns the shard group duration of the destination db/rp, which is queried only once.
+func (cmd *DataMigrateCommand) shardGroupDuration(db, rp string) (time.Duration, error) {
+	key := joinDbRp(db, rp)
+	if d, ok := cmd.shardGroupDurations[key]; ok {
+		return d, nil
 	}
-	min, _, err = cmd.fileTimeRange(files[0])
+	d, err := cmd.gs.GetShardGroupDuration(db, rp)
 	if err != nil {
-		return 0, 0, errors.WithStack(err)
+		return 0, err
 	}
-	_, max, err = cmd.fileTimeRange(files[len(files)-1])
-	if err != nil {
-		return 0, 0, errors.WithStack(err)
-	}
-	return
+	cmd.shardGroupDurations[key] = d
+	return d, nil
 }
 
-func (cmd *DataMigrateCommand) shardGroupByTimestamp(timestamp time.Time) *shardGroupInfo {
+func (cmd *DataMigrateCommand) shardGroupByTimestamp(timestamp time.Time, shard ShardInfo) *shardGroupInfo {
 	for i := range cmd.shardGroups {
 		sgi := &cmd.shardGroups[i]
-		if sgi.Contains(timestamp) {
+		if sgi.db == shard.Database && sgi.rp == shard.RetentionPolicy && sgi.Contains(timestamp) {
 			return &cmd.shardGroups[i]
 		}
 	}
 	return nil
 }
 
-func (cmd *DataMigrateCommand) createShardGroupInfo(timestamp time.Time, info fileGroupInfo) shardGroupInfo {
+func (cmd *DataMigrateCommand) createShardGroupInfo(timestamp time.Time, shard ShardInfo, duration time.Duration) shardGroupInfo {
 	sgi := shardGroupInfo{
-		db:   info.db,
-		rp:   info.rp,
-		sids: make([]string, 0),
+		db:     shard.Database,
+		rp:     shard.RetentionPolicy,
+		shards: make([]ShardInfo, 0),
 	}
-	sgi.min = timestamp.Truncate(cmd.shardGroupDuration).UTC()
-	sgi.max = sgi.min.Add(cmd.shardGroupDuration).UTC()
+	sgi.min = timestamp.Truncate(duration).UTC()
+	sgi.max = sgi.min.Add(duration).UTC()
 	if sgi.max.After(time.Unix(0, models.MaxNanoTime)) {
 		// Shard group range is [start, end) so add one to the max time.
 		sgi.max = time.Unix(0, models.MaxNanoTime+1)
@@ -329,45 +418,66 @@ func (cmd *DataMigrateCommand) createShardGroupInfo(timestamp time.Time, info fi
 }
 
 func (cmd *DataMigrateCommand) populateShardGroups() error {
-	for _, info := range cmd.manifest {
-		key := filepath.Join(info.db, info.rp, info.sid)
-		if files, ok := cmd.tsmFiles[key]; ok {
-			min, _, err := cmd.shardTimeRange(files)
-			if err != nil {
-				return errors.WithStack(err)
-			}
-			minTs := time.Unix(0, min).UTC()
-			sgi := cmd.shardGroupByTimestamp(minTs)
-			if sgi != nil {
-				sgi.sids = append(sgi.sids, info.sid)
+	spans := make([]shardSpan, 0, len(cmd.shards))
+	for _, shard := range cmd.shards {
+		min, max, err := cmd.Source.TimeRange(shard)
+		if err != nil {
+			if cmd.skipShard(shard, err) {
 				continue
 			}
-			newSgi := cmd.createShardGroupInfo(minTs, info)
-			newSgi.sids = append(newSgi.sids, info.sid)
-			cmd.shardGroups = append(cmd.shardGroups, newSgi)
-		} else {
-			logger.LogString("migrate: manifest does not match tsmFiles", TOLOGFILE, LEVEL_WARNING)
+			return errors.WithStack(err)
+		}
+		spans = append(spans, shardSpan{shard: shard, min: min, max: max})
+		minTs := time.Unix(0, min).UTC()
+		sgi := cmd.shardGroupByTimestamp(minTs, shard)
+		if sgi != nil {
+			sgi.shards = append(sgi.shards, shard)
+			continue
+		}
+		duration, err := cmd.shardGroupDuration(cmd.mapping.resolve(shard.Database, shard.RetentionPolicy))
+		if err != nil {
+			return errors.WithStack(err)
 		}
+		newSgi := cmd.createShardGroupInfo(minTs, shard, duration)
+		newSgi.shards = append(newSgi.shards, shard)
+		cmd.shardGroups = append(cmd.shardGroups, newSgi)
 	}
-	return nil
+	return checkDownsampleWindows(cmd.downsampleRules, spans)
 }
 
 func (cmd *DataMigrateCommand) doMigrate(ctx context.Context, info shardGroupInfo) error {
-	migrateShard := func(info *shardGroupInfo, key string, files []string) error {
-		logger.LogString(fmt.Sprintf("Writing out data from shard %v, [%d/%d]...", key, cmd.gstat.progress.Inc(), len(cmd.manifest)), TOCONSOLE|TOLOGFILE, LEVEL_INFO)
+	migrateShard := func(info *shardGroupInfo, shard ShardInfo) error {
+		key := shard.key()
+		logger.LogString(fmt.Sprintf("Writing out data from shard %v, [%d/%d]...", key, cmd.gstat.progress.Inc(), len(cmd.shards)), TOCONSOLE|TOLOGFILE, LEVEL_INFO,
+			ShardField(key))
 		st := time.Now()
 
+		r, err := cmd.Source.Open(shard, cmd.opt.StartTime, cmd.opt.EndTime)
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		cmd.recordSkippedFiles(shard, r)
 		mig := NewMigrator(cmd, info)
 		defer mig.release()
-		if err := mig.migrateTsmFiles(files); err != nil {
+		if err := mig.migrateShard(r); err != nil {
 			return err
 		}
+		if c, ok := r.(committer); ok {
+			// the data buffered by the sink is written out before it is recorded as migrated
+			if err := cmd.Sink.Flush(); err != nil {
+				return &sinkError{err: err}
+			}
+			if err := c.commit(); err != nil {
+				return err
+			}
+		}
 		eclipse := time.Since(st)
-		cmd.gstat.rowsTotal.Add(int64(mig.stat.rowsRead))
+		cmd.gstat.add(mig.stat)
 
-		logger.LogString("Shard "+key+" takes "+eclipse.String()+" to migrate, with "+
-			strconv.Itoa(len(mig.stat.tagsRead))+" tags, "+strconv.Itoa(len(mig.stat.fieldsRead))+
-			" fields, "+strconv.Itoa(mig.stat.rowsRead)+" rows read", TOCONSOLE|TOLOGFILE, LEVEL_INFO)
+		msg := "Shard " + key + " takes " + eclipse.String() + " to migrate, with " +
+			mig.stat.summary(len(mig.stat.tagsRead), len(mig.stat.fieldsRead))
+		logger.LogString(msg, TOCONSOLE|TOLOGFILE, LEVEL_INFO, ShardField(key))
 		return nil
 	}
 
@@ -375,14 +485,12 @@ func (cmd *DataMigrateCommand) doMigrate(ctx context.Context, info shardGroupInf
 	case <-ctx.Done():
 		return ctx.Err()
 	default:
-		for _, sid := range info.sids {
-			key := filepath.Join(info.db, info.rp, sid)
-			if files, ok := cmd.tsmFiles[key]; ok {
-				if err := migrateShard(&info, key, files); err != nil {
-					return errors.WithStack(err)
+		for _, shard := range info.shards {
+			if err := migrateShard(&info, shard); err != nil {
+				if ctx.Err() == nil && cmd.skipShard(shard, err) {
+					continue
 				}
-			} else {
-				logger.LogString("migrate: manifest does not match tsmFiles", TOLOGFILE|TOCONSOLE, LEVEL_WARNING)
+				return errors.WithStack(err)
 			}
 		}
 		return nil
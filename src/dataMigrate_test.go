@@ -10,20 +10,36 @@ copyright 2023 Huawei Cloud Computing Technologies Co., Ltd.
 package src
 
 import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
 	"fmt"
 	"io"
+	"math"
 	"math/rand"
 	"os"
+	"path/filepath"
+	"reflect"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"net/http"
 	"net/http/httptest"
 
+	"github.com/influxdata/influxdb/cmd/influxd/backup_util"
+	"github.com/influxdata/influxdb/models"
+	"github.com/influxdata/influxdb/services/meta"
+	"github.com/influxdata/influxdb/tsdb"
 	"github.com/influxdata/influxdb/tsdb/engine/tsm1"
+	"github.com/influxdata/influxdb/tsdb/index/tsi1"
+	"github.com/influxdata/influxql"
+	bolt "go.etcd.io/bbolt"
+	"go.uber.org/atomic"
 )
 
 type corpus map[string][]tsm1.Value
@@ -115,15 +131,14 @@ func Test_ReadTSMFile(t *testing.T) {
 
 		filelist := []string{tsmFile.Name()}
 
-		mig := NewMigrator(cmd, info)
-		if err := mig.migrateTsmFiles(filelist); err != nil {
+		if _, err := migrateTsmFiles(cmd, info, filelist); err != nil {
 			t.Fatal(err)
 		}
 	}
 
 	// Missing .tsm file should not cause a failure.
 	filelist := []string{"file-that-does-not-exist.tsm"}
-	if err := NewMigrator(newCommand(), info).migrateTsmFiles(filelist); err != nil {
+	if _, err := migrateTsmFiles(cmd, info, filelist); err != nil {
 		t.Fatal(err)
 	}
 }
@@ -151,7 +166,7 @@ func TestEmptyMigrate(t *testing.T) {
 	defer os.Remove(f.Name())
 
 	filelist := []string{f.Name()}
-	if err := NewMigrator(cmd, info).migrateTsmFiles(filelist); err != nil {
+	if _, err := migrateTsmFiles(cmd, info, filelist); err != nil {
 		t.Fatal(err)
 	}
 }
@@ -170,6 +185,8 @@ func benchmarkReadTSM(c corpus, b *testing.B) {
 
 	cmd := newCommand()
 	cmd.opt.Out = strings.TrimPrefix(server.URL, "http://")
+	cmd.opt.BatchSize = 1000
+	cmd.opt.StartTime, cmd.opt.EndTime = math.MinInt64, math.MaxInt64
 	// Garbage collection is relatively likely to happen during export, so track allocations.
 	b.ReportAllocs()
 
@@ -185,7 +202,7 @@ func benchmarkReadTSM(c corpus, b *testing.B) {
 	b.StartTimer()
 	for i := 0; i < b.N; i++ {
 		filelist := []string{f.Name()}
-		if err := NewMigrator(cmd, info).migrateTsmFiles(filelist); err != nil {
+		if _, err := migrateTsmFiles(cmd, info, filelist); err != nil {
 			b.Fatal(err)
 		}
 	}
@@ -207,6 +224,75 @@ func BenchmarkReadTSMStrings_100s_250vps(b *testing.B) {
 	benchmarkReadTSM(makeStringsCorpus(100, 250), b)
 }
 
+func benchmarkAppendLine(c corpus, b *testing.B) {
+	type line struct {
+		series string
+		fields []fieldValue
+	}
+	var lines []line
+	for k, values := range c {
+		series, field := tsm1.SeriesAndFieldFromCompositeKey([]byte(k))
+		for _, v := range values {
+			lines = append(lines, line{string(series), []fieldValue{{key: string(field), value: v}}})
+		}
+	}
+	buf := make([]byte, 0, 64*1024)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, l := range lines {
+			buf = appendLine(buf[:0], l.series, l.fields, l.fields[0].value.UnixNano(), 1)
+		}
+	}
+}
+
+func BenchmarkAppendLineFloats_100s_250vps(b *testing.B) {
+	benchmarkAppendLine(makeFloatsCorpus(100, 250), b)
+}
+
+func BenchmarkAppendLineInts_100s_250vps(b *testing.B) {
+	benchmarkAppendLine(makeIntsCorpus(100, 250), b)
+}
+
+func BenchmarkAppendLineBools_100s_250vps(b *testing.B) {
+	benchmarkAppendLine(makeBoolsCorpus(100, 250), b)
+}
+
+func BenchmarkAppendLineStrings_100s_250vps(b *testing.B) {
+	benchmarkAppendLine(makeStringsCorpus(100, 250), b)
+}
+
+// migrateTsmFiles migrates the TSM files as a shard of the shard group.
+func migrateTsmFiles(cmd *DataMigrateCommand, info *shardGroupInfo, files []string) (mig *migrator, err error) {
+	// write to the destination of the options unless a sink is set
+	if cmd.Sink == nil {
+		sink, err := newSink(cmd.opt)
+		if err != nil {
+			return nil, err
+		}
+		cmd.Sink = sink
+		defer func() {
+			if ferr := sink.Flush(); err == nil {
+				err = ferr
+			}
+			if cerr := sink.Close(); err == nil {
+				err = cerr
+			}
+			cmd.Sink = nil
+		}()
+	}
+	r, err := openTSMShard(files, cmd.opt.StartTime, cmd.opt.EndTime, shardReadOptions{
+		stream:         cmd.opt.Stream,
+		seriesMemLimit: int64(cmd.opt.SeriesMemLimit) * 1024 * 1024,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	mig = NewMigrator(cmd, info)
+	return mig, mig.migrateShard(r)
+}
+
 func newCommand() *DataMigrateCommand {
 	return &DataMigrateCommand{
 		Stderr: io.Discard,
@@ -214,9 +300,7 @@ func newCommand() *DataMigrateCommand {
 
 		opt: &DataMigrateOptions{},
 
-		manifest: make([]fileGroupInfo, 0),
-		tsmFiles: make(map[string][]string),
-		gstat:    &globalStatInfo{},
+		gstat: &globalStatInfo{},
 	}
 }
 
@@ -307,3 +391,2124 @@ func writeCorpusToTSMFile(c corpus) *os.File {
 
 	return tsmFile
 }
+
+func TestMappingTable(t *testing.T) {
+	cmd := newCommand()
+	cmd.opt.Mappings = []string{
+		"db0.autogen -> db1.default",
+		`"app.metrics" -> app`,
+		"tmp_* -> tmp.*",
+		"*.autogen -> *.default",
+	}
+	cmd.opt.Database = "db2"
+	cmd.opt.DestDatabase = "db3"
+	if err := cmd.loadMapping(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		db, rp         string
+		destDB, destRP string
+	}{
+		{"db0", "autogen", "db1", "default"},
+		{"db0", "rp0", "db0", "rp0"},
+		{"app.metrics", "rp0", "app", "rp0"},
+		{"tmp_1", "rp1", "tmp", "rp1"},
+		{"db9", "autogen", "db9", "default"},
+		{"db2", "rp0", "db3", "rp0"},
+	} {
+		db, rp := cmd.mapping.resolve(c.db, c.rp)
+		if db != c.destDB || rp != c.destRP {
+			t.Fatalf("resolve %s.%s: expect %s.%s, got %s.%s", c.db, c.rp, c.destDB, c.destRP, db, rp)
+		}
+	}
+
+	for _, s := range []string{"db0", "db0 -> ", "a.b.c -> d", `"db0 -> d`, "db0 -> d*"} {
+		if _, err := parseMappingRule(s); err == nil {
+			t.Fatalf("expect error for mapping rule %q", s)
+		}
+	}
+}
+
+func TestDownsample(t *testing.T) {
+	minute := int64(time.Minute)
+	rule, err := parseDownsampleRule("90d:5m:mean,max,last,count:rp_cold", time.Unix(0, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rule.cutoff != -int64(90*24*time.Hour) || rule.rp != "rp_cold" {
+		t.Fatalf("unexpected rule: %s", rule)
+	}
+
+	agg := newAggregator(rule)
+	var out []row
+	for i, v := range []float64{1, 2, 3, 10, 20} {
+		r := &row{
+			ts: int64(i) * 2 * minute,
+			fields: []fieldValue{
+				{key: "f", value: tsm1.NewValue(int64(i)*2*minute, v)},
+				{key: "s", value: tsm1.NewValue(int64(i)*2*minute, strconv.Itoa(i))},
+			},
+		}
+		if o := agg.add(r); o != nil {
+			out = append(out, row{ts: o.ts, fields: append([]fieldValue(nil), o.fields...)})
+		}
+	}
+	if o := agg.flush(); o != nil {
+		out = append(out, row{ts: o.ts, fields: append([]fieldValue(nil), o.fields...)})
+	}
+
+	expect := []map[string]interface{}{
+		{"mean_f": 2.0, "max_f": 3.0, "last_f": 3.0, "count_f": int64(3), "last_s": "2", "count_s": int64(3)},
+		{"mean_f": 15.0, "max_f": 20.0, "last_f": 20.0, "count_f": int64(2), "last_s": "4", "count_s": int64(2)},
+	}
+	if len(out) != len(expect) {
+		t.Fatalf("expect %d rows, got %d", len(expect), len(out))
+	}
+	for i, r := range out {
+		if r.ts != int64(i)*5*minute {
+			t.Fatalf("row %d: expect ts %d, got %d", i, int64(i)*5*minute, r.ts)
+		}
+		if len(r.fields) != len(expect[i]) {
+			t.Fatalf("row %d: expect %d fields, got %d", i, len(expect[i]), len(r.fields))
+		}
+		for _, f := range r.fields {
+			if f.value.Value() != expect[i][f.key] {
+				t.Fatalf("row %d: field %s expect %v, got %v", i, f.key, expect[i][f.key], f.value.Value())
+			}
+		}
+	}
+
+	// the values of another type than the window are skipped
+	fa := &fieldAgg{}
+	if !fa.add(tsm1.NewValue(0, 1.5)) || fa.add(tsm1.NewValue(1, int64(2))) || fa.add(tsm1.NewValue(2, "s")) || !fa.add(tsm1.NewValue(3, 2.5)) {
+		t.Fatalf("expect only the float values to be aggregated")
+	}
+	if v := fa.result(aggSum, 0); fa.count != 2 || v.Value() != 4.0 {
+		t.Fatalf("expect the sum of 2 floats, got %v of %d", v.Value(), fa.count)
+	}
+
+	for _, s := range []string{"90d:5m", "90x:5m:mean", "90d:5m:median", "90d:0s:mean"} {
+		if _, err := parseDownsampleRule(s, time.Now()); err == nil {
+			t.Fatalf("expect error for downsample rule %q", s)
+		}
+	}
+}
+
+func TestCheckDownsampleWindows(t *testing.T) {
+	day := int64(24 * time.Hour)
+	spans := []shardSpan{
+		{shard: ShardInfo{Database: "db0", RetentionPolicy: "autogen", ID: "2"}, min: day, max: 2*day - 1},
+		{shard: ShardInfo{Database: "db0", RetentionPolicy: "autogen", ID: "1"}, min: 0, max: day - 1},
+		{shard: ShardInfo{Database: "db1", RetentionPolicy: "autogen", ID: "3"}, min: day, max: day},
+	}
+	for _, c := range []struct {
+		interval time.Duration
+		cutoff   int64
+		err      string
+	}{
+		{time.Hour, math.MaxInt64, ""},
+		// the window [21h, 28h) spans the shards of the days
+		{7 * time.Hour, math.MaxInt64, "spans the shards db0/autogen/1 and db0/autogen/2"},
+		// no point of the shards is downsampled
+		{7 * time.Hour, 0, ""},
+	} {
+		rules := []*downsampleRule{{interval: c.interval, aggs: []string{aggMean}, cutoff: c.cutoff}}
+		err := checkDownsampleWindows(rules, spans)
+		if (c.err == "" && err != nil) || (c.err != "" && (err == nil || !strings.Contains(err.Error(), c.err))) {
+			t.Fatalf("interval %s: expect error %q, got %v", c.interval, c.err, err)
+		}
+	}
+}
+
+func TestTimeTransform(t *testing.T) {
+	var body strings.Builder
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			if r.URL.Query().Get("precision") != "s" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			b, _ := io.ReadAll(r.Body)
+			body.Write(b)
+			w.WriteHeader(http.StatusNoContent)
+		} else {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	second := int64(time.Second)
+	f := writeCorpusToTSMFile(corpus{
+		tsm1.SeriesFieldKey("m,k=a", "f"): []tsm1.Value{
+			tsm1.NewValue(second+1, float64(1)),
+			tsm1.NewValue(second+2, float64(2)),
+			tsm1.NewValue(2*second, float64(3)),
+		},
+		tsm1.SeriesFieldKey("m,k=a", "g"): []tsm1.Value{
+			tsm1.NewValue(second+3, int64(4)),
+		},
+	})
+	defer os.Remove(f.Name())
+
+	for _, c := range []struct {
+		dedup  string
+		expect string
+	}{
+		{dedupFirst, "m,k=a f=1,g=4i 3601\nm,k=a f=3 3602\n"},
+		{dedupLast, "m,k=a f=2,g=4i 3601\nm,k=a f=3 3602\n"},
+	} {
+		body.Reset()
+		cmd := newCommand()
+		cmd.opt.Out = strings.TrimPrefix(server.URL, "http://")
+		cmd.opt.BatchSize = 1000
+		cmd.opt.StartTime, cmd.opt.EndTime = math.MinInt64, math.MaxInt64
+		tr, err := newTimeTransform("1h", "s", c.dedup)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cmd.timeTransform = tr
+
+		mig, err := migrateTsmFiles(cmd, &shardGroupInfo{db: "db0", rp: "rp0"}, []string{f.Name()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if body.String() != c.expect {
+			t.Fatalf("dedup %s: expect %q, got %q", c.dedup, c.expect, body.String())
+		}
+		if mig.stat.rowsDeduplicated != 2 {
+			t.Fatalf("dedup %s: expect 2 rows deduplicated, got %d", c.dedup, mig.stat.rowsDeduplicated)
+		}
+	}
+
+	if tr, _ := newTimeTransform("", "ms", ""); tr.apply(-1) != -int64(time.Millisecond) {
+		t.Fatalf("negative timestamps should be truncated towards the past")
+	}
+	if _, err := newTimeTransform("", "m", ""); err == nil {
+		t.Fatalf("expect error for precision m")
+	}
+}
+
+func TestStatistics(t *testing.T) {
+	f := writeCorpusToTSMFile(makeFloatsCorpus(10, 10))
+	defer os.Remove(f.Name())
+	filter, err := NewSeriesFilter(nil, []string{"t=0", "t=1", "t=2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rule, err := parseDownsampleRule("1s:1h:count:rp_cold", time.Unix(10, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		stream      bool
+		downsample  bool
+		written     int
+		downsampled int
+	}{
+		{false, false, 30, 0},
+		{true, false, 30, 0},
+		// the 10 rows of every series are aggregated into 1
+		{false, true, 3, 30},
+	} {
+		cmd := newCommand()
+		sink := &recordSink{}
+		cmd.Sink = sink
+		cmd.opt.BatchSize = 4
+		cmd.opt.StartTime, cmd.opt.EndTime = math.MinInt64, math.MaxInt64
+		if c.downsample {
+			cmd.downsampleRules = []*downsampleRule{rule}
+		}
+		r, err := openTSMShard([]string{f.Name()}, cmd.opt.StartTime, cmd.opt.EndTime, shardReadOptions{stream: c.stream, filter: filter})
+		if err != nil {
+			t.Fatal(err)
+		}
+		mig := NewMigrator(cmd, &shardGroupInfo{db: "db0", rp: "rp0"})
+		if err := mig.migrateShard(r); err != nil {
+			t.Fatal(err)
+		}
+		r.Close()
+		cmd.gstat.add(mig.stat)
+
+		var bytes int64
+		for _, b := range sink.batches {
+			bytes += int64(len(b.Lines))
+		}
+		total := cmd.gstat.total()
+		if total.seriesRead != 3 || total.seriesSkipped != 7 || total.rowsRead != 30 || total.rowsWritten != c.written ||
+			total.rowsDownsampled != c.downsampled || total.rowsAggregated != c.downsampled/10 || total.bytesWritten != bytes {
+			t.Fatalf("stream %v, downsample %v: unexpected statistics %+v", c.stream, c.downsample, total)
+		}
+		expect := fmt.Sprintf("1 tag keys, 1 field keys, 3 series, 30 rows read, %d rows written", c.written)
+		if c.downsample {
+			expect += ", 30 rows downsampled into 3 rows"
+		}
+		expect += fmt.Sprintf(", 7 series skipped, %d bytes written", bytes)
+		if msg := mig.stat.summary(len(mig.stat.tagsRead), len(mig.stat.fieldsRead)); msg != expect {
+			t.Fatalf("expect %q, got %q", expect, msg)
+		}
+		mig.release()
+	}
+}
+
+func TestTranslateContinuousQuery(t *testing.T) {
+	mapping := mappingTable{
+		{srcDB: "db0", srcRP: "autogen", dstDB: "db1", dstRP: "default"},
+		{srcDB: "db0", dstDB: "db1"},
+	}
+	for _, c := range []struct {
+		query  string
+		expect string
+		err    bool
+	}{
+		{
+			query:  `CREATE CONTINUOUS QUERY cq0 ON db0 BEGIN SELECT mean(value) INTO cpu_1h FROM cpu GROUP BY time(1h), * END`,
+			expect: `CREATE CONTINUOUS QUERY cq0 ON db1 BEGIN SELECT mean(value) INTO db1."default".cpu_1h FROM db1."default".cpu GROUP BY time(1h), * END`,
+		},
+		{
+			query:  `CREATE CONTINUOUS QUERY cq1 ON db0 RESAMPLE EVERY 2h FOR 4h BEGIN SELECT max(value) INTO db0.rp_1y.cpu_1h FROM db0.rp_30d.cpu GROUP BY time(1h) END`,
+			expect: `CREATE CONTINUOUS QUERY cq1 ON db1 RESAMPLE EVERY 2h FOR 4h BEGIN SELECT max(value) INTO db1.rp_1y.cpu_1h FROM db1.rp_30d.cpu GROUP BY time(1h) END`,
+		},
+		{
+			query: `CREATE CONTINUOUS QUERY cq2 ON db0 BEGIN SELECT percentile(value, 95) INTO cpu_p95 FROM cpu GROUP BY time(1h) END`,
+			err:   true,
+		},
+		{
+			query: `CREATE CONTINUOUS QUERY cq3 ON db0 BEGIN SELECT mean(value) INTO cpu_1h FROM /cpu.*/ GROUP BY time(1h) END`,
+			err:   true,
+		},
+	} {
+		db, query, err := translateContinuousQuery(continuousQueryInfo{database: "db0", defaultRP: "autogen", query: c.query}, mapping)
+		if c.err {
+			if err == nil {
+				t.Fatalf("expect error for %s", c.query)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if db != "db1" || query != c.expect {
+			t.Fatalf("expect %s on db1, got %s on %s", c.expect, query, db)
+		}
+	}
+}
+
+func TestGeneratePassword(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		pw, err := generatePassword()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(pw) != passwordLength {
+			t.Fatalf("expect password of length %d, got %q", passwordLength, pw)
+		}
+		for _, chars := range []string{lowerChars, upperChars, digitChars, specialChars} {
+			if !strings.ContainsAny(pw, chars) {
+				t.Fatalf("password %q has no character of %q", pw, chars)
+			}
+		}
+	}
+}
+
+func TestMigrateUsers(t *testing.T) {
+	dir := t.TempDir()
+	data := &meta.Data{}
+	for db, rp := range map[string]string{"db0": "autogen", "db2": "rp1"} {
+		if err := data.CreateDatabase(db); err != nil {
+			t.Fatal(err)
+		}
+		if err := data.CreateRetentionPolicy(db, &meta.RetentionPolicyInfo{Name: rp, ReplicaN: 1}, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := data.CreateUser("u0", "hash", false); err != nil {
+		t.Fatal(err)
+	}
+	for _, db := range []string{"db0", "db2"} {
+		if err := data.SetPrivilege("u0", db, influxql.ReadPrivilege); err != nil {
+			t.Fatal(err)
+		}
+	}
+	buf, err := data.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "meta.db"), buf, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := newCommand()
+	cmd.opt.MetaDir = dir
+	cmd.opt.UsersOutput = filepath.Join(dir, "users.txt")
+	// the privileges are mapped as the default retention policy of the database
+	for _, rule := range []string{"db0.autogen -> db1", "db2.autogen -> db3"} {
+		r, err := parseMappingRule(rule)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cmd.mapping = append(cmd.mapping, r)
+	}
+	gs := &fakeGeminiService{}
+	cmd.gs = gs
+	if err := cmd.migrateUsers(); err != nil {
+		t.Fatal(err)
+	}
+	expect := []string{"u0:db1:READ", "u0:db2:READ"}
+	if !reflect.DeepEqual(gs.grants, expect) {
+		t.Fatalf("expect grants %q, got %q", expect, gs.grants)
+	}
+}
+
+// fakeGeminiService answers the queries to openGemini from memory.
+type fakeGeminiService struct {
+	fieldKeys map[string]map[string]map[string]string
+	// the privileges granted, as user:database:privilege
+	grants []string
+}
+
+func (s *fakeGeminiService) GetShardGroupDuration(database, retentionPolicy string) (time.Duration, error) {
+	return 7 * 24 * time.Hour, nil
+}
+
+func (s *fakeGeminiService) CreateContinuousQuery(database, query string) error { return nil }
+
+func (s *fakeGeminiService) CreateUser(name, password string, admin bool) error { return nil }
+
+func (s *fakeGeminiService) GrantPrivilege(user, database, privilege string) error {
+	s.grants = append(s.grants, user+":"+database+":"+privilege)
+	return nil
+}
+
+func (s *fakeGeminiService) GetFieldKeys(database string) (map[string]map[string]string, error) {
+	return s.fieldKeys[database], nil
+}
+
+func TestCheckSchema(t *testing.T) {
+	f1 := writeCorpusToTSMFile(corpus{
+		tsm1.SeriesFieldKey("cpu,host=a", "usage"): []tsm1.Value{tsm1.NewValue(1, float64(1))},
+		tsm1.SeriesFieldKey("cpu,host=a", "count"): []tsm1.Value{tsm1.NewValue(1, int64(1))},
+	})
+	defer os.Remove(f1.Name())
+	f2 := writeCorpusToTSMFile(corpus{
+		tsm1.SeriesFieldKey("cpu,host=b", "usage"): []tsm1.Value{tsm1.NewValue(1, int64(1))},
+	})
+	defer os.Remove(f2.Name())
+
+	cmd := newCommand()
+	source := NewTSMSource(TSMSourceConfig{})
+	source.files = map[string][]string{
+		"db0/rp0/1": {f1.Name()},
+		"db0/rp0/2": {f2.Name()},
+	}
+	cmd.Source = source
+	cmd.shards = []ShardInfo{{Database: "db0", RetentionPolicy: "rp0", ID: "1"}, {Database: "db0", RetentionPolicy: "rp0", ID: "2"}}
+	gs := &fakeGeminiService{fieldKeys: map[string]map[string]map[string]string{
+		"db0": {"cpu": {"count": "float"}},
+	}}
+	cmd.gs = gs
+
+	err := cmd.checkSchema()
+	if err == nil || !strings.Contains(err.Error(), "found 2 schema conflicts") {
+		t.Fatalf("expect 2 schema conflicts, got %v", err)
+	}
+
+	source.files["db0/rp0/2"] = nil
+	gs.fieldKeys["db0"]["cpu"]["count"] = "integer"
+	if err := cmd.checkSchema(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the fields older than the cutoff of a downsample rule are written aggregated, and the mean is always float
+	cmd.downsampleRules = []*downsampleRule{{interval: time.Hour, aggs: []string{aggMean, aggSum}, cutoff: 2}}
+	gs.fieldKeys["db0"]["cpu"] = map[string]string{"usage": "string", "mean_count": "integer", "sum_count": "integer"}
+	err = cmd.checkSchema()
+	if err == nil || !strings.Contains(err.Error(), "found 1 schema conflicts") {
+		t.Fatalf("expect 1 schema conflict of mean_count, got %v", err)
+	}
+	gs.fieldKeys["db0"]["cpu"]["mean_count"] = "float"
+	if err := cmd.checkSchema(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// writeDataDir writes the corpus of every shard key (db/rp/sid) into the TSM file of the shard in a temp data dir.
+func writeDataDir(t *testing.T, shards map[string]corpus) string {
+	dir := t.TempDir()
+	for key, c := range shards {
+		f := writeCorpusToTSMFile(c)
+		shardDir := filepath.Join(dir, filepath.FromSlash(key))
+		if err := os.MkdirAll(shardDir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Rename(f.Name(), filepath.Join(shardDir, "000000001-000000001.tsm")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestLogger(t *testing.T) {
+	dir := t.TempDir()
+	l := NewLogger()
+	defer l.Close()
+	if err := l.Configure(LogConfig{Dir: dir, Level: "warning", Format: LogFormatJson}); err != nil {
+		t.Fatal(err)
+	}
+	l.LogString("Dealing file: a.tsm", TOLOGFILE, LEVEL_INFO, FileField("a.tsm"))
+	l.LogString("Shard db0/autogen/1 is skipped", TOLOGFILE, LEVEL_WARNING, ShardField("db0/autogen/1"))
+	b, err := os.ReadFile(filepath.Join(dir, l.logName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m map[string]string
+	if err := json.Unmarshal(b, &m); err != nil {
+		t.Fatalf("expect a json message above the level, got %q: %s", b, err)
+	}
+	if m["level"] != "warning" || m["msg"] != "Shard db0/autogen/1 is skipped" || m["shard"] != "db0/autogen/1" {
+		t.Fatalf("unexpected message %q", b)
+	}
+
+	// the file is opened only if logging to it
+	l.Close()
+	if err := l.Configure(LogConfig{Dir: filepath.Join(dir, "none"), Level: "info", Format: LogFormatText, NoFile: true}); err != nil {
+		t.Fatal(err)
+	}
+	l.LogString("not in any file", TOLOGFILE, LEVEL_INFO)
+	if _, err := os.Stat(filepath.Join(dir, "none")); !os.IsNotExist(err) {
+		t.Fatalf("expect no log dir with no log file, got %v", err)
+	}
+	for _, cfg := range []LogConfig{{Level: "trace", Format: LogFormatText}, {Level: "info", Format: "xml"}} {
+		if err := l.Configure(cfg); err == nil {
+			t.Fatalf("expect error for %+v", cfg)
+		}
+	}
+
+	path := filepath.Join(dir, "rotate.log")
+	w, err := newRotateWriter(path, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"line 1\n", "line 2\n", "line 3\n", "line 4\n"} {
+		if _, err := w.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w.Close()
+	for suffix, expect := range map[string]string{"": "line 4\n", ".1": "line 3\n", ".2": "line 2\n"} {
+		b, err := os.ReadFile(path + suffix)
+		if err != nil || string(b) != expect {
+			t.Fatalf("expect %q in %s, got %q, %v", expect, path+suffix, b, err)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Fatalf("expect 2 rotated files kept")
+	}
+}
+
+func TestInspect(t *testing.T) {
+	dir := writeDataDir(t, map[string]corpus{
+		"db0/autogen/1": {
+			tsm1.SeriesFieldKey("cpu,host=a,region=r1", "usage"): []tsm1.Value{tsm1.NewValue(1, float64(1)), tsm1.NewValue(2, float64(2))},
+			tsm1.SeriesFieldKey("cpu,host=b,region=r1", "usage"): []tsm1.Value{tsm1.NewValue(3, float64(1))},
+			tsm1.SeriesFieldKey("mem,host=a", "free"):            []tsm1.Value{tsm1.NewValue(1, int64(1))},
+		},
+		"db0/autogen/2": {
+			tsm1.SeriesFieldKey("cpu,host=c,region=r2", "usage"): []tsm1.Value{tsm1.NewValue(10, int64(1))},
+		},
+	})
+
+	var out bytes.Buffer
+	cmd := NewInspectCommand(&InspectOptions{DataDir: dir, Format: "json", Exact: true})
+	cmd.Stdout = &out
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+	var report InspectReport
+	if err := json.Unmarshal(out.Bytes(), &report); err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Shards) != 2 || len(report.Measurements) != 2 {
+		t.Fatalf("expect 2 shards and 2 measurements, got %d and %d", len(report.Shards), len(report.Measurements))
+	}
+	cpu := report.Measurements[0]
+	if cpu.Measurement != "cpu" || cpu.Series != 3 || cpu.Points != 4 || cpu.Blocks != 3 {
+		t.Fatalf("unexpected report of cpu: %+v", cpu)
+	}
+	if cpu.Fields["usage"] != "float|integer" || cpu.TagKeys["host"] != 3 || cpu.TagKeys["region"] != 2 ||
+		cpu.SeriesEstimated || len(cpu.TagsEstimated) != 0 {
+		t.Fatalf("unexpected schema of cpu: %+v", cpu)
+	}
+	if cpu.MinTime.UnixNano() != 1 || cpu.MaxTime.UnixNano() != 10 {
+		t.Fatalf("unexpected time range of cpu: %s - %s", cpu.MinTime, cpu.MaxTime)
+	}
+
+	out.Reset()
+	cmd = NewInspectCommand(&InspectOptions{DataDir: dir, Format: "table"})
+	cmd.Stdout = &out
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "POINTS(EST.)") {
+		t.Fatalf("unexpected table: %s", out.String())
+	}
+}
+
+func TestCardinality(t *testing.T) {
+	c := newCardinality()
+	for i := 0; i < 2; i++ {
+		for j := 0; j < exactCardinality; j++ {
+			c.add([]byte("cpu,host=" + strconv.Itoa(j)))
+		}
+	}
+	if c.estimated() || c.count() != exactCardinality {
+		t.Fatalf("expect %d counted exactly, got %d, estimated: %v", exactCardinality, c.count(), c.estimated())
+	}
+
+	// the values beyond the cap are estimated
+	n := 3 * exactCardinality
+	for j := exactCardinality; j < n; j++ {
+		c.add([]byte("cpu,host=" + strconv.Itoa(j)))
+	}
+	if got := c.count(); !c.estimated() || math.Abs(float64(got-n)) > 0.02*float64(n) {
+		t.Fatalf("expect about %d estimated, got %d, estimated: %v", n, got, c.estimated())
+	}
+}
+
+func TestStreamingSeries(t *testing.T) {
+	var body strings.Builder
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		body.Write(b)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	f1 := writeCorpusToTSMFile(corpus{
+		tsm1.SeriesFieldKey("m,k=b", "f"): []tsm1.Value{tsm1.NewValue(1, float64(1))},
+		tsm1.SeriesFieldKey("m,k=a", "g"): []tsm1.Value{tsm1.NewValue(1, int64(2))},
+	})
+	defer os.Remove(f1.Name())
+	f2 := writeCorpusToTSMFile(corpus{
+		tsm1.SeriesFieldKey("m,k=a", "f"): []tsm1.Value{tsm1.NewValue(1, float64(3))},
+		tsm1.SeriesFieldKey("m,k=a", "g"): []tsm1.Value{tsm1.NewValue(2, int64(4))},
+		tsm1.SeriesFieldKey("n", "f"):     []tsm1.Value{tsm1.NewValue(1, float64(5))},
+	})
+	defer os.Remove(f2.Name())
+
+	var files []tsm1.TSMFile
+	for _, name := range []string{f1.Name(), f2.Name()} {
+		f, err := os.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, err := tsm1.NewTSMReader(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+		files = append(files, r)
+	}
+	var got []string
+	it := newMergeSeriesIterator(files)
+	for {
+		series, fields, ok := it.next()
+		if !ok {
+			break
+		}
+		got = append(got, series+":"+strings.Join(fields, ","))
+	}
+	expect := []string{"m,k=a:f,g", "m,k=b:f", "n:f"}
+	if !reflect.DeepEqual(got, expect) {
+		t.Fatalf("expect series %v, got %v", expect, got)
+	}
+
+	// the same points are written whether the series are collected, streamed or switched to streaming
+	var bodies []string
+	for _, c := range []struct {
+		stream bool
+		limit  int64
+	}{{false, 0}, {true, 0}, {false, 1}} {
+		body.Reset()
+		cmd := newCommand()
+		cmd.opt.Out = strings.TrimPrefix(server.URL, "http://")
+		cmd.opt.BatchSize = 1000
+		cmd.opt.StartTime, cmd.opt.EndTime = math.MinInt64, math.MaxInt64
+		cmd.opt.Stream = c.stream
+
+		r, err := openTSMShard([]string{f1.Name(), f2.Name()}, cmd.opt.StartTime, cmd.opt.EndTime,
+			shardReadOptions{stream: c.stream, seriesMemLimit: c.limit})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.stream || c.limit > 0 {
+			if !r.streaming || len(r.serieskeys) != 0 {
+				t.Fatalf("expect streaming with no series collected")
+			}
+		}
+		sink, err := newSink(cmd.opt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cmd.Sink = sink
+		err = NewMigrator(cmd, &shardGroupInfo{db: "db0", rp: "rp0"}).migrateShard(r)
+		r.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := sink.Close(); err != nil {
+			t.Fatal(err)
+		}
+		bodies = append(bodies, body.String())
+	}
+	if bodies[0] == "" || bodies[0] != bodies[1] || bodies[0] != bodies[2] {
+		t.Fatalf("expect the same points written, got %q", bodies)
+	}
+}
+
+func TestAppendLine(t *testing.T) {
+	var body strings.Builder
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		body.Write(b)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	for _, c := range []corpus{basicCorpus, escapeStringCorpus} {
+		body.Reset()
+		f := writeCorpusToTSMFile(c)
+		defer os.Remove(f.Name())
+
+		cmd := newCommand()
+		cmd.opt.Out = strings.TrimPrefix(server.URL, "http://")
+		cmd.opt.BatchSize = 1000
+		cmd.opt.StartTime, cmd.opt.EndTime = math.MinInt64, math.MaxInt64
+		if _, err := migrateTsmFiles(cmd, &shardGroupInfo{db: "db0", rp: "rp0"}, []string{f.Name()}); err != nil {
+			t.Fatal(err)
+		}
+
+		// the points written must be parsed back to the corpus
+		models.EnableUintSupport()
+		points, err := models.ParsePointsString(body.String())
+		if err != nil {
+			t.Fatalf("parse %q: %s", body.String(), err)
+		}
+		got := make(corpus)
+		for _, p := range points {
+			fields, err := p.Fields()
+			if err != nil {
+				t.Fatal(err)
+			}
+			for k, v := range fields {
+				key := tsm1.SeriesFieldKey(string(p.Key()), k)
+				got[key] = append(got[key], tsm1.NewValue(p.UnixNano(), v))
+			}
+		}
+		if !reflect.DeepEqual(got, c) {
+			t.Fatalf("expect %v, got %v", c, got)
+		}
+	}
+
+	line := appendLine(nil, "m,k=v", []fieldValue{
+		{key: "a b", value: tsm1.NewValue(0, float64(1.5))},
+		{key: "c,d=e", value: tsm1.NewValue(0, `x"y\z`)},
+	}, 3*int64(time.Millisecond), int64(time.Millisecond))
+	if expect := `m,k=v a\ b=1.5,c\,d\=e="x\"y\\z" 3` + "\n"; string(line) != expect {
+		t.Fatalf("expect %q, got %q", expect, line)
+	}
+
+	// nothing is allocated once the buffer has enough capacity
+	fields := []fieldValue{
+		{key: "f", value: tsm1.NewValue(0, 1.5)},
+		{key: "i", value: tsm1.NewValue(0, int64(-2))},
+		{key: "u", value: tsm1.NewValue(0, uint64(3))},
+		{key: "b", value: tsm1.NewValue(0, true)},
+		{key: "s", value: tsm1.NewValue(0, "str")},
+	}
+	buf := make([]byte, 0, 1024)
+	if n := testing.AllocsPerRun(100, func() {
+		buf = appendLine(buf[:0], "m,k=v", fields, 1, 1)
+	}); n != 0 {
+		t.Fatalf("expect no allocation, got %v", n)
+	}
+}
+
+func TestCompression(t *testing.T) {
+	var body strings.Builder
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Encoding") != "gzip" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		b, _ := io.ReadAll(gz)
+		body.Write(b)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	f := writeCorpusToTSMFile(makeFloatsCorpus(10, 100))
+	defer os.Remove(f.Name())
+
+	cmd := newCommand()
+	cmd.opt.Out = strings.TrimPrefix(server.URL, "http://")
+	cmd.opt.BatchSize = 100
+	cmd.opt.StartTime, cmd.opt.EndTime = math.MinInt64, math.MaxInt64
+	cmd.opt.Compress = compressGzip
+	cmd.opt.CompressLevel = gzip.BestCompression
+	sink, err := newSink(cmd.opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd.Sink = sink
+	mig, err := migrateTsmFiles(cmd, &shardGroupInfo{db: "db0", rp: "rp0"}, []string{f.Name()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mig.stat.rowsWritten != 1000 || strings.Count(body.String(), "\n") != 1000 {
+		t.Fatalf("expect 1000 rows written, got %d", mig.stat.rowsWritten)
+	}
+	if stats := sink.Stats(); stats.BytesWritten != int64(body.Len()) || stats.BytesSent <= 0 || stats.BytesSent >= stats.BytesWritten {
+		t.Fatalf("unexpected compression stat: %d bytes written, %d bytes sent", stats.BytesWritten, stats.BytesSent)
+	}
+
+	for _, c := range []struct {
+		compress string
+		level    int
+	}{{"zstd", 0}, {compressGzip, 10}} {
+		if err := checkCompression(c.compress, c.level); err == nil {
+			t.Fatalf("expect error for compression %s level %d", c.compress, c.level)
+		}
+	}
+}
+
+func TestEndpointFailover(t *testing.T) {
+	var rows atomic.Int64
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/write":
+			b, _ := io.ReadAll(r.Body)
+			rows.Add(int64(bytes.Count(b, []byte("\n"))))
+		case "/query":
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = io.WriteString(w, `{"results":[{"statement_id":0,"series":[
+				{"name":"cpu","columns":["fieldKey","fieldType"],"values":[["usage","float"]]}]}]}`)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	good := httptest.NewServer(handler)
+	defer good.Close()
+	down := httptest.NewServer(handler)
+	down.Close()
+
+	f := writeCorpusToTSMFile(makeFloatsCorpus(10, 100))
+	defer os.Remove(f.Name())
+
+	cmd := newCommand()
+	cmd.opt.Out = strings.TrimPrefix(down.URL, "http://") + "," + strings.TrimPrefix(good.URL, "http://")
+	cmd.opt.BatchSize = 100
+	cmd.opt.StartTime, cmd.opt.EndTime = math.MinInt64, math.MaxInt64
+	sink, err := newPrimarySink(cmd.opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd.Sink = sink
+	if _, err := migrateTsmFiles(cmd, &shardGroupInfo{db: "db0", rp: "rp0"}, []string{f.Name()}); err != nil {
+		t.Fatal(err)
+	}
+	if rows.Load() != 1000 {
+		t.Fatalf("expect 1000 rows written to the live endpoint, got %d", rows.Load())
+	}
+	eps := sink.pool.endpoints
+	if eps[0].healthy.Load() || !eps[1].healthy.Load() {
+		t.Fatalf("expect only the unreachable endpoint marked down")
+	}
+	sink.pool.checkHealth()
+	if eps[0].healthy.Load() {
+		t.Fatalf("expect the unreachable endpoint still down")
+	}
+
+	// the queries fail over as well, both endpoints are picked in turn
+	gs := NewGeminiService(cmd)
+	for i := 0; i < 2; i++ {
+		fieldKeys, err := gs.GetFieldKeys("db0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expect := map[string]map[string]string{"cpu": {"usage": "float"}}; !reflect.DeepEqual(fieldKeys, expect) {
+			t.Fatalf("expect field keys %v, got %v", expect, fieldKeys)
+		}
+	}
+	if eps := gs.pool.endpoints; eps[0].healthy.Load() || !eps[1].healthy.Load() {
+		t.Fatalf("expect only the unreachable endpoint marked down")
+	}
+
+	// least-inflight picks the idle endpoint, and a live endpoint is back after the health check
+	pool := newEndpointPool([]string{"a:1", "b:2", "c:3"}, false, balanceLeastInflight)
+	pool.endpoints[0].inflight.Store(2)
+	pool.endpoints[1].inflight.Store(1)
+	if ep := pool.pick(nil); ep != pool.endpoints[2] {
+		t.Fatalf("expect the idle endpoint picked, got %s", ep.addr)
+	}
+	pool = newEndpointPool([]string{strings.TrimPrefix(good.URL, "http://")}, false, balanceRoundRobin)
+	pool.markDown(pool.endpoints[0], fmt.Errorf("test"))
+	if pool.pick(nil) != nil {
+		t.Fatalf("expect no endpoint picked when all are down")
+	}
+	pool.checkHealth()
+	if pool.pick(nil) == nil {
+		t.Fatalf("expect the endpoint back after the health check")
+	}
+}
+
+func TestFanout(t *testing.T) {
+	var body strings.Builder
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		body.Write(b)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer primary.Close()
+	var failures atomic.Int64
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		failures.Inc()
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write([]byte(`{"error":"engine is closed"}`))
+	}))
+	defer failing.Close()
+	failingHost := strings.TrimPrefix(failing.URL, "http://")
+
+	f := writeCorpusToTSMFile(makeFloatsCorpus(10, 10))
+	defer os.Remove(f.Name())
+	dir := t.TempDir()
+
+	newCmd := func(fanouts ...string) *DataMigrateCommand {
+		cmd := newCommand()
+		cmd.opt.Out = strings.TrimPrefix(primary.URL, "http://")
+		cmd.opt.BatchSize = 50
+		cmd.opt.StartTime, cmd.opt.EndTime = math.MinInt64, math.MaxInt64
+		cmd.opt.DeadLetterDir = filepath.Join(dir, "dead-letter")
+		cmd.opt.MaxRetries = 1
+		cmd.opt.Fanouts = fanouts
+		sink, err := newSink(cmd.opt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sink.RetryInterval = 0
+		cmd.Sink = sink
+		return cmd
+	}
+
+	archive := filepath.Join(dir, "archive.lp")
+	cmd := newCmd("file:"+archive, "http://"+failingHost+"?on-error=skip", "http://u:p@"+failingHost+"?on-error=dead-letter")
+	if _, err := migrateTsmFiles(cmd, &shardGroupInfo{db: "db0", rp: "rp0"}, []string{f.Name()}); err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Count(body.String(), "\n") != 100 {
+		t.Fatalf("expect 100 rows written to the primary destination, got %q", body.String())
+	}
+	header := "# DML\n# CONTEXT-DATABASE: db0\n# CONTEXT-RETENTION-POLICY: rp0\n"
+	b, err := os.ReadFile(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != header+body.String() {
+		t.Fatalf("expect the archive to be the same as the data written, got %q", b)
+	}
+	b, err = os.ReadFile(filepath.Join(dir, "dead-letter", strings.Replace(failingHost, ":", "_", 1)+".lp"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != header+body.String() {
+		t.Fatalf("expect the dead letters to be the same as the data written, got %q", b)
+	}
+	// a batch per series, each tried twice by 2 destinations
+	if failures.Load() != 40 {
+		t.Fatalf("expect 40 failed requests, got %d", failures.Load())
+	}
+	targets := cmd.Sink.(*FanoutSink).targets
+	if n := targets[2].pointsSkipped.Load(); n != 100 {
+		t.Fatalf("expect 100 rows skipped, got %d", n)
+	}
+	if n := targets[3].pointsDeadLettered.Load(); n != 100 {
+		t.Fatalf("expect 100 rows dead-lettered, got %d", n)
+	}
+	if s := targets[3].Sink.(*GeminiSink); s.username != "u" || s.password != "p" {
+		t.Fatalf("expect the user of the destination, got %s:%s", s.username, s.password)
+	}
+
+	cmd = newCmd("http://" + failingHost)
+	if _, err := migrateTsmFiles(cmd, &shardGroupInfo{db: "db0", rp: "rp0"}, []string{f.Name()}); err == nil {
+		t.Fatalf("expect error from the destination with the fail policy")
+	}
+
+	for _, spec := range []string{"ftp://host", "http://?on-error=skip", "http://host?on-error=retry", "file:"} {
+		cmd.opt.Fanouts = []string{spec}
+		if _, err := newSink(cmd.opt); err == nil {
+			t.Fatalf("expect error for destination %q", spec)
+		}
+	}
+}
+
+func TestPartialWrite(t *testing.T) {
+	var requests atomic.Int64
+	partial := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Inc()
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(`{"error":"partial write: field type conflict: input field \"field0\" on measurement \"cpu\" is type integer, already exists as type float dropped=2"}`))
+	}))
+	defer partial.Close()
+	var failures atomic.Int64
+	invalid := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		failures.Inc()
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(`{"error":"unable to parse 'cpu value=': missing field value"}`))
+	}))
+	defer invalid.Close()
+
+	f := writeCorpusToTSMFile(makeFloatsCorpus(10, 10))
+	defer os.Remove(f.Name())
+
+	cmd := newCommand()
+	cmd.opt.Out = strings.TrimPrefix(partial.URL, "http://")
+	cmd.opt.BatchSize = 50
+	cmd.opt.StartTime, cmd.opt.EndTime = math.MinInt64, math.MaxInt64
+	// retrying until it succeeds, which is never for the errors of the data
+	cmd.opt.MaxRetries = 0
+	cmd.opt.Fanouts = []string{"http://" + strings.TrimPrefix(invalid.URL, "http://") + "?on-error=skip"}
+	sink, err := newSink(cmd.opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink.RetryInterval = 0
+	cmd.Sink = sink
+	mig, err := migrateTsmFiles(cmd, &shardGroupInfo{db: "db0", rp: "rp0"}, []string{f.Name()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a batch per series, each written once
+	if requests.Load() != 10 || failures.Load() != 10 {
+		t.Fatalf("expect 10 requests to each destination, got %d and %d", requests.Load(), failures.Load())
+	}
+	if mig.stat.rowsRead != 100 || mig.stat.rowsWritten != 80 || mig.stat.rowsRejected != 20 {
+		t.Fatalf("expect 100 rows read, 80 written and 20 rejected, got %+v", mig.stat)
+	}
+	stats := sink.Stats()
+	if stats.PointsWritten != 80 || stats.PointsRejected != 20 {
+		t.Fatalf("expect 80 rows written and 20 rejected, got %+v", stats)
+	}
+	if n := sink.targets[1].pointsSkipped.Load(); n != 100 {
+		t.Fatalf("expect 100 rows skipped, got %d", n)
+	}
+
+	for _, tt := range []struct {
+		code      int
+		body      string
+		partial   bool
+		dropped   int
+		retryable bool
+	}{
+		{http.StatusBadRequest, `{"error":"partial write: points beyond retention policy dropped=3"}`, true, 3, false},
+		{http.StatusInternalServerError, `{"error":"point time is expired, compared with rp duration"}`, true, 10, false},
+		{http.StatusNotFound, `{"error":"database not found: \"db0\""}`, false, 0, false},
+		{http.StatusServiceUnavailable, `{"error":"engine is closed"}`, false, 0, true},
+		{http.StatusTooManyRequests, `too many requests`, false, 0, true},
+	} {
+		e := parseWriteError(tt.code, http.StatusText(tt.code), []byte(tt.body), 10)
+		if e.Partial != tt.partial || e.Dropped != tt.dropped || e.Retryable() != tt.retryable {
+			t.Fatalf("unexpected error of %d %s: %+v, retryable %v", tt.code, tt.body, e, e.Retryable())
+		}
+	}
+}
+
+// recordSink records the batches written.
+type recordSink struct {
+	mu      sync.Mutex
+	batches []Batch
+	flushed bool
+	// returned by Write and Flush if set
+	writeErr error
+	flushErr error
+}
+
+func (s *recordSink) Write(b *Batch) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.writeErr != nil {
+		return s.writeErr
+	}
+	c := *b
+	c.Lines = append([]byte(nil), b.Lines...)
+	s.batches = append(s.batches, c)
+	return nil
+}
+
+func (s *recordSink) Flush() error {
+	if s.flushErr != nil {
+		return s.flushErr
+	}
+	s.flushed = true
+	return nil
+}
+
+func (s *recordSink) Close() error { return nil }
+
+func (s *recordSink) Stats() SinkStats { return SinkStats{} }
+
+func TestCustomSink(t *testing.T) {
+	f := writeCorpusToTSMFile(basicCorpus)
+	defer os.Remove(f.Name())
+
+	sink := &recordSink{}
+	cmd := newCommand()
+	cmd.opt.BatchSize = 1000
+	cmd.opt.StartTime, cmd.opt.EndTime = math.MinInt64, math.MaxInt64
+	cmd.opt.Mappings = []string{"db0.rp0 -> db1.rp1"}
+	if err := cmd.loadMapping(); err != nil {
+		t.Fatal(err)
+	}
+	cmd.Sink = sink
+	if _, err := migrateTsmFiles(cmd, &shardGroupInfo{db: "db0", rp: "rp0"}, []string{f.Name()}); err != nil {
+		t.Fatal(err)
+	}
+
+	var lines strings.Builder
+	points := 0
+	for _, b := range sink.batches {
+		if b.Database != "db1" || b.RetentionPolicy != "rp1" || b.Precision != "ns" {
+			t.Fatalf("unexpected batch to %s.%s with precision %s", b.Database, b.RetentionPolicy, b.Precision)
+		}
+		lines.Write(b.Lines)
+		points += b.Points
+	}
+	if points != 10 || strings.Count(lines.String(), "\n") != 10 {
+		t.Fatalf("expect 10 points, got %d: %q", points, lines.String())
+	}
+}
+
+// memSource is a source of the series in memory, keyed by the shard id.
+type memSource struct {
+	shards []ShardInfo
+	data   map[string]corpus
+}
+
+func (s *memSource) Shards() ([]ShardInfo, error) { return s.shards, nil }
+
+func (s *memSource) TimeRange(shard ShardInfo) (min, max int64, err error) {
+	min, max = math.MaxInt64, math.MinInt64
+	for _, values := range s.data[shard.ID] {
+		if ts := values[0].UnixNano(); ts < min {
+			min = ts
+		}
+		if ts := values[len(values)-1].UnixNano(); ts > max {
+			max = ts
+		}
+	}
+	return min, max, nil
+}
+
+func (s *memSource) Open(shard ShardInfo, start, end int64) (ShardReader, error) {
+	series := make(map[string]*Series)
+	var keys []string
+	for k, values := range s.data[shard.ID] {
+		key, field := tsm1.SeriesAndFieldFromCompositeKey([]byte(k))
+		if _, ok := series[string(key)]; !ok {
+			series[string(key)] = &Series{Key: string(key), Fields: make(map[string]FieldCursor)}
+			keys = append(keys, string(key))
+		}
+		series[string(key)].Fields[string(field)] = &memCursor{values: values}
+	}
+	sort.Strings(keys)
+	return &memShardReader{series: series, keys: keys}, nil
+}
+
+func (s *memSource) Close() error { return nil }
+
+type memShardReader struct {
+	series map[string]*Series
+	keys   []string
+}
+
+func (r *memShardReader) Next() (*Series, error) {
+	if len(r.keys) == 0 {
+		return nil, nil
+	}
+	s := r.series[r.keys[0]]
+	r.keys = r.keys[1:]
+	return s, nil
+}
+
+func (r *memShardReader) Close() error { return nil }
+
+type memCursor struct {
+	values []tsm1.Value
+}
+
+func (c *memCursor) Peek() (tsm1.Value, error) {
+	if len(c.values) == 0 {
+		return nil, nil
+	}
+	return c.values[0], nil
+}
+
+func (c *memCursor) Next() (tsm1.Value, error) {
+	v, err := c.Peek()
+	if v != nil {
+		c.values = c.values[1:]
+	}
+	return v, err
+}
+
+func TestCustomSource(t *testing.T) {
+	sink := &recordSink{}
+	cmd := NewDataMigrateCommand(&DataMigrateOptions{BatchSize: 1000, StartTime: math.MinInt64, EndTime: math.MaxInt64})
+	cmd.gs = &fakeGeminiService{}
+	cmd.Sink = sink
+	cmd.Source = &memSource{
+		shards: []ShardInfo{{Database: "db0", RetentionPolicy: "rp0", ID: "1"}, {Database: "db0", RetentionPolicy: "rp0", ID: "2"}},
+		data: map[string]corpus{
+			"1": {
+				tsm1.SeriesFieldKey("cpu,host=a", "usage"): []tsm1.Value{tsm1.NewValue(1, float64(1)), tsm1.NewValue(2, float64(2))},
+				tsm1.SeriesFieldKey("cpu,host=a", "idle"):  []tsm1.Value{tsm1.NewValue(2, int64(3))},
+			},
+			"2": {
+				tsm1.SeriesFieldKey("mem,host=a", "used"): []tsm1.Value{tsm1.NewValue(1, int64(4))},
+			},
+		},
+	}
+	if err := cmd.runMigrate(); err != nil {
+		t.Fatal(err)
+	}
+
+	var lines []string
+	for _, b := range sink.batches {
+		lines = append(lines, strings.Split(strings.TrimSpace(string(b.Lines)), "\n")...)
+	}
+	sort.Strings(lines)
+	expect := []string{"cpu,host=a idle=3i,usage=2 2", "cpu,host=a usage=1 1", "mem,host=a used=4i 1"}
+	if !reflect.DeepEqual(lines, expect) || !sink.flushed {
+		t.Fatalf("expect lines %q flushed, got %q", expect, lines)
+	}
+	if cmd.gstat.rowsTotal.Load() != 3 {
+		t.Fatalf("expect 3 rows read, got %d", cmd.gstat.rowsTotal.Load())
+	}
+}
+
+// writeBackupDir writes the corpus of every shard of db0/autogen into the archive of the shard in a temp dir,
+// in the format of `influxd backup -portable`. The shard groups of the shards in groups are in the meta data.
+func writeBackupDir(t *testing.T, shards map[uint64]corpus, groups []time.Time) string {
+	dir := t.TempDir()
+	data := &meta.Data{}
+	if err := data.CreateDatabase("db0"); err != nil {
+		t.Fatal(err)
+	}
+	rpi := &meta.RetentionPolicyInfo{Name: "autogen", ReplicaN: 1, ShardGroupDuration: 7 * 24 * time.Hour}
+	if err := data.CreateRetentionPolicy("db0", rpi, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := data.CreateContinuousQuery("db0", "cq0", "CREATE CONTINUOUS QUERY cq0 ON db0 BEGIN SELECT mean(usage) INTO cpu_1h FROM cpu GROUP BY time(1h) END"); err != nil {
+		t.Fatal(err)
+	}
+	for _, ts := range groups {
+		if err := data.CreateShardGroup("db0", "autogen", ts); err != nil {
+			t.Fatal(err)
+		}
+	}
+	metaBytes, err := data.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	packed, err := backup_util.PortablePacker{Data: metaBytes}.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "20231208T000000Z.meta"), packed, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	manifest := backup_util.Manifest{Meta: backup_util.MetaEntry{FileName: "20231208T000000Z.meta"}}
+	for id, c := range shards {
+		f := writeCorpusToTSMFile(c)
+		buf, err := os.ReadFile(f.Name())
+		os.Remove(f.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		name := fmt.Sprintf("20231208T000000Z.s%d.tar.gz", id)
+		out, err := os.Create(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		zw := gzip.NewWriter(out)
+		tw := tar.NewWriter(zw)
+		shardPath := fmt.Sprintf("db0/autogen/%d/", id)
+		_ = tw.WriteHeader(&tar.Header{Name: shardPath + "index/", Typeflag: tar.TypeDir, Mode: 0755})
+		_ = tw.WriteHeader(&tar.Header{Name: shardPath + "000000001-000000001.tsm", Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(buf))})
+		_, _ = tw.Write(buf)
+		if err := tw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		zw.Close()
+		out.Close()
+		manifest.Files = append(manifest.Files, backup_util.Entry{Database: "db0", Policy: "autogen", ShardID: id, FileName: name})
+	}
+	buf, _ := json.Marshal(manifest)
+	if err := os.WriteFile(filepath.Join(dir, "20231208T000000Z.manifest"), buf, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestBackupSource(t *testing.T) {
+	week := int64(7 * 24 * time.Hour)
+	dir := writeBackupDir(t, map[uint64]corpus{
+		1: {
+			tsm1.SeriesFieldKey("cpu,host=a", "usage"): []tsm1.Value{tsm1.NewValue(1, float64(1)), tsm1.NewValue(2, float64(2))},
+			tsm1.SeriesFieldKey("mem,host=a", "free"):  []tsm1.Value{tsm1.NewValue(1, int64(1))},
+		},
+		// not in the meta data
+		2: {
+			tsm1.SeriesFieldKey("cpu,host=b", "usage"): []tsm1.Value{tsm1.NewValue(week+5, float64(1)), tsm1.NewValue(week+9, float64(2))},
+		},
+	}, []time.Time{time.Unix(0, 1)})
+	tmpDir := t.TempDir()
+
+	opt := &DataMigrateOptions{DataDir: dir, TmpDir: tmpDir}
+	source, err := newSource(opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := source.(*BackupSource); !ok {
+		t.Fatalf("expect the backup source, got %T", source)
+	}
+	shards, err := source.Shards()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(shards) != 2 || shards[0].key() != "db0/autogen/1" || shards[1].key() != "db0/autogen/2" {
+		t.Fatalf("unexpected shards %v", shards)
+	}
+
+	// the time range of the shard group, or the time range of the data if the shard is not in the meta data
+	start := time.Unix(0, 1).Truncate(7 * 24 * time.Hour).UnixNano()
+	for i, expect := range [][2]int64{{start, start + week - 1}, {week + 5, week + 9}} {
+		min, max, err := source.TimeRange(shards[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if min != expect[0] || max != expect[1] {
+			t.Fatalf("expect the time range of shard %s to be %v, got [%d %d]", shards[i].key(), expect, min, max)
+		}
+	}
+
+	r, err := source.Open(shards[0], math.MinInt64, math.MaxInt64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var series []string
+	for {
+		s, err := r.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s == nil {
+			break
+		}
+		series = append(series, s.Key)
+	}
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(series, []string{"cpu,host=a", "mem,host=a"}) {
+		t.Fatalf("unexpected series %v", series)
+	}
+	if entries, _ := os.ReadDir(tmpDir); len(entries) != 0 {
+		t.Fatalf("expect the extracted files removed, got %d entries", len(entries))
+	}
+
+	opt.Database = "db1"
+	if source, err = newSource(opt); err != nil {
+		t.Fatal(err)
+	}
+	if shards, _ := source.Shards(); len(shards) != 0 {
+		t.Fatalf("expect no shard of db1, got %v", shards)
+	}
+
+	s, err := newMetaFileService(filepath.Join(dir, "20231208T000000Z.meta"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cqs, err := s.GetContinuousQueries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cqs) != 1 || cqs[0].name != "cq0" || cqs[0].defaultRP != "autogen" {
+		t.Fatalf("unexpected continuous queries %+v", cqs)
+	}
+}
+
+// fakeInfluxDB answers the queries of the online source, with the points of db0.autogen.cpu
+// in the first hour, split into two chunks.
+func fakeInfluxDB(t *testing.T, selects *atomic.Int64) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Influxdb-Version", "1.8.0")
+		q := r.FormValue("q")
+		switch {
+		case q == "SHOW SHARDS":
+			_, _ = io.WriteString(w, `{"results":[{"statement_id":0,"series":[
+				{"name":"db0","columns":["id","database","retention_policy","shard_group","start_time","end_time","expiry_time","owners"],
+				"values":[[1,"db0","autogen",1,"1970-01-01T00:00:00Z","1970-01-01T03:00:00Z","1970-01-01T03:00:00Z",""]]},
+				{"name":"db1","columns":["id","database","retention_policy","shard_group","start_time","end_time","expiry_time","owners"],
+				"values":[[2,"db1","autogen",2,"1970-01-01T00:00:00Z","1970-01-01T03:00:00Z","1970-01-01T03:00:00Z",""]]}]}]}`)
+		case q == "SHOW FIELD KEYS":
+			_, _ = io.WriteString(w, `{"results":[{"statement_id":0,"series":[
+				{"name":"cpu","columns":["fieldKey","fieldType"],"values":[["count","integer"],["idle","unsigned"],["usage","float"],["up","boolean"]]},
+				{"name":"log","columns":["fieldKey","fieldType"],"values":[["msg","string"]]}]}]}`)
+		case strings.HasPrefix(q, "SELECT"):
+			selects.Inc()
+			if r.FormValue("chunked") != "true" || r.FormValue("db") != "db0" {
+				t.Errorf("unexpected query %s", r.URL.RawQuery)
+			}
+			if q == `SELECT * FROM "autogen".cpu WHERE time >= 0 AND time < 3600000000000 GROUP BY *` {
+				_, _ = io.WriteString(w, `{"results":[{"statement_id":0,"series":[
+					{"name":"cpu","tags":{"host":"a b"},"columns":["time","count","idle","usage","up"],"values":[[1,1,2,0.5,true],[2,null,null,1,null]]},
+					{"name":"cpu","tags":{"host":"c"},"columns":["time","count","idle","usage","up"],"values":[[1,3,null,null,null]],"partial":true}],"partial":true}]}
+{"results":[{"statement_id":0,"series":[
+					{"name":"cpu","tags":{"host":"c"},"columns":["time","count","idle","usage","up"],"values":[[2,4,null,null,false]]}]}]}
+`)
+				return
+			}
+			_, _ = io.WriteString(w, `{"results":[{"statement_id":0}]}`)
+		default:
+			t.Errorf("unexpected query %s", q)
+		}
+	}))
+}
+
+func TestOnlineSource(t *testing.T) {
+	var selects atomic.Int64
+	server := fakeInfluxDB(t, &selects)
+	defer server.Close()
+
+	checkpoint := filepath.Join(t.TempDir(), "checkpoint.json")
+	run := func(sink *recordSink) []string {
+		cmd := NewDataMigrateCommand(&DataMigrateOptions{
+			BatchSize: 1000, StartTime: math.MinInt64, EndTime: math.MaxInt64,
+			Online: true, SrcHost: strings.TrimPrefix(server.URL, "http://"), Database: "db0",
+			Window: "1h", ChunkSize: 1, Checkpoint: checkpoint,
+		})
+		cmd.gs = &fakeGeminiService{}
+		cmd.Sink = sink
+		source, err := newSource(cmd.opt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cmd.Source = source
+		defer source.Close()
+		if err := cmd.runMigrate(); (err != nil) != (sink.flushErr != nil) {
+			t.Fatalf("expect error %v, got %v", sink.flushErr, err)
+		}
+		var lines []string
+		for _, b := range sink.batches {
+			lines = append(lines, strings.Split(strings.TrimSpace(string(b.Lines)), "\n")...)
+		}
+		sort.Strings(lines)
+		return lines
+	}
+
+	// the windows are not recorded if the sink fails to write them out
+	run(&recordSink{flushErr: fmt.Errorf("flush failed")})
+	if _, err := os.Stat(checkpoint); !os.IsNotExist(err) {
+		t.Fatalf("expect no checkpoint, got %v", err)
+	}
+	selects.Store(0)
+
+	lines := run(&recordSink{})
+	expect := []string{
+		`cpu,host=a\ b count=1i,idle=2u,up=true,usage=0.5 1`,
+		`cpu,host=a\ b usage=1 2`,
+		`cpu,host=c count=3i 1`,
+		`cpu,host=c count=4i,up=false 2`,
+	}
+	if !reflect.DeepEqual(lines, expect) {
+		t.Fatalf("expect lines %q, got %q", expect, lines)
+	}
+	// 3 windows of 2 measurements
+	if selects.Load() != 6 {
+		t.Fatalf("expect 6 queries, got %d", selects.Load())
+	}
+
+	// all the windows are in the checkpoint
+	selects.Store(0)
+	if lines := run(&recordSink{}); len(lines) != 0 || selects.Load() != 0 {
+		t.Fatalf("expect nothing read again, got %d queries and lines %q", selects.Load(), lines)
+	}
+}
+
+// writeBoltFile writes the buckets and orgs into the bolt file of InfluxDB 2.x.
+func writeBoltFile(t *testing.T, path string, buckets []bucketRecord, orgs []orgRecord) {
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	err = db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket(boltBucketsBucket)
+		if err != nil {
+			return err
+		}
+		for _, bucket := range buckets {
+			v, _ := json.Marshal(bucket)
+			if err := b.Put([]byte(bucket.ID), v); err != nil {
+				return err
+			}
+		}
+		if b, err = tx.CreateBucket(boltOrgsBucket); err != nil {
+			return err
+		}
+		for _, org := range orgs {
+			v, _ := json.Marshal(org)
+			if err := b.Put([]byte(org.ID), v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEngineSource(t *testing.T) {
+	root := t.TempDir()
+	engine := filepath.Join(root, "engine")
+	data := writeDataDir(t, map[string]corpus{
+		"000000000000000a/autogen/1": {
+			tsm1.SeriesFieldKey("cpu,host=a", "usage"): []tsm1.Value{tsm1.NewValue(1, float64(1))},
+		},
+		"000000000000000b/autogen/2": {
+			tsm1.SeriesFieldKey("cpu,host=b", "usage"): []tsm1.Value{tsm1.NewValue(2, float64(2))},
+		},
+		"000000000000000c/autogen/3": {
+			tsm1.SeriesFieldKey("mem,host=c", "free"): []tsm1.Value{tsm1.NewValue(3, int64(3))},
+		},
+		"000000000000000d/autogen/4": {
+			tsm1.SeriesFieldKey("runs,task=t", "count"): []tsm1.Value{tsm1.NewValue(4, int64(4))},
+		},
+	})
+	for _, dir := range []string{engine, filepath.Join(engine, "wal")} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Rename(data, filepath.Join(engine, "data")); err != nil {
+		t.Fatal(err)
+	}
+	writeBoltFile(t, filepath.Join(root, "influxd.bolt"), []bucketRecord{
+		{ID: "000000000000000a", OrgID: "0000000000000001", Name: "metrics"},
+		{ID: "000000000000000b", OrgID: "0000000000000002", Name: "metrics"},
+		{ID: "000000000000000c", OrgID: "0000000000000001", Name: "hosts"},
+		{ID: "000000000000000d", OrgID: "0000000000000001", Name: "_tasks", Type: systemBucketType},
+	}, []orgRecord{{ID: "0000000000000001", Name: "ops"}, {ID: "0000000000000002", Name: "dev"}})
+
+	if isEngineDir(t.TempDir()) || !isEngineDir(engine) || !isEngineDir(filepath.Join(engine, "data")) {
+		t.Fatal("unexpected detection of the engine dir")
+	}
+	for _, dir := range []string{engine, filepath.Join(engine, "data")} {
+		source, err := newSource(&DataMigrateOptions{DataDir: dir})
+		if err != nil {
+			t.Fatal(err)
+		}
+		shards, err := source.Shards()
+		if err != nil {
+			t.Fatal(err)
+		}
+		expect := []ShardInfo{
+			{Database: "dev_metrics", RetentionPolicy: "autogen", ID: "2"},
+			{Database: "hosts", RetentionPolicy: "autogen", ID: "3"},
+			{Database: "ops_metrics", RetentionPolicy: "autogen", ID: "1"},
+		}
+		if !reflect.DeepEqual(shards, expect) {
+			t.Fatalf("expect shards %v, got %v", expect, shards)
+		}
+		if min, max, err := source.TimeRange(shards[1]); err != nil || min != 3 || max != 3 {
+			t.Fatalf("unexpected time range of shard 3: %d - %d, %v", min, max, err)
+		}
+	}
+
+	source, err := newSource(&DataMigrateOptions{DataDir: engine, Database: "hosts"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if shards, _ := source.Shards(); len(shards) != 1 || shards[0].ID != "3" {
+		t.Fatalf("expect shard 3 of bucket hosts, got %v", shards)
+	}
+	if _, err := newSource(&DataMigrateOptions{DataDir: engine, BoltPath: filepath.Join(root, "missing.bolt")}); err == nil {
+		t.Fatal("expect an error without the bolt file")
+	}
+}
+
+// writeTSIIndex creates the TSI index of the series in the shard dir, and drops the series of dropped.
+func writeTSIIndex(t *testing.T, shardDir string, series []string, dropped []string) {
+	sfile := tsdb.NewSeriesFile(seriesFileDir(shardDir))
+	if err := sfile.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer sfile.Close()
+	// compact the series into index files as well as log files
+	index := tsi1.NewIndex(sfile, "db0", tsi1.WithPath(filepath.Join(shardDir, "index")), tsi1.WithMaximumLogFileSize(1))
+	if err := index.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+
+	keys, names, tagsSlice := make([][]byte, 0, len(series)), make([][]byte, 0, len(series)), make([]models.Tags, 0, len(series))
+	for _, key := range series {
+		name, tags := models.ParseKeyBytes([]byte(key))
+		keys, names, tagsSlice = append(keys, []byte(key)), append(names, name), append(tagsSlice, tags)
+	}
+	if err := index.CreateSeriesListIfNotExists(keys, names, tagsSlice); err != nil {
+		t.Fatal(err)
+	}
+	index.Wait()
+	for _, key := range dropped {
+		name, tags := models.ParseKeyBytes([]byte(key))
+		if err := index.DropSeries(sfile.SeriesID(name, tags, nil), []byte(key), true); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestTSIIndex(t *testing.T) {
+	dir := writeDataDir(t, map[string]corpus{
+		"db0/autogen/1": {
+			tsm1.SeriesFieldKey("cpu,host=a", "usage"): []tsm1.Value{tsm1.NewValue(1, float64(1))},
+			tsm1.SeriesFieldKey("cpu,host=b", "usage"): []tsm1.Value{tsm1.NewValue(2, float64(2))},
+			tsm1.SeriesFieldKey("cpu,host=c", "usage"): []tsm1.Value{tsm1.NewValue(3, float64(3))},
+			tsm1.SeriesFieldKey("mem,host=a", "free"):  []tsm1.Value{tsm1.NewValue(4, int64(4))},
+		},
+		// inmem, no index on disk
+		"db0/autogen/2": {
+			tsm1.SeriesFieldKey("cpu,host=d", "usage"): []tsm1.Value{tsm1.NewValue(5, float64(5))},
+		},
+	})
+	writeTSIIndex(t, filepath.Join(dir, "db0", "autogen", "1"),
+		[]string{"cpu,host=a", "cpu,host=b", "cpu,host=c", "mem,host=a"}, []string{"cpu,host=b"})
+
+	migrate := func(opt *DataMigrateOptions) []string {
+		sink := &recordSink{}
+		opt.DataDir, opt.BatchSize = dir, 1000
+		opt.StartTime, opt.EndTime = math.MinInt64, math.MaxInt64
+		cmd := NewDataMigrateCommand(opt)
+		cmd.gs = &fakeGeminiService{}
+		cmd.Sink = sink
+		source, err := newSource(opt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer source.Close()
+		cmd.Source = source
+		if err := cmd.runMigrate(); err != nil {
+			t.Fatal(err)
+		}
+		var lines []string
+		for _, b := range sink.batches {
+			lines = append(lines, strings.Split(strings.TrimSpace(string(b.Lines)), "\n")...)
+		}
+		sort.Strings(lines)
+		return lines
+	}
+	for _, c := range []struct {
+		opt    *DataMigrateOptions
+		expect []string
+	}{
+		{&DataMigrateOptions{}, []string{"cpu,host=a usage=1 1", "cpu,host=c usage=3 3", "cpu,host=d usage=5 5", "mem,host=a free=4i 4"}},
+		{&DataMigrateOptions{Stream: true}, []string{"cpu,host=a usage=1 1", "cpu,host=c usage=3 3", "cpu,host=d usage=5 5", "mem,host=a free=4i 4"}},
+		{&DataMigrateOptions{IgnoreIndex: true}, []string{"cpu,host=a usage=1 1", "cpu,host=b usage=2 2", "cpu,host=c usage=3 3", "cpu,host=d usage=5 5", "mem,host=a free=4i 4"}},
+		{&DataMigrateOptions{Measurements: []string{"mem"}}, []string{"mem,host=a free=4i 4"}},
+		{&DataMigrateOptions{Tags: []string{"host=b", "host=c", "host=d"}}, []string{"cpu,host=c usage=3 3", "cpu,host=d usage=5 5"}},
+	} {
+		if lines := migrate(c.opt); !reflect.DeepEqual(lines, c.expect) {
+			t.Fatalf("expect lines %q with %+v, got %q", c.expect, c.opt, lines)
+		}
+	}
+
+	var out bytes.Buffer
+	cmd := NewInspectCommand(&InspectOptions{DataDir: dir, Format: "json", IndexOnly: true, Measurements: []string{"cpu"}})
+	cmd.Stdout = &out
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+	var report InspectReport
+	if err := json.Unmarshal(out.Bytes(), &report); err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Shards) != 2 || report.Shards[0].Index != "tsi1" || report.Shards[1].Index != "inmem" {
+		t.Fatalf("unexpected shards: %+v, %+v", report.Shards[0], report.Shards[1])
+	}
+	// host=a and host=c in the index of shard 1, host=d in the TSM file of shard 2
+	if len(report.Measurements) != 1 || report.Measurements[0].Series != 3 || report.Measurements[0].TagKeys["host"] != 3 {
+		t.Fatalf("unexpected measurements: %+v", report.Measurements)
+	}
+}
+
+func TestOnError(t *testing.T) {
+	dir := writeDataDir(t, map[string]corpus{
+		"db0/autogen/1": {tsm1.SeriesFieldKey("cpu,host=a", "usage"): []tsm1.Value{tsm1.NewValue(1, float64(1))}},
+		"db0/autogen/2": {tsm1.SeriesFieldKey("cpu,host=b", "usage"): []tsm1.Value{tsm1.NewValue(2, float64(2))}},
+	})
+	for _, path := range []string{"db0/autogen/2/000000002-000000001.tsm", "db0/autogen/3/000000001-000000001.tsm"} {
+		path = filepath.Join(dir, filepath.FromSlash(path))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte("corrupt"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, c := range []struct {
+		policy  string
+		lines   []string
+		skipped []string
+	}{
+		{OnErrorFail, nil, nil},
+		{OnErrorSkipShard, []string{"cpu,host=a usage=1 1"}, []string{"db0/autogen/2", "db0/autogen/3"}},
+		{OnErrorSkipFile, []string{"cpu,host=a usage=1 1", "cpu,host=b usage=2 2"},
+			[]string{"db0/autogen/3", filepath.Join(dir, "db0", "autogen", "2", "000000002-000000001.tsm")}},
+	} {
+		sink := &recordSink{}
+		opt := &DataMigrateOptions{DataDir: dir, BatchSize: 1000, OnError: c.policy, Report: filepath.Join(dir, c.policy+".json")}
+		opt.StartTime, opt.EndTime = math.MinInt64, math.MaxInt64
+		cmd := NewDataMigrateCommand(opt)
+		cmd.gs = &fakeGeminiService{}
+		cmd.Sink = sink
+		source, err := newSource(opt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cmd.Source = source
+		err = cmd.runMigrate()
+		source.Close()
+
+		b, rerr := os.ReadFile(opt.Report)
+		if rerr != nil {
+			t.Fatal(rerr)
+		}
+		var report RunReport
+		if err := json.Unmarshal(b, &report); err != nil {
+			t.Fatal(err)
+		}
+		if c.policy == OnErrorFail {
+			if err == nil || report.Status != "failed" || report.Error == "" {
+				t.Fatalf("expect the corrupt file to fail the migration, got %v and %s", err, b)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %s", c.policy, err)
+		}
+		var lines []string
+		for _, b := range sink.batches {
+			lines = append(lines, strings.Split(strings.TrimSpace(string(b.Lines)), "\n")...)
+		}
+		sort.Strings(lines)
+		if !reflect.DeepEqual(lines, c.lines) {
+			t.Fatalf("%s: expect %q, got %q", c.policy, c.lines, lines)
+		}
+		var skipped []string
+		for _, u := range report.Skipped {
+			if u.Error == "" {
+				t.Fatalf("%s: expect the error of %+v", c.policy, u)
+			}
+			if u.File != "" {
+				skipped = append(skipped, u.File)
+			} else {
+				skipped = append(skipped, u.Shard)
+			}
+		}
+		if report.Status != "completed" || report.RowsWritten != len(c.lines) || !reflect.DeepEqual(skipped, c.skipped) {
+			t.Fatalf("%s: unexpected report %s", c.policy, b)
+		}
+	}
+
+	// the errors of the sink are not skipped
+	opt := &DataMigrateOptions{DataDir: dir, BatchSize: 1000, OnError: OnErrorSkipFile}
+	opt.StartTime, opt.EndTime = math.MinInt64, math.MaxInt64
+	cmd := NewDataMigrateCommand(opt)
+	cmd.gs = &fakeGeminiService{}
+	cmd.Sink = &recordSink{writeErr: fmt.Errorf("destination down")}
+	source, err := newSource(opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer source.Close()
+	cmd.Source = source
+	if err := cmd.runMigrate(); err == nil || !strings.Contains(err.Error(), "destination down") {
+		t.Fatalf("expect the error of the sink to fail the migration, got %v", err)
+	}
+	for _, u := range cmd.skipped.list() {
+		if strings.Contains(u.Error, "destination down") {
+			t.Fatalf("expect no shard skipped for the sink, got %+v", u)
+		}
+	}
+}
+
+func TestVerify(t *testing.T) {
+	dir := writeDataDir(t, map[string]corpus{"db0/autogen/1": makeFloatsCorpus(3, 10)})
+	path := filepath.Join(dir, "db0", "autogen", "1", "000000001-000000001.tsm")
+	key := tsm1.SeriesFieldKey("m,t=1", "x")
+
+	// flip a byte of the values of the block
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := tsm1.NewTSMReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry := r.Entries([]byte(key))[0]
+	r.Close()
+	f, err = os.OpenFile(path, os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 1)
+	if _, err := f.ReadAt(b, entry.Offset+10); err != nil {
+		t.Fatal(err)
+	}
+	b[0] ^= 0xff
+	if _, err := f.WriteAt(b, entry.Offset+10); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	for _, policy := range []string{VerifyFail, VerifySkipBlock} {
+		sink := &recordSink{}
+		opt := &DataMigrateOptions{DataDir: dir, BatchSize: 1000, Verify: policy, Report: filepath.Join(dir, policy+".json")}
+		opt.StartTime, opt.EndTime = math.MinInt64, math.MaxInt64
+		cmd := NewDataMigrateCommand(opt)
+		cmd.gs = &fakeGeminiService{}
+		cmd.Sink = sink
+		source, err := newSource(opt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cmd.Source = source
+		err = cmd.runMigrate()
+		source.Close()
+
+		b, rerr := os.ReadFile(opt.Report)
+		if rerr != nil {
+			t.Fatal(rerr)
+		}
+		var report RunReport
+		if err := json.Unmarshal(b, &report); err != nil {
+			t.Fatal(err)
+		}
+		if len(report.CorruptBlocks) != 1 || report.CorruptBlocks[0].File != path || report.CorruptBlocks[0].Key != key ||
+			report.CorruptBlocks[0].Offset != entry.Offset || report.CorruptBlocks[0].Shard != "db0/autogen/1" {
+			t.Fatalf("%s: expect the corrupt block of %s at %d, got %s", policy, key, entry.Offset, b)
+		}
+		if policy == VerifyFail {
+			if err == nil || len(sink.batches) != 0 || report.Status != "failed" {
+				t.Fatalf("expect the corrupt block to fail the migration before writing, got %v and %d batches", err, len(sink.batches))
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		rows := 0
+		for _, b := range sink.batches {
+			for _, line := range strings.Split(strings.TrimSpace(string(b.Lines)), "\n") {
+				if strings.HasPrefix(line, "m,t=1 ") {
+					t.Fatalf("expect the corrupt block to be skipped, got %q", line)
+				}
+				rows++
+			}
+		}
+		if rows != 20 || report.RowsWritten != 20 {
+			t.Fatalf("expect 20 rows of the other series, got %d, report %s", rows, b)
+		}
+	}
+}
+
+func TestIncremental(t *testing.T) {
+	dir := t.TempDir()
+	shardDir := filepath.Join(dir, "db0", "autogen", "1")
+	if err := os.MkdirAll(shardDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeFile := func(name string, c corpus) {
+		f := writeCorpusToTSMFile(c)
+		if err := os.Rename(f.Name(), filepath.Join(shardDir, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	values := func(ts ...int64) []tsm1.Value {
+		var vals []tsm1.Value
+		for _, v := range ts {
+			vals = append(vals, tsm1.NewValue(v, float64(v)))
+		}
+		return vals
+	}
+	cpu := func(host string) string { return tsm1.SeriesFieldKey("cpu,host="+host, "usage") }
+	state := filepath.Join(dir, "state.json")
+	run := func(verify string) []string {
+		sink := &recordSink{}
+		opt := &DataMigrateOptions{DataDir: dir, BatchSize: 1000, Incremental: state, Verify: verify}
+		opt.StartTime, opt.EndTime = math.MinInt64, math.MaxInt64
+		cmd := NewDataMigrateCommand(opt)
+		cmd.gs = &fakeGeminiService{}
+		cmd.Sink = sink
+		source, err := newSource(opt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cmd.Source = source
+		if err := cmd.runMigrate(); err != nil {
+			t.Fatal(err)
+		}
+		source.Close()
+		var lines []string
+		for _, b := range sink.batches {
+			lines = append(lines, strings.Split(strings.TrimSpace(string(b.Lines)), "\n")...)
+		}
+		sort.Strings(lines)
+		return lines
+	}
+
+	writeFile("000000001-000000001.tsm", corpus{cpu("a"): values(1, 2)})
+	if lines := run(""); len(lines) != 2 {
+		t.Fatalf("expect all the rows by the first run, got %q", lines)
+	}
+
+	// a new generation written from the cache is read all, including the points written late
+	writeFile("000000002-000000001.tsm", corpus{cpu("a"): values(3), cpu("b"): values(0)})
+	expect := []string{"cpu,host=a usage=3 3", "cpu,host=b usage=0 0"}
+	if lines := run(""); !reflect.DeepEqual(lines, expect) {
+		t.Fatalf("expect %q, got %q", expect, lines)
+	}
+
+	remove := func(names ...string) {
+		for _, name := range names {
+			if err := os.Remove(filepath.Join(shardDir, name)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	// the compaction of the generations migrated is skipped
+	remove("000000001-000000001.tsm", "000000002-000000001.tsm")
+	writeFile("000000002-000000002.tsm", corpus{cpu("a"): values(1, 2, 3), cpu("b"): values(0)})
+	if lines := run(""); len(lines) != 0 {
+		t.Fatalf("expect nothing new, got %q", lines)
+	}
+
+	// a late write with an old timestamp compacted with the generations migrated before the next run
+	// is read, along with the points migrated already
+	remove("000000002-000000002.tsm")
+	writeFile("000000003-000000002.tsm", corpus{cpu("a"): values(1, 2, 3), cpu("b"): values(0), cpu("c"): values(5), cpu("d"): values(0)})
+	expect = []string{"cpu,host=a usage=1 1", "cpu,host=a usage=2 2", "cpu,host=a usage=3 3", "cpu,host=b usage=0 0",
+		"cpu,host=c usage=5 5", "cpu,host=d usage=0 0"}
+	if lines := run(""); !reflect.DeepEqual(lines, expect) {
+		t.Fatalf("expect %q, got %q", expect, lines)
+	}
+	if lines := run(""); len(lines) != 0 {
+		t.Fatalf("expect nothing new, got %q", lines)
+	}
+
+	// the data filtered out would never be migrated
+	for _, opt := range []*DataMigrateOptions{
+		{Incremental: state, Start: "2023-01-01T00:00:00Z"},
+		{Incremental: state, Measurements: []string{"cpu"}},
+		{Incremental: state, Tags: []string{"host=a"}},
+	} {
+		if err := NewDataMigrateCommand(opt).validate(); err == nil {
+			t.Fatalf("expect error for --incremental with %+v", opt)
+		}
+	}
+
+	load := func() (*shardState, []byte) {
+		b, err := os.ReadFile(state)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var shards map[string]*shardState
+		if err := json.Unmarshal(b, &shards); err != nil {
+			t.Fatal(err)
+		}
+		return shards[filepath.Join("db0", "autogen", "1")], b
+	}
+	st, b := load()
+	if st == nil || st.Generation != 3 || !reflect.DeepEqual(st.Files, []string{"000000003-000000002.tsm"}) {
+		t.Fatalf("unexpected state %s", b)
+	}
+
+	// the file with a corrupt block skipped is pending, and read again once it is fixed
+	c := corpus{cpu("e"): values(6), cpu("f"): values(7)}
+	writeFile("000000004-000000001.tsm", c)
+	path := filepath.Join(shardDir, "000000004-000000001.tsm")
+	f, err := os.OpenFile(path, os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt([]byte{0xff, 0xff}, tsmHeaderSize+4+2); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	expect = []string{"cpu,host=f usage=7 7"}
+	if lines := run(VerifySkipBlock); !reflect.DeepEqual(lines, expect) {
+		t.Fatalf("expect %q, got %q", expect, lines)
+	}
+	if st, b := load(); len(st.Files) != 1 || !reflect.DeepEqual(st.Pending, []string{"000000004-000000001.tsm"}) {
+		t.Fatalf("expect the file with the corrupt block pending, got %s", b)
+	}
+	writeFile("000000004-000000001.tsm", c)
+	expect = []string{"cpu,host=e usage=6 6", "cpu,host=f usage=7 7"}
+	if lines := run(VerifySkipBlock); !reflect.DeepEqual(lines, expect) {
+		t.Fatalf("expect %q, got %q", expect, lines)
+	}
+	if st, b := load(); len(st.Files) != 2 || len(st.Pending) != 0 || st.Generation != 4 {
+		t.Fatalf("expect the fixed file migrated, got %s", b)
+	}
+}
+
+func TestTombstones(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "000000001-000000001.tsm")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := tsm1.NewTSMWriter(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 3 blocks of cpu,host=a: [0, 999], [1000, 1999], [2000, 2499]
+	for _, block := range [][2]int64{{0, 1000}, {1000, 2000}, {2000, 2500}} {
+		var values []tsm1.Value
+		for i := block[0]; i < block[1]; i++ {
+			values = append(values, tsm1.NewValue(i, float64(i)))
+		}
+		if err := w.Write([]byte(tsm1.SeriesFieldKey("cpu,host=a", "usage")), values); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the keys are written in order
+	for _, s := range []struct {
+		key    string
+		values []tsm1.Value
+	}{
+		{tsm1.SeriesFieldKey("cpu,host=b", "usage"), []tsm1.Value{tsm1.NewValue(1, float64(1)), tsm1.NewValue(2, float64(2))}},
+		{tsm1.SeriesFieldKey("mem,host=a", "free"), []tsm1.Value{tsm1.NewValue(1, int64(1)), tsm1.NewValue(2, int64(2))}},
+	} {
+		if err := w.Write([]byte(s.key), s.values); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.WriteIndex(); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	tombstones := []struct {
+		keys     []string
+		min, max int64
+	}{
+		// part of the first block, the bounds are inclusive
+		{[]string{"cpu,host=a#!~#usage"}, 10, 20},
+		// the whole second block
+		{[]string{"cpu,host=a#!~#usage"}, 1000, 1999},
+		// across the second and the third blocks
+		{[]string{"cpu,host=a#!~#usage"}, 1990, 2005},
+		// a single point
+		{[]string{"cpu,host=a#!~#usage"}, 2499, 2499},
+		// the whole series
+		{[]string{"mem,host=a#!~#free"}, math.MinInt64, math.MaxInt64},
+	}
+	if f, err = os.Open(path); err != nil {
+		t.Fatal(err)
+	}
+	r, err := tsm1.NewTSMReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tomb := range tombstones {
+		keys := make([][]byte, 0, len(tomb.keys))
+		for _, k := range tomb.keys {
+			keys = append(keys, []byte(k))
+		}
+		if err := r.DeleteRange(keys, tomb.min, tomb.max); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r.Close()
+	if _, err := os.Stat(strings.TrimSuffix(path, ".tsm") + ".tombstone"); err != nil {
+		t.Fatal(err)
+	}
+
+	deleted := func(ts int64) bool {
+		return (ts >= 10 && ts <= 20) || (ts >= 1000 && ts <= 2005) || ts == 2499
+	}
+	for _, c := range []struct {
+		start, end int64
+	}{{math.MinInt64, math.MaxInt64}, {15, 2002}, {5, 2499}} {
+		sr, err := openTSMShard([]string{path}, c.start, c.end, shardReadOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		read := make(map[string][]int64)
+		for {
+			s, err := sr.Next()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if s == nil {
+				break
+			}
+			for _, cursor := range s.Fields {
+				for {
+					v, err := cursor.Next()
+					if err != nil {
+						t.Fatal(err)
+					}
+					if v == nil {
+						break
+					}
+					read[s.Key] = append(read[s.Key], v.UnixNano())
+				}
+			}
+		}
+		sr.Close()
+
+		var expect []int64
+		for i := int64(0); i < 2500; i++ {
+			if i >= c.start && i <= c.end && !deleted(i) {
+				expect = append(expect, i)
+			}
+		}
+		if !reflect.DeepEqual(read["cpu,host=a"], expect) {
+			t.Fatalf("expect %d points of cpu,host=a in [%d, %d], got %d: %v", len(expect), c.start, c.end, len(read["cpu,host=a"]), read["cpu,host=a"])
+		}
+		if len(read["mem,host=a"]) != 0 {
+			t.Fatalf("expect mem,host=a deleted, got %v", read["mem,host=a"])
+		}
+		if c.start <= 1 && len(read["cpu,host=b"]) != 2 {
+			t.Fatalf("expect cpu,host=b untouched, got %v", read["cpu,host=b"])
+		}
+	}
+}
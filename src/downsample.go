@@ -0,0 +1,363 @@
+package src
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/influxdata/influxdb/tsdb/engine/tsm1"
+)
+
+const (
+	aggMean  = "mean"
+	aggMax   = "max"
+	aggMin   = "min"
+	aggSum   = "sum"
+	aggCount = "count"
+	aggFirst = "first"
+	aggLast  = "last"
+)
+
+var supportedAggs = map[string]bool{
+	aggMean:  true,
+	aggMax:   true,
+	aggMin:   true,
+	aggSum:   true,
+	aggCount: true,
+	aggFirst: true,
+	aggLast:  true,
+}
+
+// downsampleRule aggregates the points older than age into windows of interval.
+type downsampleRule struct {
+	age      time.Duration
+	interval time.Duration
+	aggs     []string
+	rp       string // the retention policy to write the aggregated points, empty means the destination rp
+	cutoff   int64  // points before cutoff are aggregated
+}
+
+func (r *downsampleRule) String() string {
+	return fmt.Sprintf("older than %s -> %s %s into rp %q", r.age, r.interval, strings.Join(r.aggs, ","), r.rp)
+}
+
+// parseDownsampleRule parses a rule like `90d:5m:mean,max,last[:rp]`.
+func parseDownsampleRule(s string, now time.Time) (*downsampleRule, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) < 3 || len(parts) > 4 {
+		return nil, fmt.Errorf("invalid downsample rule %q, expect age:interval:aggs[:rp]", s)
+	}
+	age, err := parseDuration(parts[0])
+	if err != nil || age <= 0 {
+		return nil, fmt.Errorf("invalid downsample rule %q: bad age %q", s, parts[0])
+	}
+	interval, err := parseDuration(parts[1])
+	if err != nil || interval <= 0 {
+		return nil, fmt.Errorf("invalid downsample rule %q: bad interval %q", s, parts[1])
+	}
+	rule := &downsampleRule{
+		age:      age,
+		interval: interval,
+		cutoff:   now.Add(-age).UnixNano(),
+	}
+	for _, agg := range strings.Split(parts[2], ",") {
+		agg = strings.ToLower(strings.TrimSpace(agg))
+		if !supportedAggs[agg] {
+			return nil, fmt.Errorf("invalid downsample rule %q: unsupported aggregation %q", s, agg)
+		}
+		rule.aggs = append(rule.aggs, agg)
+	}
+	if len(parts) == 4 {
+		rule.rp = parts[3]
+	}
+	return rule, nil
+}
+
+// parseDownsampleRules parses all rules and sorts them by age in descending order,
+// so the first rule a point is older than is the one with the coarsest resolution.
+func parseDownsampleRules(rules []string, now time.Time) ([]*downsampleRule, error) {
+	var parsed []*downsampleRule
+	for _, s := range rules {
+		rule, err := parseDownsampleRule(s, now)
+		if err != nil {
+			return nil, err
+		}
+		parsed = append(parsed, rule)
+	}
+	sort.SliceStable(parsed, func(i, j int) bool {
+		return parsed[i].age > parsed[j].age
+	})
+	return parsed, nil
+}
+
+// parseDuration is time.ParseDuration with the additional units "d" (day) and "w" (week).
+func parseDuration(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, fmt.Errorf("empty duration")
+	}
+	unit := time.Duration(0)
+	switch s[len(s)-1] {
+	case 'd':
+		unit = 24 * time.Hour
+	case 'w':
+		unit = 7 * 24 * time.Hour
+	default:
+		return time.ParseDuration(s)
+	}
+	n, err := strconv.ParseInt(s[:len(s)-1], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration %q", s)
+	}
+	return time.Duration(n) * unit, nil
+}
+
+// windowStart returns the start of the window ts belongs to, windows are aligned to the epoch.
+func windowStart(ts int64, interval time.Duration) int64 {
+	d := int64(interval)
+	w := ts - ts%d
+	if ts%d < 0 {
+		w -= d
+	}
+	return w
+}
+
+// downsampleRuleOf returns the rule which the point at ts is downsampled by, or nil if the point is
+// written as it is, as Scanner.aggregatorOf.
+func downsampleRuleOf(rules []*downsampleRule, ts int64) *downsampleRule {
+	for _, rule := range rules {
+		if ts < rule.cutoff {
+			return rule
+		}
+	}
+	return nil
+}
+
+// shardSpan is the time range of a shard.
+type shardSpan struct {
+	shard    ShardInfo
+	min, max int64
+}
+
+// checkDownsampleWindows returns an error if a window of a downsample rule spans two shards of the
+// same db/rp. The windows are aggregated per shard, so the aggregations of the window in both shards
+// would be written at the same time and overwrite each other. Since the windows are aligned to the
+// epoch, as the shard groups are, this happens only if the interval does not divide the shard group
+// duration.
+func checkDownsampleWindows(rules []*downsampleRule, spans []shardSpan) error {
+	if len(rules) == 0 {
+		return nil
+	}
+	sorted := append([]shardSpan(nil), spans...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		a, b := sorted[i].shard, sorted[j].shard
+		if a.Database != b.Database {
+			return a.Database < b.Database
+		}
+		if a.RetentionPolicy != b.RetentionPolicy {
+			return a.RetentionPolicy < b.RetentionPolicy
+		}
+		return sorted[i].min < sorted[j].min
+	})
+	for i := 1; i < len(sorted); i++ {
+		prev, next := sorted[i-1], sorted[i]
+		if prev.shard.Database != next.shard.Database || prev.shard.RetentionPolicy != next.shard.RetentionPolicy {
+			continue
+		}
+		rule := downsampleRuleOf(rules, next.min)
+		if rule == nil || rule != downsampleRuleOf(rules, prev.max) {
+			continue
+		}
+		if w := windowStart(next.min, rule.interval); w == windowStart(prev.max, rule.interval) {
+			return fmt.Errorf("dataMigrate: the window at %s of downsample rule %q spans the shards %s and %s, whose aggregations would overwrite each other, use an interval which divides the shard group duration",
+				time.Unix(0, w).UTC().Format(time.RFC3339), rule, prev.shard.key(), next.shard.key())
+		}
+	}
+	return nil
+}
+
+// fieldAgg keeps the state to aggregate one field in a window.
+type fieldAgg struct {
+	count       int64
+	fsum        float64
+	isum        int64
+	usum        uint64
+	first, last tsm1.Value
+	min, max    tsm1.Value
+}
+
+// add aggregates v, or returns false if v is of another type than the values added before, e.g. the
+// field has different types in the TSM files, then v is skipped.
+func (a *fieldAgg) add(v tsm1.Value) bool {
+	if a.count == 0 {
+		a.first, a.min, a.max = v, v, v
+	} else if !sameType(v.Value(), a.first.Value()) {
+		return false
+	}
+	a.count++
+	a.last = v
+	switch val := v.Value().(type) {
+	case float64:
+		a.fsum += val
+		if val < a.min.Value().(float64) {
+			a.min = v
+		}
+		if val > a.max.Value().(float64) {
+			a.max = v
+		}
+	case int64:
+		a.isum += val
+		if val < a.min.Value().(int64) {
+			a.min = v
+		}
+		if val > a.max.Value().(int64) {
+			a.max = v
+		}
+	case uint64:
+		a.usum += val
+		if val < a.min.Value().(uint64) {
+			a.min = v
+		}
+		if val > a.max.Value().(uint64) {
+			a.max = v
+		}
+	}
+	return true
+}
+
+// sameType reports whether the field values are of the same type.
+func sameType(a, b interface{}) bool {
+	switch a.(type) {
+	case float64:
+		_, ok := b.(float64)
+		return ok
+	case int64:
+		_, ok := b.(int64)
+		return ok
+	case uint64:
+		_, ok := b.(uint64)
+		return ok
+	case bool:
+		_, ok := b.(bool)
+		return ok
+	case string:
+		_, ok := b.(string)
+		return ok
+	}
+	return false
+}
+
+// result returns the aggregated value at ts, or nil if the aggregation does not apply to the field type.
+func (a *fieldAgg) result(agg string, ts int64) tsm1.Value {
+	numeric := true
+	switch a.first.Value().(type) {
+	case bool, string:
+		numeric = false
+	}
+	switch agg {
+	case aggCount:
+		return tsm1.NewValue(ts, a.count)
+	case aggFirst:
+		return tsm1.NewValue(ts, a.first.Value())
+	case aggLast:
+		return tsm1.NewValue(ts, a.last.Value())
+	}
+	if !numeric {
+		return nil
+	}
+	switch agg {
+	case aggMin:
+		return tsm1.NewValue(ts, a.min.Value())
+	case aggMax:
+		return tsm1.NewValue(ts, a.max.Value())
+	case aggSum, aggMean:
+		var sum float64
+		switch a.first.Value().(type) {
+		case float64:
+			sum = a.fsum
+		case int64:
+			if agg == aggSum {
+				return tsm1.NewValue(ts, a.isum)
+			}
+			sum = float64(a.isum)
+		case uint64:
+			if agg == aggSum {
+				return tsm1.NewValue(ts, a.usum)
+			}
+			sum = float64(a.usum)
+		}
+		if agg == aggSum {
+			return tsm1.NewValue(ts, sum)
+		}
+		return tsm1.NewValue(ts, sum/float64(a.count))
+	}
+	return nil
+}
+
+// aggregator downsamples the rows of a single series for a rule,
+// the rows must be added in ascending order of time.
+type aggregator struct {
+	rule   *downsampleRule
+	window int64
+	fields map[string]*fieldAgg
+	out    row
+}
+
+func newAggregator(rule *downsampleRule) *aggregator {
+	return &aggregator{
+		rule:   rule,
+		fields: make(map[string]*fieldAgg),
+	}
+}
+
+// add aggregates r, the aggregated row of the previous window is returned once r starts a new window.
+func (a *aggregator) add(r *row) *row {
+	var out *row
+	w := windowStart(r.ts, a.rule.interval)
+	if len(a.fields) > 0 && w != a.window {
+		out = a.flush()
+	}
+	a.window = w
+	for _, f := range r.fields {
+		fa, ok := a.fields[f.key]
+		if !ok {
+			fa = &fieldAgg{}
+			a.fields[f.key] = fa
+		}
+		if !fa.add(f.value) {
+			logger.LogString(fmt.Sprintf("downsample: value of field %s at %d is %T, not %T as the window, skipped", f.key, r.ts,
+				f.value.Value(), fa.first.Value()), TOLOGFILE, LEVEL_WARNING)
+		}
+	}
+	return out
+}
+
+// flush returns the aggregated row of the current window, or nil if there is nothing aggregated.
+// The returned row is only valid until the next call of add or flush.
+func (a *aggregator) flush() *row {
+	if len(a.fields) == 0 {
+		return nil
+	}
+	keys := make([]string, 0, len(a.fields))
+	for k := range a.fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	a.out.ts = a.window
+	a.out.fields = a.out.fields[:0]
+	for _, k := range keys {
+		fa := a.fields[k]
+		for _, agg := range a.rule.aggs {
+			if v := fa.result(agg, a.window); v != nil {
+				a.out.fields = append(a.out.fields, fieldValue{key: agg + "_" + k, value: v})
+			}
+		}
+		delete(a.fields, k)
+	}
+	if len(a.out.fields) == 0 {
+		return nil
+	}
+	return &a.out
+}
@@ -0,0 +1,150 @@
+package src
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.uber.org/atomic"
+)
+
+const (
+	balanceRoundRobin    = "round-robin"
+	balanceLeastInflight = "least-inflight"
+
+	healthCheckInterval = 10 * time.Second
+)
+
+// splitEndpoints splits the comma separated host:port list of --to.
+func splitEndpoints(out string) []string {
+	var hosts []string
+	for _, h := range strings.Split(out, ",") {
+		if h = strings.TrimSpace(h); h != "" {
+			hosts = append(hosts, h)
+		}
+	}
+	return hosts
+}
+
+func checkBalance(balance string) error {
+	switch balance {
+	case "", balanceRoundRobin, balanceLeastInflight:
+		return nil
+	}
+	return fmt.Errorf("dataMigrate: invalid balance policy %q, expect %s or %s", balance, balanceRoundRobin, balanceLeastInflight)
+}
+
+// endpoint is an openGemini ts-sql node to write to.
+type endpoint struct {
+	addr     string // url without path
+	inflight atomic.Int64
+	healthy  atomic.Bool
+}
+
+// endpointPool balances the write requests of all the migrators among the endpoints. An endpoint
+// is marked down once it is unreachable, and is back to the pool once it answers /ping again.
+type endpointPool struct {
+	endpoints []*endpoint
+	balance   string
+	next      atomic.Uint64
+	client    *http.Client
+	// the endpoints marked down are checked in the background every healthCheckInterval
+	down      atomic.Int64
+	lastCheck atomic.Int64
+	checking  atomic.Bool
+}
+
+func newEndpointPool(hosts []string, useSsl bool, balance string) *endpointPool {
+	scheme := "http://"
+	if useSsl {
+		scheme = "https://"
+	}
+	p := &endpointPool{
+		balance: balance,
+		client: &http.Client{
+			Timeout: 5 * time.Second,
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+			},
+		},
+	}
+	for _, host := range hosts {
+		ep := &endpoint{addr: scheme + host}
+		ep.healthy.Store(true)
+		p.endpoints = append(p.endpoints, ep)
+	}
+	return p
+}
+
+// pick returns the endpoint to send the next request to, skipping the ones in tried.
+// nil is returned if no healthy endpoint is left.
+func (p *endpointPool) pick(tried map[*endpoint]struct{}) *endpoint {
+	n := uint64(len(p.endpoints))
+	if n == 0 {
+		return nil
+	}
+	if p.down.Load() > 0 {
+		p.checkHealthInBackground()
+	}
+	start := p.next.Inc()
+	var picked *endpoint
+	for i := uint64(0); i < n; i++ {
+		ep := p.endpoints[(start+i)%n]
+		if _, ok := tried[ep]; ok || !ep.healthy.Load() {
+			continue
+		}
+		if p.balance != balanceLeastInflight {
+			return ep
+		}
+		if picked == nil || ep.inflight.Load() < picked.inflight.Load() {
+			picked = ep
+		}
+	}
+	return picked
+}
+
+func (p *endpointPool) markDown(ep *endpoint, err error) {
+	if ep.healthy.CAS(true, false) {
+		p.down.Inc()
+		p.lastCheck.Store(time.Now().UnixNano())
+		logger.LogString("Endpoint "+ep.addr+" is down: "+err.Error(), TOCONSOLE|TOLOGFILE, LEVEL_WARNING)
+	}
+}
+
+// ping reports whether the endpoint answers /ping.
+func (p *endpointPool) ping(ep *endpoint) bool {
+	resp, err := p.client.Get(ep.addr + "/ping")
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode == http.StatusNoContent || resp.StatusCode == http.StatusOK
+}
+
+// checkHealth pings the endpoints marked down and brings the live ones back.
+func (p *endpointPool) checkHealth() {
+	for _, ep := range p.endpoints {
+		if ep.healthy.Load() || !p.ping(ep) {
+			continue
+		}
+		if ep.healthy.CAS(false, true) {
+			p.down.Dec()
+			logger.LogString("Endpoint "+ep.addr+" is up again", TOCONSOLE|TOLOGFILE, LEVEL_INFO)
+		}
+	}
+}
+
+// checkHealthInBackground checks the health if it is not checked in the last healthCheckInterval.
+func (p *endpointPool) checkHealthInBackground() {
+	now := time.Now().UnixNano()
+	last := p.lastCheck.Load()
+	if now-last < int64(healthCheckInterval) || !p.lastCheck.CAS(last, now) || !p.checking.CAS(false, true) {
+		return
+	}
+	go func() {
+		defer p.checking.Store(false)
+		p.checkHealth()
+	}()
+}
@@ -0,0 +1,194 @@
+package src
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+	bolt "go.etcd.io/bbolt"
+)
+
+// the bolt buckets of InfluxDB 2.x with the buckets and organizations, keyed by their ids
+var (
+	boltBucketsBucket = []byte("bucketsv1")
+	boltOrgsBucket    = []byte("organizationsv1")
+)
+
+// the type of the system buckets of InfluxDB 2.x, e.g. _monitoring and _tasks
+const systemBucketType = 1
+
+type EngineSourceConfig struct {
+	// the engine dir of InfluxDB 2.x, or the data dir in it, which is laid out as
+	// <bucket id>/autogen/<shard id>/*.tsm
+	Dir string
+	// influxd.bolt with the names of the buckets, next to the engine dir if empty
+	BoltPath string
+	// only the shards of the bucket and retention policy are read if set
+	Database        string
+	RetentionPolicy string
+	// see TSMSourceConfig
+	Stream         bool
+	SeriesMemLimit int64
+	Filter         *SeriesFilter
+	IgnoreIndex    bool
+	SkipFiles      bool
+	State          string
+}
+
+// isEngineDir reports whether dir is the engine dir of InfluxDB 2.x or the data dir in it.
+func isEngineDir(dir string) bool {
+	return isBucketsDir(filepath.Join(dir, "data")) || isBucketsDir(dir)
+}
+
+// isBucketsDir reports whether every dir in dir is named after a bucket id of InfluxDB 2.x,
+// which is 16 hex digits.
+func isBucketsDir(dir string) bool {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return false
+	}
+	buckets := 0
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		if !isBucketID(e.Name()) {
+			return false
+		}
+		buckets++
+	}
+	return buckets > 0
+}
+
+func isBucketID(name string) bool {
+	if len(name) != 16 {
+		return false
+	}
+	for _, c := range name {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// NewEngineSource reads the TSM files in the engine dir of InfluxDB 2.x. The buckets are migrated
+// as the databases named after them, the bucket ids are resolved to the names in influxd.bolt.
+func NewEngineSource(cfg EngineSourceConfig) (*TSMSource, error) {
+	engineDir, dataDir := cfg.Dir, filepath.Join(cfg.Dir, "data")
+	if !isBucketsDir(dataDir) {
+		engineDir, dataDir = filepath.Dir(cfg.Dir), cfg.Dir
+	}
+	boltPath := cfg.BoltPath
+	if boltPath == "" {
+		boltPath = filepath.Join(filepath.Dir(engineDir), "influxd.bolt")
+	}
+	databases, err := readBucketNames(boltPath)
+	if err != nil {
+		return nil, err
+	}
+	return NewTSMSource(TSMSourceConfig{
+		DataDir:         dataDir,
+		Databases:       databases,
+		Database:        cfg.Database,
+		RetentionPolicy: cfg.RetentionPolicy,
+		Stream:          cfg.Stream,
+		SeriesMemLimit:  cfg.SeriesMemLimit,
+		Filter:          cfg.Filter,
+		IgnoreIndex:     cfg.IgnoreIndex,
+		SkipFiles:       cfg.SkipFiles,
+		State:           cfg.State,
+	}), nil
+}
+
+// bucketRecord and orgRecord are the parts of the JSON values in influxd.bolt used here.
+type bucketRecord struct {
+	ID    string `json:"id"`
+	OrgID string `json:"orgID"`
+	Type  int    `json:"type"`
+	Name  string `json:"name"`
+}
+
+type orgRecord struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// readBucketNames returns the names of the databases to migrate the buckets to, by the bucket ids.
+// A database is named after its bucket, or <org>_<bucket> if buckets of several orgs share the
+// name. The system buckets are not migrated.
+func readBucketNames(boltPath string) (map[string]string, error) {
+	if _, err := os.Stat(boltPath); err != nil {
+		return nil, fmt.Errorf("dataMigrate: cannot read the bucket names of InfluxDB 2.x, use --bolt-path to specify influxd.bolt: %s", err)
+	}
+	// the file is locked while influxd is running
+	db, err := bolt.Open(boltPath, 0400, &bolt.Options{ReadOnly: true, Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("dataMigrate: open %s, stop influxd or migrate from a copy of the file: %s", boltPath, err)
+	}
+	defer db.Close()
+
+	var buckets []bucketRecord
+	orgs := make(map[string]string)
+	err = db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltBucketsBucket)
+		if b == nil {
+			return fmt.Errorf("dataMigrate: no buckets in %s", boltPath)
+		}
+		if err := b.ForEach(func(k, v []byte) error {
+			var bucket bucketRecord
+			if err := json.Unmarshal(v, &bucket); err != nil {
+				return fmt.Errorf("dataMigrate: invalid bucket %s in %s: %s", k, boltPath, err)
+			}
+			buckets = append(buckets, bucket)
+			return nil
+		}); err != nil {
+			return err
+		}
+		if b := tx.Bucket(boltOrgsBucket); b != nil {
+			return b.ForEach(func(k, v []byte) error {
+				var org orgRecord
+				if err := json.Unmarshal(v, &org); err != nil {
+					return fmt.Errorf("dataMigrate: invalid organization %s in %s: %s", k, boltPath, err)
+				}
+				orgs[org.ID] = org.Name
+				return nil
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	names := make(map[string]int)
+	for _, bucket := range buckets {
+		if bucket.Type != systemBucketType {
+			names[bucket.Name]++
+		}
+	}
+	databases := make(map[string]string, len(buckets))
+	for _, bucket := range buckets {
+		if bucket.Type == systemBucketType {
+			logger.LogString("Skip system bucket "+bucket.Name, TOLOGFILE, LEVEL_INFO)
+			continue
+		}
+		org, ok := orgs[bucket.OrgID]
+		if !ok {
+			org = bucket.OrgID
+		}
+		name := bucket.Name
+		if names[name] > 1 {
+			name = org + "_" + bucket.Name
+			logger.LogString(fmt.Sprintf("Bucket %s exists in several orgs, migrate the one of org %s to database %s",
+				bucket.Name, org, name), TOCONSOLE|TOLOGFILE, LEVEL_WARNING)
+		}
+		logger.LogString(fmt.Sprintf("Bucket %s (%s) of org %s is migrated as database %s", bucket.Name, bucket.ID, org, name),
+			TOLOGFILE, LEVEL_INFO)
+		databases[bucket.ID] = name
+	}
+	return databases, nil
+}
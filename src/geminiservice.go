@@ -2,52 +2,156 @@ package src
 
 import (
 	"fmt"
+	"net/url"
+	"strings"
 	"time"
 
 	client "github.com/influxdata/influxdb1-client/v2"
+	"github.com/influxdata/influxql"
 	"github.com/pkg/errors"
 )
 
 type GeminiService interface {
-	GetShardGroupDuration(database string) (time.Duration, error)
+	GetShardGroupDuration(database, retentionPolicy string) (time.Duration, error)
+	CreateContinuousQuery(database, query string) error
+	CreateUser(name, password string, admin bool) error
+	GrantPrivilege(user, database, privilege string) error
+	GetFieldKeys(database string) (map[string]map[string]string, error)
 }
 
 var _ GeminiService = (*geminiService)(nil)
 
+// geminiService sends the queries to the hosts of --to, and fails over to another host if the one
+// picked is unreachable, as the writes do.
 type geminiService struct {
-	out      string
+	pool     *endpointPool
 	username string
 	password string
-	useSsl   bool
 }
 
 func NewGeminiService(cmd *DataMigrateCommand) *geminiService {
 	return &geminiService{
-		out:      cmd.opt.Out,
+		pool:     newEndpointPool(splitEndpoints(cmd.opt.Out), cmd.opt.Ssl, balanceRoundRobin),
 		username: cmd.opt.Username,
 		password: cmd.opt.Password,
-		useSsl:   cmd.opt.Ssl,
 	}
 }
 
-func (g *geminiService) getUrl() string {
-	url := fmt.Sprintf("http://%s", g.out)
-	if g.useSsl {
-		url = fmt.Sprintf("https://%s", g.out)
-	}
-	return url
-}
-
-func (g *geminiService) GetShardGroupDuration(database string) (time.Duration, error) {
+// newClient returns a client of the endpoint, which is closed by the caller.
+func (g *geminiService) newClient(ep *endpoint) (client.Client, error) {
 	c, err := client.NewHTTPClient(client.HTTPConfig{
-		Addr:               g.getUrl(),
+		Addr:               ep.addr,
+		Username:           g.username,
+		Password:           g.password,
 		InsecureSkipVerify: true,
 	})
 	if err != nil {
-		return 0, errors.WithStack(err)
+		return nil, errors.WithStack(err)
+	}
+	return c, nil
+}
+
+// query sends the query to a healthy endpoint. An endpoint which cannot be connected is marked
+// down, and the query is sent to another one.
+func (g *geminiService) query(q client.Query) (*client.Response, error) {
+	tried := make(map[*endpoint]struct{}, 1)
+	var lastErr error
+	for {
+		ep := g.pool.pick(tried)
+		if ep == nil && len(tried) == 0 {
+			// all the endpoints are down, check whether any one is back
+			g.pool.checkHealth()
+			ep = g.pool.pick(tried)
+		}
+		if ep == nil {
+			if lastErr == nil {
+				lastErr = fmt.Errorf("dataMigrate: no healthy endpoint to query")
+			}
+			return nil, lastErr
+		}
+		tried[ep] = struct{}{}
+
+		c, err := g.newClient(ep)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := c.Query(q)
+		c.Close()
+		// the errors of the HTTP client are *url.Error, the others are answered by the endpoint
+		if _, ok := err.(*url.Error); !ok {
+			return resp, errors.WithStack(err)
+		}
+		g.pool.markDown(ep, err)
+		lastErr = errors.WithStack(err)
+	}
+}
+
+// execute runs the command and returns the error of the response if any.
+func (g *geminiService) execute(command, database string) (*client.Response, error) {
+	resp, err := g.query(client.NewQuery(command, database, ""))
+	if err != nil {
+		return nil, err
 	}
-	defer c.Close()
+	if resp.Error() != nil {
+		return nil, errors.WithStack(resp.Error())
+	}
+	return resp, nil
+}
+
+func (g *geminiService) CreateContinuousQuery(database, query string) error {
+	_, err := g.execute(query, database)
+	return err
+}
+
+func (g *geminiService) CreateUser(name, password string, admin bool) error {
+	command := "CREATE USER " + influxql.QuoteIdent(name) + " WITH PASSWORD " + influxql.QuoteString(password)
+	if admin {
+		command += " WITH ALL PRIVILEGES"
+	}
+	_, err := g.execute(command, "")
+	return err
+}
+
+// GrantPrivilege grants READ, WRITE or ALL PRIVILEGES on the database to the user.
+func (g *geminiService) GrantPrivilege(user, database, privilege string) error {
+	command := "GRANT " + privilege + " ON " + influxql.QuoteIdent(database) + " TO " + influxql.QuoteIdent(user)
+	_, err := g.execute(command, "")
+	return err
+}
+
+// GetFieldKeys returns the field types of all the measurements in the database, keyed by measurement and field.
+func (g *geminiService) GetFieldKeys(database string) (map[string]map[string]string, error) {
+	resp, err := g.execute("SHOW FIELD KEYS", database)
+	if err != nil {
+		// the database does not exist yet, so there is no field
+		if strings.Contains(err.Error(), "database not found") {
+			return map[string]map[string]string{}, nil
+		}
+		return nil, err
+	}
+	fieldKeys := make(map[string]map[string]string)
+	// every series is a measurement with the columns: fieldKey, fieldType
+	for _, result := range resp.Results {
+		for _, series := range result.Series {
+			fields, ok := fieldKeys[series.Name]
+			if !ok {
+				fields = make(map[string]string)
+				fieldKeys[series.Name] = fields
+			}
+			for _, row := range series.Values {
+				if len(row) < 2 {
+					continue
+				}
+				fields[fmt.Sprint(row[0])] = fmt.Sprint(row[1])
+			}
+		}
+	}
+	return fieldKeys, nil
+}
 
+// GetShardGroupDuration returns the shard group duration of the retention policy,
+// the default retention policy of the database is used if retentionPolicy is empty.
+func (g *geminiService) GetShardGroupDuration(database, retentionPolicy string) (time.Duration, error) {
 	q := client.Query{
 		Command:         "show retention policies",
 		Database:        database,
@@ -57,15 +161,15 @@ func (g *geminiService) GetShardGroupDuration(database string) (time.Duration, e
 		ChunkSize:       0,
 		Parameters:      nil,
 	}
-	resp, err := c.Query(q)
+	resp, err := g.query(q)
 	if err != nil {
-		return 0, errors.WithStack(err)
+		return 0, err
 	}
 	var shardGroupDuration time.Duration
 	for _, item := range resp.Results {
 		for _, item1 := range item.Series {
 			for _, row := range item1.Values {
-				if row[7] == "true" {
+				if (retentionPolicy == "" && (row[7] == true || row[7] == "true")) || (retentionPolicy != "" && row[0] == retentionPolicy) {
 					shardGroupDuration, _ = time.ParseDuration(row[2].(string))
 					break
 				}
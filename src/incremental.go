@@ -0,0 +1,157 @@
+package src
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/influxdata/influxdb/tsdb/engine/tsm1"
+	"github.com/pkg/errors"
+)
+
+// shardState is what is migrated of a shard by the runs with --incremental.
+type shardState struct {
+	// the names of the TSM files migrated, e.g. 000000001-000000001.tsm
+	Files []string `json:"files"`
+	// the max generation of the files migrated
+	Generation int `json:"generation"`
+	// the names of the files left out, which are skipped by --on-error or have corrupt blocks skipped
+	// by --verify. Their data may be compacted into any file, so the files not recorded are read
+	// entirely while there are any.
+	Pending []string `json:"pending,omitempty"`
+}
+
+// incrementalState records the TSM files migrated of every shard, so the next run migrates only the
+// new data. It is saved to the file after every shard.
+//
+// InfluxDB writes the cache to a TSM file of a new generation with sequence 1, and compacts the
+// files into one of the max generation of them with the next sequence. So a file of a generation
+// migrated is compacted from the files migrated, and skipped. A file of a new generation is read
+// entirely: even if it is compacted with the files migrated, the points written late with old
+// timestamps may be in any of its blocks. The files left out of a run are not recorded, so they are
+// read again by the next run.
+type incrementalState struct {
+	path string
+	mu   sync.Mutex
+	// shard key to the state
+	shards map[string]*shardState
+}
+
+func loadIncrementalState(path string) (*incrementalState, error) {
+	s := &incrementalState{path: path, shards: make(map[string]*shardState)}
+	buf, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if err := json.Unmarshal(buf, &s.shards); err != nil {
+		return nil, fmt.Errorf("dataMigrate: invalid incremental state %s: %s", path, err)
+	}
+	logger.LogString("Migrating the data since the last run in "+path, TOCONSOLE|TOLOGFILE, LEVEL_INFO)
+	return s, nil
+}
+
+// plan returns the files of the shard to read.
+func (s *incrementalState) plan(shard ShardInfo, files []string) []string {
+	s.mu.Lock()
+	st, ok := s.shards[shard.key()]
+	s.mu.Unlock()
+	if !ok {
+		return files
+	}
+	migrated := make(map[string]struct{}, len(st.Files))
+	for _, name := range st.Files {
+		migrated[name] = struct{}{}
+	}
+
+	var toRead []string
+	for _, f := range files {
+		if _, ok := migrated[filepath.Base(f)]; ok {
+			continue
+		}
+		// the data of the files pending may be compacted into any file
+		gen, _, err := tsm1.DefaultParseFileName(f)
+		if err == nil && len(st.Pending) == 0 && gen <= st.Generation {
+			continue
+		}
+		toRead = append(toRead, f)
+	}
+	if skipped := len(files) - len(toRead); skipped > 0 {
+		logger.LogString(fmt.Sprintf("%d TSM files of shard %s are migrated already", skipped, shard.key()), TOCONSOLE|TOLOGFILE, LEVEL_INFO,
+			ShardField(shard.key()))
+	}
+	return toRead
+}
+
+// set records the files of the shard migrated and the files left out.
+func (s *incrementalState) set(shard ShardInfo, files, pending []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st, ok := s.shards[shard.key()]
+	if !ok {
+		st = &shardState{}
+		s.shards[shard.key()] = st
+	}
+	// the files removed by compactions are dropped
+	st.Files = st.Files[:0]
+	for _, f := range files {
+		name := filepath.Base(f)
+		st.Files = append(st.Files, name)
+		if gen, _, err := tsm1.DefaultParseFileName(name); err == nil && gen > st.Generation {
+			st.Generation = gen
+		}
+	}
+	st.Pending = st.Pending[:0]
+	for _, f := range pending {
+		st.Pending = append(st.Pending, filepath.Base(f))
+	}
+
+	buf, err := json.MarshalIndent(s.shards, "", "  ")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	// write to a temp file first, so the state is never left half written
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, buf, 0644); err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(os.Rename(tmp, s.path))
+}
+
+// committer is implemented by the shard readers which record the data read, once the data of the
+// shard is written to the sink and flushed.
+type committer interface {
+	commit() error
+}
+
+// incrementalShardReader records the files of the shard in the state once the shard is migrated.
+type incrementalShardReader struct {
+	*tsmShardReader
+	state *incrementalState
+	shard ShardInfo
+	// all the files of the shard, including the ones migrated already
+	files []string
+}
+
+func (r *incrementalShardReader) commit() error {
+	skipped := make(map[string]struct{}, len(r.filesSkipped))
+	for _, f := range r.filesSkipped {
+		skipped[f.path] = struct{}{}
+	}
+	// the files skipped by --on-error and the ones with corrupt blocks are read again by the next run
+	files := make([]string, 0, len(r.files))
+	var pending []string
+	for _, f := range r.files {
+		_, ok := skipped[f]
+		if ok || len(r.badBlocks[f]) > 0 {
+			pending = append(pending, f)
+			continue
+		}
+		files = append(files, f)
+	}
+	return r.state.set(r.shard, files, pending)
+}
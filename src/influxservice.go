@@ -0,0 +1,252 @@
+package src
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/influxdata/influxdb/services/meta"
+	client "github.com/influxdata/influxdb1-client/v2"
+	"github.com/influxdata/influxql"
+	"github.com/pkg/errors"
+)
+
+// InfluxService reads the meta data of the source InfluxDB,
+// either from its meta.db file or from the HTTP API of a running instance.
+type InfluxService interface {
+	GetContinuousQueries() ([]continuousQueryInfo, error)
+	GetUsers() ([]userInfo, error)
+	// DefaultRetentionPolicy returns the name of the default retention policy of the database.
+	DefaultRetentionPolicy(database string) (string, error)
+}
+
+var _ InfluxService = (*influxService)(nil)
+var _ InfluxService = (*metaFileService)(nil)
+
+type continuousQueryInfo struct {
+	database  string
+	defaultRP string // the default retention policy of the database
+	name      string
+	query     string
+}
+
+// NewInfluxService prefers the meta file to the running InfluxDB.
+func NewInfluxService(cmd *DataMigrateCommand) (InfluxService, error) {
+	if cmd.opt.MetaDir != "" {
+		return newMetaFileService(cmd.opt.MetaDir)
+	}
+	if cmd.opt.SrcHost != "" {
+		return &influxService{
+			host:     cmd.opt.SrcHost,
+			username: cmd.opt.SrcUsername,
+			password: cmd.opt.SrcPassword,
+			useSsl:   cmd.opt.SrcSsl,
+		}, nil
+	}
+	return nil, fmt.Errorf("dataMigrate: --meta or --src-host is required to read the meta data of InfluxDB")
+}
+
+type metaFileService struct {
+	data *meta.Data
+}
+
+// newMetaFileService loads the meta data from path, which is the meta.db file, the meta dir
+// of InfluxDB (see the config item meta.dir), or the .meta file of a portable backup.
+func newMetaFileService(path string) (*metaFileService, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if !fi.IsDir() && filepath.Ext(path) == ".meta" {
+		data, err := readBackupMeta(path)
+		if err != nil {
+			return nil, err
+		}
+		return &metaFileService{data: data}, nil
+	}
+	if fi.IsDir() {
+		path = filepath.Join(path, "meta.db")
+	}
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	data := &meta.Data{}
+	if err := data.UnmarshalBinary(buf); err != nil {
+		return nil, fmt.Errorf("dataMigrate: unmarshal meta data from %s: %s", path, err)
+	}
+	return &metaFileService{data: data}, nil
+}
+
+func (s *metaFileService) GetContinuousQueries() ([]continuousQueryInfo, error) {
+	var cqs []continuousQueryInfo
+	for _, db := range s.data.Databases {
+		for _, cq := range db.ContinuousQueries {
+			cqs = append(cqs, continuousQueryInfo{
+				database:  db.Name,
+				defaultRP: db.DefaultRetentionPolicy,
+				name:      cq.Name,
+				query:     cq.Query,
+			})
+		}
+	}
+	return cqs, nil
+}
+
+func (s *metaFileService) DefaultRetentionPolicy(database string) (string, error) {
+	db := s.data.Database(database)
+	if db == nil {
+		return "", nil
+	}
+	return db.DefaultRetentionPolicy, nil
+}
+
+func (s *metaFileService) GetUsers() ([]userInfo, error) {
+	users := make([]userInfo, 0, len(s.data.Users))
+	for _, u := range s.data.Users {
+		user := userInfo{
+			name:       u.Name,
+			admin:      u.Admin,
+			privileges: make(map[string]string, len(u.Privileges)),
+		}
+		for db, p := range u.Privileges {
+			if p != influxql.NoPrivileges {
+				user.privileges[db] = p.String()
+			}
+		}
+		users = append(users, user)
+	}
+	return users, nil
+}
+
+type influxService struct {
+	host     string
+	username string
+	password string
+	useSsl   bool
+}
+
+func (s *influxService) getUrl() string {
+	url := fmt.Sprintf("http://%s", s.host)
+	if s.useSsl {
+		url = fmt.Sprintf("https://%s", s.host)
+	}
+	return url
+}
+
+func (s *influxService) query(command, database string) (*client.Response, error) {
+	c, err := client.NewHTTPClient(client.HTTPConfig{
+		Addr:               s.getUrl(),
+		Username:           s.username,
+		Password:           s.password,
+		InsecureSkipVerify: true,
+	})
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer c.Close()
+
+	resp, err := c.Query(client.NewQuery(command, database, ""))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if resp.Error() != nil {
+		return nil, errors.WithStack(resp.Error())
+	}
+	return resp, nil
+}
+
+func (s *influxService) DefaultRetentionPolicy(database string) (string, error) {
+	resp, err := s.query("SHOW RETENTION POLICIES", database)
+	if err != nil {
+		return "", err
+	}
+	// columns: name, duration, shardGroupDuration, replicaN, default
+	for _, result := range resp.Results {
+		for _, series := range result.Series {
+			for _, row := range series.Values {
+				if len(row) >= 5 && row[4] == true {
+					return fmt.Sprint(row[0]), nil
+				}
+			}
+		}
+	}
+	return "", nil
+}
+
+func (s *influxService) GetContinuousQueries() ([]continuousQueryInfo, error) {
+	resp, err := s.query("SHOW CONTINUOUS QUERIES", "")
+	if err != nil {
+		return nil, err
+	}
+	var cqs []continuousQueryInfo
+	// every series is a database with the columns: name, query
+	for _, result := range resp.Results {
+		for _, series := range result.Series {
+			if len(series.Values) == 0 {
+				continue
+			}
+			defaultRP, err := s.DefaultRetentionPolicy(series.Name)
+			if err != nil {
+				return nil, err
+			}
+			for _, row := range series.Values {
+				if len(row) < 2 {
+					continue
+				}
+				cqs = append(cqs, continuousQueryInfo{
+					database:  series.Name,
+					defaultRP: defaultRP,
+					name:      fmt.Sprint(row[0]),
+					query:     fmt.Sprint(row[1]),
+				})
+			}
+		}
+	}
+	return cqs, nil
+}
+
+func (s *influxService) GetUsers() ([]userInfo, error) {
+	resp, err := s.query("SHOW USERS", "")
+	if err != nil {
+		return nil, err
+	}
+	var users []userInfo
+	// columns: user, admin
+	for _, result := range resp.Results {
+		for _, series := range result.Series {
+			for _, row := range series.Values {
+				if len(row) < 2 {
+					continue
+				}
+				users = append(users, userInfo{
+					name:       fmt.Sprint(row[0]),
+					admin:      row[1] == true,
+					privileges: make(map[string]string),
+				})
+			}
+		}
+	}
+
+	for _, u := range users {
+		if u.admin {
+			continue
+		}
+		resp, err := s.query("SHOW GRANTS FOR "+influxql.QuoteIdent(u.name), "")
+		if err != nil {
+			return nil, err
+		}
+		// columns: database, privilege
+		for _, result := range resp.Results {
+			for _, series := range result.Series {
+				for _, row := range series.Values {
+					if len(row) < 2 || row[1] == influxql.NoPrivileges.String() {
+						continue
+					}
+					u.privileges[fmt.Sprint(row[0])] = fmt.Sprint(row[1])
+				}
+			}
+		}
+	}
+	return users, nil
+}
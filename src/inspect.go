@@ -0,0 +1,461 @@
+package src
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/influxdata/influxdb/models"
+	"github.com/influxdata/influxdb/pkg/estimator/hll"
+	"github.com/influxdata/influxdb/tsdb"
+	"github.com/influxdata/influxdb/tsdb/engine/tsm1"
+	"github.com/influxdata/influxdb/tsdb/index/tsi1"
+	"github.com/pkg/errors"
+)
+
+type InspectOptions struct {
+	DataDir         string
+	BoltPath        string // influxd.bolt if DataDir is the engine dir of InfluxDB 2.x
+	Database        string
+	RetentionPolicy string
+	Measurements    []string // the measurements to inspect, all if empty
+	Tags            []string // key=value, only the series with the tags are inspected
+	Format          string   // table or json
+	Exact           bool     // count the points by reading the blocks
+	IgnoreIndex     bool     // inspect the series dropped as well, which are skipped by the TSI index by default
+	IndexOnly       bool     // read the series from the TSI index only, without reading the TSM files
+}
+
+// MeasurementReport is the schema and size of a measurement in a db/rp.
+type MeasurementReport struct {
+	Database        string            `json:"database"`
+	RetentionPolicy string            `json:"retentionPolicy"`
+	Measurement     string            `json:"measurement"`
+	Series          int               `json:"series"`
+	SeriesEstimated bool              `json:"seriesEstimated"`
+	Fields          map[string]string `json:"fields"`                  // field to type, conflicting types are joined by '|'
+	TagKeys         map[string]int    `json:"tagKeys"`                 // tag key to the cardinality of its values
+	TagsEstimated   []string          `json:"tagsEstimated,omitempty"` // the tag keys whose cardinality is estimated
+	MinTime         time.Time         `json:"minTime"`
+	MaxTime         time.Time         `json:"maxTime"`
+	Blocks          int               `json:"blocks"`
+	Points          int64             `json:"points"`
+	PointsEstimated bool              `json:"pointsEstimated"`
+	Size            int64             `json:"size"` // bytes of the blocks
+}
+
+// ShardReport is the on-disk size of a shard.
+type ShardReport struct {
+	Database        string `json:"database"`
+	RetentionPolicy string `json:"retentionPolicy"`
+	ID              string `json:"id"`
+	Index           string `json:"index"` // tsi1 or inmem, which has no index on disk
+	Files           int    `json:"files"`
+	Size            int64  `json:"size"`
+}
+
+type InspectReport struct {
+	Shards       []*ShardReport       `json:"shards"`
+	Measurements []*MeasurementReport `json:"measurements"`
+}
+
+// exactCardinality is the max number of the distinct values counted exactly, the cardinality
+// beyond it is estimated, so a measurement of high cardinality does not exhaust the memory.
+const exactCardinality = 100000
+
+// cardinality counts the distinct values in a set till exactCardinality, then in a HyperLogLog
+// sketch, which estimates the count with a standard error of about 0.4%.
+type cardinality struct {
+	exact  map[string]struct{}
+	sketch *hll.Plus
+}
+
+func newCardinality() *cardinality {
+	return &cardinality{exact: make(map[string]struct{})}
+}
+
+func (c *cardinality) add(v []byte) {
+	if c.sketch != nil {
+		c.sketch.Add(v)
+		return
+	}
+	if _, ok := c.exact[string(v)]; ok {
+		return
+	}
+	c.exact[string(v)] = struct{}{}
+	if len(c.exact) <= exactCardinality {
+		return
+	}
+	c.sketch = hll.NewDefaultPlus()
+	for k := range c.exact {
+		c.sketch.Add([]byte(k))
+	}
+	c.exact = nil
+}
+
+func (c *cardinality) count() int {
+	if c.sketch != nil {
+		return int(c.sketch.Count())
+	}
+	return len(c.exact)
+}
+
+func (c *cardinality) estimated() bool {
+	return c.sketch != nil
+}
+
+// measurementStat accumulates the report of a measurement across the shards.
+type measurementStat struct {
+	report    *MeasurementReport
+	series    *cardinality
+	fields    map[string]map[string]struct{}
+	tagValues map[string]*cardinality
+	minTime   int64
+	maxTime   int64
+}
+
+// InspectCommand reports the schema and size of the TSM files in the data dir of InfluxDB.
+type InspectCommand struct {
+	Stdout io.Writer
+
+	opt    *InspectOptions
+	filter *SeriesFilter
+	stat   map[string]*measurementStat
+}
+
+func NewInspectCommand(opt *InspectOptions) *InspectCommand {
+	return &InspectCommand{
+		Stdout: os.Stdout,
+		opt:    opt,
+		stat:   make(map[string]*measurementStat),
+	}
+}
+
+func (cmd *InspectCommand) Run() error {
+	if cmd.opt.Format != "table" && cmd.opt.Format != "json" {
+		return fmt.Errorf("dataMigrate: invalid format %q, expect table or json", cmd.opt.Format)
+	}
+	dm := NewDataMigrateCommand(&DataMigrateOptions{
+		DataDir:         cmd.opt.DataDir,
+		Database:        cmd.opt.Database,
+		RetentionPolicy: cmd.opt.RetentionPolicy,
+	})
+	if err := dm.validate(); err != nil {
+		return err
+	}
+	filter, err := NewSeriesFilter(cmd.opt.Measurements, cmd.opt.Tags)
+	if err != nil {
+		return err
+	}
+	cmd.filter = filter
+	var source *TSMSource
+	if isEngineDir(cmd.opt.DataDir) {
+		source, err = NewEngineSource(EngineSourceConfig{
+			Dir:             cmd.opt.DataDir,
+			BoltPath:        cmd.opt.BoltPath,
+			Database:        cmd.opt.Database,
+			RetentionPolicy: cmd.opt.RetentionPolicy,
+			IgnoreIndex:     cmd.opt.IgnoreIndex,
+		})
+		if err != nil {
+			return err
+		}
+	} else {
+		source = NewTSMSource(TSMSourceConfig{
+			DataDir:         cmd.opt.DataDir,
+			Database:        cmd.opt.Database,
+			RetentionPolicy: cmd.opt.RetentionPolicy,
+			IgnoreIndex:     cmd.opt.IgnoreIndex,
+		})
+	}
+	defer source.Close()
+	shards, err := source.Shards()
+	if err != nil {
+		return err
+	}
+
+	report := &InspectReport{}
+	for _, info := range shards {
+		shard, err := cmd.inspectShard(source, info)
+		if err != nil {
+			return err
+		}
+		report.Shards = append(report.Shards, shard)
+	}
+
+	keys := make([]string, 0, len(cmd.stat))
+	for k := range cmd.stat {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		s := cmd.stat[k]
+		r := s.report
+		r.Series = s.series.count()
+		r.SeriesEstimated = s.series.estimated()
+		for field, types := range s.fields {
+			names := make([]string, 0, len(types))
+			for typ := range types {
+				names = append(names, typ)
+			}
+			sort.Strings(names)
+			r.Fields[field] = strings.Join(names, "|")
+		}
+		for tagKey, values := range s.tagValues {
+			r.TagKeys[tagKey] = values.count()
+			if values.estimated() {
+				r.TagsEstimated = append(r.TagsEstimated, tagKey)
+			}
+		}
+		sort.Strings(r.TagsEstimated)
+		// the time range is unknown without reading the TSM files
+		if r.Blocks > 0 {
+			r.MinTime = time.Unix(0, s.minTime).UTC()
+			r.MaxTime = time.Unix(0, s.maxTime).UTC()
+		}
+		report.Measurements = append(report.Measurements, r)
+	}
+
+	if cmd.opt.Format == "json" {
+		enc := json.NewEncoder(cmd.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(report)
+	}
+	return cmd.printTable(report)
+}
+
+// inspectShard adds the series of the shard to the statistics. The series dropped are skipped
+// if the shard has a TSI index.
+func (cmd *InspectCommand) inspectShard(source *TSMSource, info ShardInfo) (*ShardReport, error) {
+	shard := &ShardReport{Database: info.Database, RetentionPolicy: info.RetentionPolicy, ID: info.ID, Index: "inmem"}
+	index, err := source.openIndex(info)
+	if err != nil {
+		return nil, err
+	}
+	if index != nil {
+		defer index.Close()
+		shard.Index = tsi1.IndexName
+	}
+
+	if cmd.opt.IndexOnly && index != nil {
+		if err := cmd.inspectIndex(index, info); err != nil {
+			return nil, err
+		}
+		for _, file := range source.Files(info) {
+			fi, err := os.Stat(file)
+			if err != nil {
+				return nil, errors.WithStack(err)
+			}
+			shard.Files++
+			shard.Size += fi.Size()
+		}
+		return shard, nil
+	}
+	if cmd.opt.IndexOnly {
+		logger.LogString("Shard "+info.key()+" has no TSI index, read its TSM files", TOCONSOLE|TOLOGFILE, LEVEL_WARNING)
+	}
+	for _, file := range source.Files(info) {
+		size, err := cmd.inspectFile(file, info, index)
+		if err != nil {
+			return nil, err
+		}
+		shard.Files++
+		shard.Size += size
+	}
+	return shard, nil
+}
+
+// inspectIndex adds the series in the TSI index of the shard to the statistics, the fields, time
+// range, blocks and points are not known without reading the TSM files.
+func (cmd *InspectCommand) inspectIndex(index *shardIndex, info ShardInfo) error {
+	measurements, err := index.measurements()
+	if err != nil {
+		return err
+	}
+	for _, name := range measurements {
+		if !cmd.filter.MatchMeasurement(name) {
+			continue
+		}
+		ids, err := index.measurementSeries([]byte(name))
+		if err != nil {
+			return err
+		}
+		for _, id := range ids {
+			_, tags := tsdb.ParseSeriesKey(index.sfile.SeriesKey(id))
+			series := models.MakeKey([]byte(name), tags)
+			if !cmd.filter.Match(series) {
+				continue
+			}
+			cmd.addSeries(cmd.measurementStat(info, name), series, tags)
+		}
+	}
+	return nil
+}
+
+func (cmd *InspectCommand) addSeries(s *measurementStat, series []byte, tags models.Tags) {
+	s.series.add(series)
+	for _, tag := range tags {
+		values, ok := s.tagValues[string(tag.Key)]
+		if !ok {
+			values = newCardinality()
+			s.tagValues[string(tag.Key)] = values
+		}
+		values.add(tag.Value)
+	}
+}
+
+// inspectFile adds the index of the TSM file to the statistics, and returns the size of the file.
+// The series not selected or dropped from the TSI index are skipped.
+func (cmd *InspectCommand) inspectFile(file string, info ShardInfo, index *shardIndex) (int64, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+	defer f.Close()
+
+	r, err := tsm1.NewTSMReader(f)
+	if err != nil {
+		return 0, fmt.Errorf("unable to read %s: %s", file, err)
+	}
+	defer r.Close()
+
+	var entries []tsm1.IndexEntry
+	var lastSeries []byte
+	var s *measurementStat
+	skip := false
+	for i := 0; i < r.KeyCount(); i++ {
+		key, typ := r.KeyAt(i)
+		series, field := tsm1.SeriesAndFieldFromCompositeKey(key)
+		if !bytes.Equal(series, lastSeries) {
+			lastSeries = append(lastSeries[:0], series...)
+			skip = !cmd.filter.Match(series) || (index != nil && !index.live(series))
+			if skip {
+				continue
+			}
+			name, tags := models.ParseKeyBytes(series)
+			s = cmd.measurementStat(info, string(name))
+			cmd.addSeries(s, series, tags)
+		}
+		if skip {
+			continue
+		}
+
+		types, ok := s.fields[string(field)]
+		if !ok {
+			types = make(map[string]struct{})
+			s.fields[string(field)] = types
+		}
+		types[blockTypeName(typ)] = struct{}{}
+
+		entries = r.ReadEntries(key, &entries)
+		for j := range entries {
+			e := &entries[j]
+			s.report.Blocks++
+			s.report.Size += int64(e.Size)
+			if e.MinTime < s.minTime {
+				s.minTime = e.MinTime
+			}
+			if e.MaxTime > s.maxTime {
+				s.maxTime = e.MaxTime
+			}
+			if !cmd.opt.Exact {
+				s.report.Points += estimateBlockPoints(e)
+				continue
+			}
+			_, block, err := r.ReadBytes(e, nil)
+			if err != nil {
+				return 0, fmt.Errorf("read block of %s at offset %d: %s", file, e.Offset, err)
+			}
+			n, err := tsm1.BlockCount(block)
+			if err != nil {
+				return 0, fmt.Errorf("count block of %s at offset %d: %s", file, e.Offset, err)
+			}
+			s.report.Points += int64(n)
+		}
+	}
+	return int64(r.Size()), nil
+}
+
+// estimateBlockPoints returns the upper bound of the points in the block, since the count
+// is not known without reading the block.
+func estimateBlockPoints(e *tsm1.IndexEntry) int64 {
+	n := int64(tsdb.DefaultMaxPointsPerBlock)
+	if span := e.MaxTime - e.MinTime + 1; span > 0 && span < n {
+		n = span
+	}
+	return n
+}
+
+func (cmd *InspectCommand) measurementStat(info ShardInfo, measurement string) *measurementStat {
+	key := info.Database + "\x00" + info.RetentionPolicy + "\x00" + measurement
+	s, ok := cmd.stat[key]
+	if !ok {
+		s = &measurementStat{
+			report: &MeasurementReport{
+				Database:        info.Database,
+				RetentionPolicy: info.RetentionPolicy,
+				Measurement:     measurement,
+				Fields:          make(map[string]string),
+				TagKeys:         make(map[string]int),
+				PointsEstimated: !cmd.opt.Exact,
+			},
+			series:    newCardinality(),
+			fields:    make(map[string]map[string]struct{}),
+			tagValues: make(map[string]*cardinality),
+			minTime:   models.MaxNanoTime,
+			maxTime:   models.MinNanoTime,
+		}
+		cmd.stat[key] = s
+	}
+	return s
+}
+
+func (cmd *InspectCommand) printTable(report *InspectReport) error {
+	w := tabwriter.NewWriter(cmd.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "DATABASE\tRP\tSHARD\tINDEX\tFILES\tSIZE")
+	for _, s := range report.Shards {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%d\n", s.Database, s.RetentionPolicy, s.ID, s.Index, s.Files, s.Size)
+	}
+	fmt.Fprintln(w)
+
+	points := "POINTS"
+	if !cmd.opt.Exact {
+		points = "POINTS(EST.)"
+	}
+	fmt.Fprintln(w, "DATABASE\tRP\tMEASUREMENT\tSERIES\tFIELDS\tTAG KEYS\tMIN TIME\tMAX TIME\tBLOCKS\t"+points+"\tSIZE")
+	for _, m := range report.Measurements {
+		fields := make([]string, 0, len(m.Fields))
+		for f, typ := range m.Fields {
+			fields = append(fields, f+":"+typ)
+		}
+		sort.Strings(fields)
+		estimated := make(map[string]bool, len(m.TagsEstimated))
+		for _, k := range m.TagsEstimated {
+			estimated[k] = true
+		}
+		tagKeys := make([]string, 0, len(m.TagKeys))
+		for k, n := range m.TagKeys {
+			tagKeys = append(tagKeys, k+"("+estimatedCount(n, estimated[k])+")")
+		}
+		sort.Strings(tagKeys)
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%d\t%d\t%d\n",
+			m.Database, m.RetentionPolicy, m.Measurement, estimatedCount(m.Series, m.SeriesEstimated), strings.Join(fields, ","), strings.Join(tagKeys, ","),
+			m.MinTime.Format(time.RFC3339Nano), m.MaxTime.Format(time.RFC3339Nano), m.Blocks, m.Points, m.Size)
+	}
+	return w.Flush()
+}
+
+// estimatedCount formats the count, prefixed with ~ if it is estimated.
+func estimatedCount(n int, estimated bool) string {
+	if estimated {
+		return "~" + strconv.Itoa(n)
+	}
+	return strconv.Itoa(n)
+}
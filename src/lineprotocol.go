@@ -0,0 +1,100 @@
+package src
+
+import (
+	"strconv"
+
+	"github.com/influxdata/influxdb/tsdb/engine/tsm1"
+)
+
+// appendLine encodes a row of the series into line protocol and appends it to b.
+// The series key read from the TSM index is already escaped as in line protocol, so it is
+// copied as it is. ts is divided by unit, the nanoseconds of the write precision.
+// Nothing is allocated once b has enough capacity, see appendFieldValue.
+func appendLine(b []byte, series string, fields []fieldValue, ts, unit int64) []byte {
+	b = append(b, series...)
+	for i, f := range fields {
+		if i == 0 {
+			b = append(b, ' ')
+		} else {
+			b = append(b, ',')
+		}
+		b = appendEscapedKey(b, f.key)
+		b = append(b, '=')
+		b = appendFieldValue(b, f.value)
+	}
+	b = append(b, ' ')
+	if unit > 1 {
+		ts /= unit
+	}
+	b = strconv.AppendInt(b, ts, 10)
+	return append(b, '\n')
+}
+
+// appendEscapedKey escapes the commas, spaces, equal signs and double quotes in a field key.
+func appendEscapedKey(b []byte, key string) []byte {
+	for i := 0; i < len(key); i++ {
+		switch c := key[i]; c {
+		case ',', ' ', '=', '"':
+			b = append(b, '\\', c)
+		default:
+			b = append(b, c)
+		}
+	}
+	return b
+}
+
+// appendStringField quotes a string field value, escaping the backslashes and double quotes.
+func appendStringField(b []byte, s string) []byte {
+	b = append(b, '"')
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '\\', '"':
+			b = append(b, '\\', c)
+		default:
+			b = append(b, c)
+		}
+	}
+	return append(b, '"')
+}
+
+// appendFieldValue writes the value by its concrete type. tsm1 has no accessor of the raw values but
+// Value() interface{}, which is inlined for the concrete types, so the value boxed does not escape
+// and is not allocated on the heap. TestAppendLine checks that nothing is allocated.
+func appendFieldValue(b []byte, v tsm1.Value) []byte {
+	switch v := v.(type) {
+	case tsm1.FloatValue:
+		return strconv.AppendFloat(b, v.Value().(float64), 'f', -1, 64)
+	case tsm1.IntegerValue:
+		return append(strconv.AppendInt(b, v.Value().(int64), 10), 'i')
+	case tsm1.UnsignedValue:
+		return append(strconv.AppendUint(b, v.Value().(uint64), 10), 'u')
+	case tsm1.BooleanValue:
+		return strconv.AppendBool(b, v.Value().(bool))
+	case tsm1.StringValue:
+		return appendStringField(b, v.Value().(string))
+	}
+	// the values aggregated by downsampling or unknown value types
+	switch x := v.Value().(type) {
+	case float64:
+		return strconv.AppendFloat(b, x, 'f', -1, 64)
+	case int64:
+		return append(strconv.AppendInt(b, x, 10), 'i')
+	case uint64:
+		return append(strconv.AppendUint(b, x, 10), 'u')
+	case bool:
+		return strconv.AppendBool(b, x)
+	case string:
+		return appendStringField(b, x)
+	}
+	return appendStringField(b, v.String())
+}
+
+// sortFields sorts the fields of a row by key as line protocol expects. The fields are mostly
+// sorted already, so insertion sort is used, which does not allocate.
+func sortFields(fields []fieldValue) {
+	for i := 1; i < len(fields); i++ {
+		for j := i; j > 0 && fields[j].key < fields[j-1].key; j-- {
+			fields[j], fields[j-1] = fields[j-1], fields[j]
+		}
+	}
+}
@@ -5,10 +5,18 @@ copyright 2023 Qizhi Huang(flaggyellow@qq.com)
 package src
 
 import (
+	"encoding/json"
+	"fmt"
+	"io"
 	"log"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
+
+	"github.com/pkg/errors"
 )
 
 const (
@@ -30,14 +38,54 @@ var LevelPrefixDict map[int]string = map[int]string{
 	LEVEL_ERROR:   "ERROR: ",
 }
 
+// LevelNameDict is the names of the levels in --log-level and the json logs.
+var LevelNameDict map[int]string = map[int]string{
+	LEVEL_DEBUG:   "debug",
+	LEVEL_INFO:    "info",
+	LEVEL_WARNING: "warning",
+	LEVEL_ERROR:   "error",
+}
+
+const (
+	LogFormatText = "text"
+	LogFormatJson = "json"
+)
+
+// Field is a structured field of a json log message, e.g. the shard or the file being migrated.
+type Field struct {
+	Key   string
+	Value string
+}
+
+func ShardField(key string) Field  { return Field{Key: "shard", Value: key} }
+func FileField(path string) Field  { return Field{Key: "file", Value: path} }
+func SeriesField(key string) Field { return Field{Key: "series", Value: key} }
+
+// LogConfig is how the messages are logged, see Log.Configure.
+type LogConfig struct {
+	// the dir of the log file
+	Dir string
+	// debug, info, warning or error, the messages of the lower levels are dropped
+	Level string
+	// text or json
+	Format string
+	// the size in MB to rotate the log file at, 0 means never
+	MaxSize int
+	// the rotated files to keep, 0 means all
+	MaxBackups int
+	// log to the console only
+	NoFile bool
+}
+
 type Log struct {
 	logDir        string
 	logName       string
-	fileWriter    *os.File
+	fileWriter    io.WriteCloser
 	fileLogger    *log.Logger
 	consoleLogger *log.Logger
 	errorLogger   *log.Logger
-	debug         bool
+	level         int
+	format        string
 }
 
 var Logger *Log
@@ -48,70 +96,214 @@ func init() {
 	logger = Logger
 }
 
+// NewLogger returns the logger to the console, the log file is opened by Configure.
 func NewLogger() *Log {
-	var err error
-	tm := time.Unix(0, time.Now().UnixNano())
-	timestr := tm.Format("2006-01-02_15-04-05")
-	filename := "migrate_log_" + timestr + ".log"
 	l := &Log{
-		logDir:  "./logs",
-		logName: filename,
-		debug:   false,
+		level:  LEVEL_INFO,
+		format: LogFormatText,
 	}
-	logPath := filepath.Join(l.logDir, l.logName)
+	l.consoleLogger = log.New(os.Stdout, "", log.LstdFlags)
+	l.errorLogger = log.New(os.Stderr, "\n", 0)
+	return l
+}
 
-	err = os.MkdirAll(l.logDir, os.ModePerm)
-	if err != nil {
-		log.Fatalf("ERROR: failed to create log path: %v\n", err)
+// Configure applies the level and the format, and opens the log file migrate_log_<time>.log in
+// the dir unless NoFile is set.
+func (l *Log) Configure(cfg LogConfig) error {
+	level := -1
+	for lv, name := range LevelNameDict {
+		if strings.EqualFold(cfg.Level, name) {
+			level = lv
+		}
+	}
+	if level < 0 {
+		return fmt.Errorf("dataMigrate: invalid log level %q, expect debug, info, warning or error", cfg.Level)
+	}
+	flags := log.LstdFlags
+	switch cfg.Format {
+	case LogFormatText:
+	case LogFormatJson:
+		// the time is a field of the json
+		flags = 0
+	default:
+		return fmt.Errorf("dataMigrate: invalid log format %q, expect text or json", cfg.Format)
+	}
+	if cfg.MaxSize < 0 || cfg.MaxBackups < 0 {
+		return fmt.Errorf("dataMigrate: invalid log rotation, the max size and backups must not be negative")
 	}
 
-	l.fileWriter, err = os.OpenFile(logPath, os.O_WRONLY|os.O_CREATE, 0755)
+	l.closeFile()
+	l.level, l.format = level, cfg.Format
+	l.consoleLogger = log.New(os.Stdout, "", flags)
+	if cfg.NoFile {
+		return nil
+	}
+	l.logDir = cfg.Dir
+	l.logName = "migrate_log_" + time.Now().Format("2006-01-02_15-04-05") + ".log"
+	w, err := newRotateWriter(filepath.Join(l.logDir, l.logName), int64(cfg.MaxSize)*1024*1024, cfg.MaxBackups)
 	if err != nil {
-		log.Fatalf("ERROR: failed to open log file: %v\n", err)
+		return err
 	}
-
-	l.fileLogger = log.New(l.fileWriter, "", log.LstdFlags)
-	l.consoleLogger = log.New(os.Stdout, "", log.LstdFlags)
-	l.errorLogger = log.New(os.Stderr, "\n", 0)
-
-	return l
+	l.fileWriter = w
+	l.fileLogger = log.New(w, "", flags)
+	return nil
 }
 
+// SetDebug enables the debug messages.
 func (l *Log) SetDebug() {
-	l.debug = true
+	l.level = LEVEL_DEBUG
 }
 
 func (l *Log) IsDebug() bool {
-	return l.debug
+	return l.level == LEVEL_DEBUG
 }
 
-func (l *Log) LogString(str string, target int, level int) {
-	if level == LEVEL_DEBUG {
-		if !l.debug {
-			return
-		}
+// LogString logs the message with the fields to the targets, if the level is enabled.
+func (l *Log) LogString(str string, target int, level int, fields ...Field) {
+	if level < l.level {
+		return
 	}
-	prefix := LevelPrefixDict[level]
-	if target&TOLOGFILE > 0 {
-		l.fileLogger.Println(prefix, str)
+	if target&TOLOGFILE > 0 && l.fileLogger != nil {
+		l.fileLogger.Println(l.formatMessage(str, level, true, fields))
 	}
 	if target&TOCONSOLE > 0 {
-		if level < LEVEL_WARNING {
-			l.consoleLogger.Println(str)
-		} else if level >= LEVEL_WARNING {
-			l.consoleLogger.Println(prefix, str)
+		l.consoleLogger.Println(l.formatMessage(str, level, level >= LEVEL_WARNING, fields))
+	}
+}
+
+// formatMessage returns the message in the format of the logger. The fields are in the json
+// messages only, since the text messages mention them already. The level is prefixed to the
+// text messages if withLevel is set.
+func (l *Log) formatMessage(str string, level int, withLevel bool, fields []Field) string {
+	if l.format == LogFormatJson {
+		var b strings.Builder
+		b.WriteString(`{"time":`)
+		b.WriteString(strconv.Quote(time.Now().Format(time.RFC3339Nano)))
+		b.WriteString(`,"level":`)
+		b.WriteString(strconv.Quote(LevelNameDict[level]))
+		b.WriteString(`,"msg":`)
+		b.Write(jsonString(str))
+		for _, f := range fields {
+			b.WriteByte(',')
+			b.Write(jsonString(f.Key))
+			b.WriteByte(':')
+			b.Write(jsonString(f.Value))
 		}
+		b.WriteByte('}')
+		return b.String()
+	}
+
+	if withLevel {
+		return LevelPrefixDict[level] + " " + str
 	}
+	return str
+}
+
+func jsonString(s string) []byte {
+	b, _ := json.Marshal(s)
+	return b
 }
 
 func (l *Log) LogError(err error) {
-	l.fileLogger.Println("ERROR: ", err.Error())
+	if l.fileLogger != nil {
+		l.fileLogger.Println(l.formatMessage(err.Error(), LEVEL_ERROR, true, nil))
+	}
 	l.errorLogger.Println("ERROR: ", err)
 }
 
+func (l *Log) closeFile() {
+	if l.fileWriter != nil {
+		l.fileWriter.Close()
+	}
+	l.fileLogger, l.fileWriter = nil, nil
+}
+
 func (l *Log) Close() {
-	l.fileLogger = nil
-	l.fileWriter.Close()
-	l.consoleLogger = nil
-	l.errorLogger = nil
+	l.closeFile()
+}
+
+// rotateWriter writes the log file, which is renamed to <path>.1 once it reaches maxSize, and the
+// older ones to <path>.2 and so on, of which maxBackups are kept.
+type rotateWriter struct {
+	mu         sync.Mutex
+	path       string
+	maxSize    int64
+	maxBackups int
+	f          *os.File
+	size       int64
+}
+
+func newRotateWriter(path string, maxSize int64, maxBackups int) (*rotateWriter, error) {
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return nil, fmt.Errorf("dataMigrate: create log dir, use --log-dir to specify a writable one or --no-log-file: %s", err)
+	}
+	w := &rotateWriter{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *rotateWriter) open() error {
+	f, err := os.OpenFile(w.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("dataMigrate: open log file, use --log-dir to specify a writable dir or --no-log-file: %s", err)
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return errors.WithStack(err)
+	}
+	w.f, w.size = f, fi.Size()
+	return nil
+}
+
+func (w *rotateWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.f == nil {
+		return 0, os.ErrClosed
+	}
+	if w.maxSize > 0 && w.size > 0 && w.size+int64(len(p)) > w.maxSize {
+		if err := w.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := w.f.Write(p)
+	w.size += int64(n)
+	return n, err
+}
+
+func (w *rotateWriter) rotate() error {
+	if err := w.f.Close(); err != nil {
+		return errors.WithStack(err)
+	}
+	w.f = nil
+	n := 1
+	for ; w.maxBackups == 0 || n < w.maxBackups; n++ {
+		if _, err := os.Stat(w.path + "." + strconv.Itoa(n)); err != nil {
+			break
+		}
+	}
+	// the oldest one is overwritten if maxBackups are kept already
+	for ; n > 1; n-- {
+		if err := os.Rename(w.path+"."+strconv.Itoa(n-1), w.path+"."+strconv.Itoa(n)); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	if err := os.Rename(w.path, w.path+".1"); err != nil {
+		return errors.WithStack(err)
+	}
+	return w.open()
+}
+
+func (w *rotateWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.f == nil {
+		return nil
+	}
+	err := w.f.Close()
+	w.f = nil
+	return errors.WithStack(err)
 }
@@ -0,0 +1,183 @@
+package src
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+)
+
+const mappingWildcard = "*"
+
+// mappingRule maps a source database/retention policy pair to a destination pair.
+// Source names are glob patterns (see path.Match), an empty source rp matches any rp.
+// A "*" or empty destination name keeps the corresponding source name.
+type mappingRule struct {
+	srcDB string
+	srcRP string
+	dstDB string
+	dstRP string
+}
+
+func (r mappingRule) String() string {
+	return joinDbRp(r.srcDB, r.srcRP) + " -> " + joinDbRp(r.dstDB, r.dstRP)
+}
+
+func (r mappingRule) match(db, rp string) bool {
+	if ok, _ := path.Match(r.srcDB, db); !ok {
+		return false
+	}
+	if r.srcRP == "" {
+		return true
+	}
+	ok, _ := path.Match(r.srcRP, rp)
+	return ok
+}
+
+// mappingTable resolves the destination of every source db/rp, the first matching rule wins.
+type mappingTable []mappingRule
+
+// resolve returns the destination database and retention policy for the given source pair.
+// Sources which are not matched by any rule are written to the same db/rp.
+func (t mappingTable) resolve(db, rp string) (string, string) {
+	for _, r := range t {
+		if !r.match(db, rp) {
+			continue
+		}
+		dstDB, dstRP := db, rp
+		if r.dstDB != "" && r.dstDB != mappingWildcard {
+			dstDB = r.dstDB
+		}
+		if r.dstRP != "" && r.dstRP != mappingWildcard {
+			dstRP = r.dstRP
+		}
+		return dstDB, dstRP
+	}
+	return db, rp
+}
+
+// parseMappingRule parses a rule like `src_db[.src_rp] -> dst_db[.dst_rp]`.
+// Names containing dots can be double-quoted, e.g. `"app.metrics".autogen -> app.default`.
+func parseMappingRule(s string) (mappingRule, error) {
+	parts := strings.Split(s, "->")
+	if len(parts) != 2 {
+		return mappingRule{}, fmt.Errorf("invalid mapping rule %q, expect src_db[.src_rp] -> dst_db[.dst_rp]", s)
+	}
+	srcDB, srcRP, err := splitDbRp(strings.TrimSpace(parts[0]))
+	if err != nil {
+		return mappingRule{}, fmt.Errorf("invalid mapping rule %q: %s", s, err)
+	}
+	dstDB, dstRP, err := splitDbRp(strings.TrimSpace(parts[1]))
+	if err != nil {
+		return mappingRule{}, fmt.Errorf("invalid mapping rule %q: %s", s, err)
+	}
+	if _, err := path.Match(srcDB, ""); err != nil {
+		return mappingRule{}, fmt.Errorf("invalid mapping rule %q: %s", s, err)
+	}
+	if _, err := path.Match(srcRP, ""); err != nil {
+		return mappingRule{}, fmt.Errorf("invalid mapping rule %q: %s", s, err)
+	}
+	if strings.ContainsAny(dstDB, "?[") || strings.ContainsAny(dstRP, "?[") ||
+		(strings.Contains(dstDB, mappingWildcard) && dstDB != mappingWildcard) ||
+		(strings.Contains(dstRP, mappingWildcard) && dstRP != mappingWildcard) {
+		return mappingRule{}, fmt.Errorf("invalid mapping rule %q: destination only supports the whole-name wildcard \"*\"", s)
+	}
+	return mappingRule{srcDB: srcDB, srcRP: srcRP, dstDB: dstDB, dstRP: dstRP}, nil
+}
+
+// parseMappingFile reads one mapping rule per line, blank lines and lines starting with '#' are ignored.
+func parseMappingFile(file string) ([]mappingRule, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var rules []mappingRule
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		rule, err := parseMappingRule(line)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, scanner.Err()
+}
+
+// splitDbRp splits `db[.rp]` into its parts, honoring double-quoted names.
+func splitDbRp(s string) (db, rp string, err error) {
+	var names []string
+	var buf strings.Builder
+	quoted := false
+	for _, r := range s {
+		switch {
+		case r == '"':
+			quoted = !quoted
+		case r == '.' && !quoted:
+			names = append(names, buf.String())
+			buf.Reset()
+		default:
+			buf.WriteRune(r)
+		}
+	}
+	if quoted {
+		return "", "", fmt.Errorf("unterminated quote in %q", s)
+	}
+	names = append(names, buf.String())
+	if len(names) > 2 {
+		return "", "", fmt.Errorf("too many name parts in %q", s)
+	}
+	db = names[0]
+	if db == "" {
+		return "", "", fmt.Errorf("empty database name in %q", s)
+	}
+	if len(names) == 2 {
+		rp = names[1]
+		if rp == "" {
+			return "", "", fmt.Errorf("empty retention policy name in %q", s)
+		}
+	}
+	return db, rp, nil
+}
+
+func joinDbRp(db, rp string) string {
+	if rp == "" {
+		return db
+	}
+	return db + "." + rp
+}
+
+// loadMapping builds the mapping table from the options. The rules given by --mapping
+// take precedence over the rules of --mapping-file, and --dest_database is the last rule.
+func (cmd *DataMigrateCommand) loadMapping() error {
+	var table mappingTable
+	for _, s := range cmd.opt.Mappings {
+		rule, err := parseMappingRule(s)
+		if err != nil {
+			return err
+		}
+		table = append(table, rule)
+	}
+	if cmd.opt.MappingFile != "" {
+		rules, err := parseMappingFile(cmd.opt.MappingFile)
+		if err != nil {
+			return fmt.Errorf("dataMigrate: load mapping file: %s", err)
+		}
+		table = append(table, rules...)
+	}
+	if cmd.opt.DestDatabase != "" && cmd.opt.DestDatabase != cmd.opt.Database {
+		srcDB := cmd.opt.Database
+		if srcDB == "" {
+			srcDB = mappingWildcard
+		}
+		table = append(table, mappingRule{srcDB: srcDB, dstDB: cmd.opt.DestDatabase})
+	}
+	cmd.mapping = table
+	return nil
+}
@@ -2,24 +2,21 @@ package src
 
 import (
 	"fmt"
-	"os"
-	"sort"
+	"strconv"
 	"sync"
 
 	"github.com/golang/groupcache/lru"
-	"github.com/influxdata/influxdb/tsdb/engine/tsm1"
-	client "github.com/influxdata/influxdb1-client/v2"
 )
 
 type Migrator interface {
-	migrateTsmFiles(files []string) error
-	writeCurrentFiles() error
-	releaseTSMReaders()
+	migrateShard(r ShardReader) error
 	getDatabase() string
 	getRetentionPolicy() string
 	getStat() *statInfo
 	getGStat() *globalStatInfo
 	getBatchSize() int
+	getDownsampleRules() []*downsampleRule
+	getTimeTransform() *timeTransform
 	release()
 }
 
@@ -34,13 +31,6 @@ var statPool = sync.Pool{
 	},
 }
 
-var filesPool = sync.Pool{
-	New: func() interface{} {
-		files := make([]tsm1.TSMFile, 0, 100)
-		return &files
-	},
-}
-
 var mstCachePool = sync.Pool{
 	New: func() interface{} {
 		return &lru.Cache{MaxEntries: 1000}
@@ -53,26 +43,74 @@ var tagsCachePool = sync.Pool{
 	},
 }
 
+// statInfo is the statistics of a shard. The rows read are either deduplicated, downsampled, or
+// written or rejected along with the rows aggregated by downsampling.
 type statInfo struct {
-	rowsRead   int
+	rowsRead int
+	// rows accepted by the destination
+	rowsWritten int
+	// rows merged into another one since they collide after truncating the timestamps
+	rowsDeduplicated int
+	// rows aggregated by the downsampling rules
+	rowsDownsampled int
+	// rows of the aggregations of the downsampling rules
+	rowsAggregated int
+	// rows dropped by the destination, e.g. for field type conflicts or the retention policy
+	rowsRejected int
+	seriesRead   int
+	// series not selected by the filter or dropped, of which no rows are read
+	seriesSkipped int
+	// the size of the line protocol written
+	bytesWritten int64
+	// the tag keys and the field keys of every measurement, see measurementKey
 	tagsRead   map[string]struct{}
 	fieldsRead map[string]struct{}
 }
 
+func (s *statInfo) reset() {
+	*s = statInfo{
+		tagsRead:   make(map[string]struct{}),
+		fieldsRead: make(map[string]struct{}),
+	}
+}
+
+// measurementKey returns the key of a tag key or a field key of the measurement in the statistics,
+// the keys of different measurements are counted separately.
+func measurementKey(measurement, key string) string {
+	return measurement + "\x00" + key
+}
+
+// summary describes the statistics with the numbers of tag keys and field keys, e.g.
+// "2 tag keys, 3 field keys, 1 series, 10 rows read, 10 rows written, 560 bytes written".
+func (s *statInfo) summary(tagKeys, fieldKeys int) string {
+	downsampled := "rows downsampled into " + strconv.Itoa(s.rowsAggregated) + " rows"
+	msg := strconv.Itoa(tagKeys) + " tag keys, " + strconv.Itoa(fieldKeys) + " field keys, " + strconv.Itoa(s.seriesRead) + " series, " +
+		strconv.Itoa(s.rowsRead) + " rows read, " + strconv.Itoa(s.rowsWritten) + " rows written"
+	for _, c := range []struct {
+		n    int
+		what string
+	}{
+		{s.rowsDeduplicated, "rows deduplicated"},
+		{s.rowsDownsampled, downsampled},
+		{s.rowsRejected, "rows rejected"},
+		{s.seriesSkipped, "series skipped"},
+	} {
+		if c.n > 0 {
+			msg += ", " + strconv.Itoa(c.n) + " " + c.what
+		}
+	}
+	return msg + ", " + strconv.FormatInt(s.bytesWritten, 10) + " bytes written"
+}
+
 type migrator struct {
-	out             string
+	sink            Sink
 	database        string
 	retentionPolicy string
-	startTime       int64
-	endTime         int64
 	batchSize       int
-	userName        string
-	password        string
-	useSsl          bool
 
-	files *[]tsm1.TSMFile
-	// series to fields
-	serieskeys map[string]map[string]struct{}
+	downsampleRules []*downsampleRule
+	timeTransform   *timeTransform
+
 	// statistics
 	stat  *statInfo
 	gstat *globalStatInfo
@@ -85,9 +123,16 @@ func (m *migrator) getBatchSize() int {
 	return m.batchSize
 }
 
+func (m *migrator) getDownsampleRules() []*downsampleRule {
+	return m.downsampleRules
+}
+
+func (m *migrator) getTimeTransform() *timeTransform {
+	return m.timeTransform
+}
+
 func (m *migrator) release() {
 	statPool.Put(m.stat)
-	filesPool.Put(m.files)
 	mstCachePool.Put(m.mstCache)
 	tagsCachePool.Put(m.tagsCache)
 }
@@ -109,217 +154,71 @@ func (m *migrator) getStat() *statInfo {
 }
 
 func NewMigrator(cmd *DataMigrateCommand, info *shardGroupInfo) *migrator {
-	var db string
-	if cmd.opt.DestDatabase == "" {
-		db = info.db
-	} else {
-		db = cmd.opt.DestDatabase
-	}
+	db, rp := cmd.mapping.resolve(info.db, info.rp)
 	mig := &migrator{
-		out:             cmd.opt.Out,
+		sink:            cmd.Sink,
 		database:        db,
-		retentionPolicy: info.rp,
-		startTime:       cmd.opt.StartTime,
-		endTime:         cmd.opt.EndTime,
-		files:           filesPool.Get().(*[]tsm1.TSMFile),
-		serieskeys:      make(map[string]map[string]struct{}, 100),
+		retentionPolicy: rp,
 		stat:            statPool.Get().(*statInfo),
 		gstat:           cmd.gstat,
 		batchSize:       cmd.opt.BatchSize,
 		mstCache:        mstCachePool.Get().(*lru.Cache),
 		tagsCache:       tagsCachePool.Get().(*lru.Cache),
-		userName:        cmd.opt.Username,
-		password:        cmd.opt.Password,
-		useSsl:          cmd.opt.Ssl,
+		downsampleRules: cmd.downsampleRules,
+		timeTransform:   cmd.timeTransform,
 	}
-	mig.stat.rowsRead = 0
-	mig.stat.tagsRead = make(map[string]struct{})
-	mig.stat.fieldsRead = make(map[string]struct{})
-
-	*mig.files = (*mig.files)[:0]
+	mig.stat.reset()
 	return mig
 }
 
-func (m *migrator) migrateTsmFiles(files []string) error {
-	// we need to make sure we write the same order that the files were written
-	sort.Strings(files)
-
-	for _, f := range files {
-		// read all the TSMFiles using TSMReader
-		logger.LogString(fmt.Sprintf("Dealing file: %s", f), TOCONSOLE|TOLOGFILE, LEVEL_INFO)
-		if err := m.readTSMFile(f); err != nil {
-			m.releaseTSMReaders()
+// migrateShard writes all the series read from the shard to the sink.
+func (m *migrator) migrateShard(r ShardReader) error {
+	if m.sink == nil {
+		return fmt.Errorf("dataMigrate: no sink to write to, the Sink of the command is not set")
+	}
+	for {
+		s, err := r.Next()
+		if err != nil {
 			return err
 		}
-	}
-	if err := m.writeCurrentFiles(); err != nil {
-		return err
-	}
-	return nil
-}
-
-func (m *migrator) readTSMFile(tsmFilePath string) error {
-	f, err := os.Open(tsmFilePath)
-	if err != nil {
-		if os.IsNotExist(err) {
-			logger.LogString("readTSMFile: missing file skipped: "+tsmFilePath, TOLOGFILE, LEVEL_WARNING)
+		if s == nil {
+			if c, ok := r.(skipCounter); ok {
+				m.stat.seriesSkipped = c.seriesSkipped()
+			}
 			return nil
 		}
-		return err
-	}
-	defer f.Close()
-
-	r, err := tsm1.NewTSMReader(f)
-	if err != nil {
-		logger.LogString(fmt.Sprintf("unable to read %s, skipping: %s", tsmFilePath, err.Error()), TOLOGFILE|TOCONSOLE, LEVEL_ERROR)
-		return nil
-	}
-
-	// If the time range of this file does not meet the conditions, abort reading.
-	if sgStart, sgEnd := r.TimeRange(); sgStart > m.endTime || sgEnd < m.startTime {
-		r.Close()
-		return nil
-	}
-
-	*m.files = append(*m.files, r)
-
-	// collect the keys
-	for i := 0; i < r.KeyCount(); i++ {
-		key, _ := r.KeyAt(i)
-		series, field := tsm1.SeriesAndFieldFromCompositeKey(key)
-		seriesStr := string(series)
-		if _, ok := m.serieskeys[seriesStr]; !ok {
-			m.serieskeys[seriesStr] = make(map[string]struct{})
-		}
-		m.serieskeys[seriesStr][string(field)] = struct{}{}
-	}
-	return nil
-}
-
-func (m *migrator) releaseTSMReaders() {
-	for _, r := range *m.files {
-		r.Close()
-	}
-}
-
-func (m *migrator) getToAddr() string {
-	addr := fmt.Sprintf("http://%s", m.out)
-	if m.useSsl {
-		addr = fmt.Sprintf("https://%s", m.out)
-	}
-	return addr
-}
-
-func (m *migrator) writeCurrentFiles() error {
-	defer m.releaseTSMReaders()
-
-	c, err := client.NewHTTPClient(client.HTTPConfig{
-		InsecureSkipVerify: true,
-		Addr:               m.getToAddr(),
-		Username:           m.userName,
-		Password:           m.password,
-	})
-	if err != nil {
-		logger.LogString("Error creating openGemini Client: "+err.Error(), TOLOGFILE|TOCONSOLE, LEVEL_ERROR)
-		return err
-	}
-	defer c.Close()
-
-	for series, field := range m.serieskeys {
+		m.stat.seriesRead++
 		var measurement interface{}
 		var tags interface{}
 		var ok bool
-		if measurement, ok = m.mstCache.Get(series); !ok {
-			measurement, tags, err = splitMeasurementAndTag(series)
+		if measurement, ok = m.mstCache.Get(s.Key); !ok {
+			measurement, tags, err = splitMeasurementAndTag(s.Key)
 			if err != nil {
-				logger.LogString(fmt.Sprintf("split measurement name and tag from %s, err: %s", series, err), TOLOGFILE, LEVEL_ERROR)
+				logger.LogString(fmt.Sprintf("split measurement name and tag from %s, err: %s", s.Key, err), TOLOGFILE, LEVEL_ERROR, SeriesField(s.Key))
 				continue
 			}
-			m.mstCache.Add(series, measurement)
-			m.tagsCache.Add(series, tags)
+			m.mstCache.Add(s.Key, measurement)
+			m.tagsCache.Add(s.Key, tags)
 		}
-		tags, _ = m.tagsCache.Get(series)
+		tags, _ = m.tagsCache.Get(s.Key)
 
 		// construct Scanner
 		scanner := &Scanner{
+			series:      s.Key,
 			measurement: measurement.(string),
 			tags:        tags.(map[string]string),
-			fields:      make(map[string]*Cursor, len(field)),
+			fields:      s.Fields,
 			heapCursor: &heapCursor{
-				items: make([]*Cursor, 0, len(field)),
+				items: make([]FieldCursor, 0, len(s.Fields)),
 			},
 		}
-		// construct field cursors
-		for f := range field {
-			key := tsm1.SeriesFieldKeyBytes(series, f)
-			newCursor := &Cursor{
-				et:     m.endTime,
-				readTs: m.startTime,
-				key:    key,
-				seeks:  m.locations(key, m.startTime, m.endTime),
-			}
-			if err = newCursor.init(); err != nil {
-				return err
-			}
-			scanner.fields[f] = newCursor
-			scanner.heapCursor.items = append(scanner.heapCursor.items, newCursor)
+		for _, c := range s.Fields {
+			scanner.heapCursor.items = append(scanner.heapCursor.items, c)
 		}
-		if err := scanner.writeBatches(c, m); err != nil {
+		if err := scanner.writeBatches(m.sink, m); err != nil {
 			return err
 		}
 	}
-	return nil
-}
-
-// Referenced from the implementation of InfluxDB
-func (m *migrator) locations(key []byte, st int64, et int64) []*location {
-	var cache []tsm1.IndexEntry
-	var locations []*location
-	for _, fd := range *m.files {
-		tombstones := fd.TombstoneRange(key)
-
-		// This file could potential contain points we are looking for so find the blocks for
-		// the given key.
-		entries := fd.ReadEntries(key, &cache)
-	LOOP:
-		for i := 0; i < len(entries); i++ {
-			ie := entries[i]
-
-			// Skip any blocks only contain values that are tombstoned.
-			for _, t := range tombstones {
-				if t.Min <= ie.MinTime && t.Max >= ie.MaxTime {
-					continue LOOP
-				}
-			}
-
-			// If the max time of a block is before where we are looking, skip
-			// it since the data is out of our range
-			if ie.MaxTime < st {
-				continue
-			}
-
-			if ie.MinTime > et {
-				continue
-			}
-
-			location := &location{
-				r:     fd,
-				entry: ie,
-			}
-
-			if st-1 < st {
-				// mark everything before the seek time as read
-				// so we can filter it out at query time
-				location.readMax = st - 1
-			} else {
-				location.readMax = st
-			}
-
-			// Otherwise, add this file and block location
-			locations = append(locations, location)
-		}
-	}
-	return locations
 }
 
 // This function is used to split the underlying read SeriesKey with escape characters and convert it into a string that can be processed normally
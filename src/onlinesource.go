@@ -0,0 +1,510 @@
+package src
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/influxdata/influxdb/tsdb/engine/tsm1"
+	"github.com/influxdata/influxdb1-client/models"
+	client "github.com/influxdata/influxdb1-client/v2"
+	"github.com/influxdata/influxql"
+	"github.com/pkg/errors"
+)
+
+type OnlineSourceConfig struct {
+	// host:port of the running InfluxDB 1.x
+	Host     string
+	Ssl      bool
+	Username string
+	Password string
+	// only the shards of the database and retention policy are read if set
+	Database        string
+	RetentionPolicy string
+	// the time range of every query, the points of a measurement in a window are held in memory
+	Window time.Duration
+	// the points per chunk of the responses
+	ChunkSize int
+	// the file to record the windows migrated, so a migration restarted skips them
+	Checkpoint string
+	// only the series selected are read if set
+	Filter *SeriesFilter
+}
+
+// OnlineSource reads a running InfluxDB through its HTTP API. The shards are the ones of
+// SHOW SHARDS, and every measurement of a shard is read by chunked queries of
+// `SELECT * ... GROUP BY *`, one time window at a time.
+type OnlineSource struct {
+	cfg    OnlineSourceConfig
+	client client.Client
+	shards []ShardInfo
+	// shard key to the time range of the shard group
+	ranges     map[string][2]int64
+	checkpoint *checkpoint
+
+	mu sync.Mutex
+	// database to measurement to field to type
+	fieldTypes map[string]map[string]map[string]string
+}
+
+func NewOnlineSource(cfg OnlineSourceConfig) (*OnlineSource, error) {
+	if cfg.Host == "" {
+		return nil, fmt.Errorf("dataMigrate: must specify the host of InfluxDB to read")
+	}
+	if cfg.Window <= 0 {
+		return nil, fmt.Errorf("dataMigrate: invalid window %s, expect a positive duration", cfg.Window)
+	}
+	scheme := "http://"
+	if cfg.Ssl {
+		scheme = "https://"
+	}
+	c, err := client.NewHTTPClient(client.HTTPConfig{
+		Addr:               scheme + cfg.Host,
+		Username:           cfg.Username,
+		Password:           cfg.Password,
+		InsecureSkipVerify: true,
+	})
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	s := &OnlineSource{
+		cfg:        cfg,
+		client:     c,
+		ranges:     make(map[string][2]int64),
+		fieldTypes: make(map[string]map[string]map[string]string),
+	}
+	if s.checkpoint, err = loadCheckpoint(cfg.Checkpoint); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *OnlineSource) query(command, database string) (*client.Response, error) {
+	resp, err := s.client.Query(client.NewQuery(command, database, "ns"))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if resp.Error() != nil {
+		return nil, fmt.Errorf("dataMigrate: %s: %s", command, resp.Error())
+	}
+	return resp, nil
+}
+
+// Shards returns the shards of SHOW SHARDS, which requires the admin privilege.
+func (s *OnlineSource) Shards() ([]ShardInfo, error) {
+	if s.shards != nil {
+		return s.shards, nil
+	}
+	resp, err := s.query("SHOW SHARDS", "")
+	if err != nil {
+		return nil, err
+	}
+	// every series is a database with the columns:
+	// id, database, retention_policy, shard_group, start_time, end_time, expiry_time, owners
+	shards := make([]ShardInfo, 0)
+	for _, result := range resp.Results {
+		for _, series := range result.Series {
+			for _, row := range series.Values {
+				if len(row) < 6 {
+					continue
+				}
+				shard := ShardInfo{Database: fmt.Sprint(row[1]), RetentionPolicy: fmt.Sprint(row[2]), ID: fmt.Sprint(row[0])}
+				if (s.cfg.Database != "" && shard.Database != s.cfg.Database) ||
+					(s.cfg.RetentionPolicy != "" && shard.RetentionPolicy != s.cfg.RetentionPolicy) {
+					continue
+				}
+				start, err := time.Parse(time.RFC3339, fmt.Sprint(row[4]))
+				if err != nil {
+					return nil, fmt.Errorf("dataMigrate: invalid start time of shard %s: %s", shard.key(), err)
+				}
+				end, err := time.Parse(time.RFC3339, fmt.Sprint(row[5]))
+				if err != nil {
+					return nil, fmt.Errorf("dataMigrate: invalid end time of shard %s: %s", shard.key(), err)
+				}
+				s.ranges[shard.key()] = [2]int64{start.UnixNano(), end.UnixNano() - 1}
+				shards = append(shards, shard)
+			}
+		}
+	}
+	sortShards(shards)
+	s.shards = shards
+	return s.shards, nil
+}
+
+// TimeRange returns the time range of the shard group of the shard.
+func (s *OnlineSource) TimeRange(shard ShardInfo) (min, max int64, err error) {
+	r, ok := s.ranges[shard.key()]
+	if !ok {
+		return 0, 0, fmt.Errorf("dataMigrate: unknown shard %s", shard.key())
+	}
+	return r[0], r[1], nil
+}
+
+func (s *OnlineSource) Open(shard ShardInfo, start, end int64) (ShardReader, error) {
+	min, max, err := s.TimeRange(shard)
+	if err != nil {
+		return nil, err
+	}
+	if start < min {
+		start = min
+	}
+	if end > max {
+		end = max
+	}
+	types, err := s.fieldTypesOf(shard.Database)
+	if err != nil {
+		return nil, err
+	}
+	measurements := make([]string, 0, len(types))
+	for mst := range types {
+		if s.cfg.Filter.MatchMeasurement(mst) {
+			measurements = append(measurements, mst)
+		}
+	}
+	sort.Strings(measurements)
+	return &onlineShardReader{
+		source:       s,
+		shard:        shard,
+		start:        start,
+		end:          end,
+		measurements: measurements,
+		fieldTypes:   types,
+		condition:    tagCondition(s.cfg.Filter),
+		mstIdx:       -1,
+		done:         make(map[string]int64),
+	}, nil
+}
+
+// tagCondition returns the condition of the tags of the filter in the WHERE clause, e.g.
+// ` AND ("host" = 'a' OR "host" = 'b')`, or an empty string if there is none.
+func tagCondition(filter *SeriesFilter) string {
+	if filter == nil {
+		return ""
+	}
+	keys := make([]string, 0, len(filter.Tags))
+	for key := range filter.Tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	for _, key := range keys {
+		values := make([]string, 0, len(filter.Tags[key]))
+		for value := range filter.Tags[key] {
+			values = append(values, fmt.Sprintf("%s = %s", influxql.QuoteIdent(key), influxql.QuoteString(value)))
+		}
+		sort.Strings(values)
+		b.WriteString(" AND (" + strings.Join(values, " OR ") + ")")
+	}
+	return b.String()
+}
+
+func (s *OnlineSource) Close() error {
+	return s.client.Close()
+}
+
+// fieldTypesOf returns the types of the fields of every measurement in the database, which are
+// queried only once.
+func (s *OnlineSource) fieldTypesOf(database string) (map[string]map[string]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if types, ok := s.fieldTypes[database]; ok {
+		return types, nil
+	}
+	resp, err := s.query("SHOW FIELD KEYS", database)
+	if err != nil {
+		return nil, err
+	}
+	types := make(map[string]map[string]string)
+	// every series is a measurement with the columns: fieldKey, fieldType
+	for _, result := range resp.Results {
+		for _, series := range result.Series {
+			fields := make(map[string]string, len(series.Values))
+			for _, row := range series.Values {
+				if len(row) >= 2 {
+					fields[fmt.Sprint(row[0])] = fmt.Sprint(row[1])
+				}
+			}
+			types[series.Name] = fields
+		}
+	}
+	s.fieldTypes[database] = types
+	return types, nil
+}
+
+// onlineShardReader reads the measurements of a shard one time window at a time.
+type onlineShardReader struct {
+	source       *OnlineSource
+	shard        ShardInfo
+	start, end   int64
+	measurements []string
+	fieldTypes   map[string]map[string]string
+	// the condition of the tags to read
+	condition string
+
+	// the measurement and the window [windowStart, windowEnd) being read
+	mstIdx      int
+	windowStart int64
+	windowEnd   int64
+	resp        *client.ChunkedResponse
+	rows        []models.Row
+	pos         int
+	// measurement to the end of the windows read, recorded in the checkpoint by commit
+	done map[string]int64
+}
+
+// Next returns the series of the current window, and moves to the next window once it is
+// exhausted.
+func (r *onlineShardReader) Next() (*Series, error) {
+	for {
+		if r.resp != nil {
+			s, err := r.nextSeries()
+			if err != nil || s != nil {
+				return s, err
+			}
+			r.resp.Close()
+			r.resp = nil
+			r.done[r.measurements[r.mstIdx]] = r.windowEnd
+		}
+		more, err := r.nextWindow()
+		if err != nil || !more {
+			return nil, err
+		}
+	}
+}
+
+// nextWindow queries the next window, of the current measurement or the next one.
+func (r *onlineShardReader) nextWindow() (bool, error) {
+	if r.mstIdx >= 0 && r.windowEnd <= r.end {
+		r.windowStart = r.windowEnd
+	} else {
+		// the next measurement, skipping the windows in the checkpoint
+		for {
+			r.mstIdx++
+			if r.mstIdx >= len(r.measurements) {
+				return false, nil
+			}
+			r.windowStart = r.start
+			if ts, ok := r.source.checkpoint.get(r.shard, r.measurements[r.mstIdx]); ok && ts > r.windowStart {
+				r.windowStart = ts
+			}
+			if r.windowStart <= r.end {
+				break
+			}
+		}
+		logger.LogString("Reading measurement "+r.measurements[r.mstIdx]+" of shard "+r.shard.key(), TOLOGFILE, LEVEL_INFO,
+			ShardField(r.shard.key()))
+	}
+	r.windowEnd = r.windowStart + int64(r.source.cfg.Window)
+	if r.windowEnd > r.end || r.windowEnd < r.windowStart {
+		r.windowEnd = r.end + 1
+	}
+
+	command := fmt.Sprintf("SELECT * FROM %s WHERE time >= %d AND time < %d%s GROUP BY *",
+		influxql.QuoteIdent(r.shard.RetentionPolicy, r.measurements[r.mstIdx]), r.windowStart, r.windowEnd, r.condition)
+	q := client.NewQuery(command, r.shard.Database, "ns")
+	q.Chunked = true
+	q.ChunkSize = r.source.cfg.ChunkSize
+	resp, err := r.source.client.QueryAsChunk(q)
+	if err != nil {
+		return false, errors.WithStack(err)
+	}
+	r.resp = resp
+	r.rows = r.rows[:0]
+	r.pos = 0
+	return true, nil
+}
+
+// nextSeries assembles the rows of the next series, which may be split into several chunks.
+// nil is returned once the window is exhausted.
+func (r *onlineShardReader) nextSeries() (*Series, error) {
+	var rows []models.Row
+	for {
+		if r.pos >= len(r.rows) {
+			resp, err := r.resp.NextResponse()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, errors.WithStack(err)
+			}
+			if resp.Error() != nil {
+				return nil, fmt.Errorf("dataMigrate: query %s of shard %s: %s", r.measurements[r.mstIdx], r.shard.key(), resp.Error())
+			}
+			r.rows, r.pos = r.rows[:0], 0
+			for _, result := range resp.Results {
+				r.rows = append(r.rows, result.Series...)
+			}
+			continue
+		}
+		row := r.rows[r.pos]
+		if len(rows) > 0 && !rows[0].SameSeries(&row) {
+			break
+		}
+		r.pos++
+		rows = append(rows, row)
+		if !row.Partial {
+			break
+		}
+	}
+	if len(rows) == 0 {
+		return nil, nil
+	}
+	return r.toSeries(rows)
+}
+
+// toSeries converts the values of the rows into field cursors by the types of the fields.
+func (r *onlineShardReader) toSeries(rows []models.Row) (*Series, error) {
+	name := rows[0].Name
+	types := r.fieldTypes[name]
+	values := make(map[string][]tsm1.Value)
+	for _, row := range rows {
+		for _, v := range row.Values {
+			if len(v) != len(row.Columns) {
+				continue
+			}
+			ts, err := v[0].(json.Number).Int64()
+			if err != nil {
+				return nil, fmt.Errorf("dataMigrate: invalid time %v of %s", v[0], name)
+			}
+			for i := 1; i < len(v); i++ {
+				if v[i] == nil {
+					continue
+				}
+				field := row.Columns[i]
+				value, err := fieldValueOf(v[i], types[field])
+				if err != nil {
+					return nil, fmt.Errorf("dataMigrate: invalid value of %s.%s: %s", name, field, err)
+				}
+				values[field] = append(values[field], tsm1.NewValue(ts, value))
+			}
+		}
+	}
+	s := &Series{
+		Key:    string(models.MakeKey([]byte(name), models.NewTags(rows[0].Tags))),
+		Fields: make(map[string]FieldCursor, len(values)),
+	}
+	for field, vs := range values {
+		s.Fields[field] = &valuesCursor{values: vs}
+	}
+	return s, nil
+}
+
+// fieldValueOf converts a value decoded from JSON to the type of the field.
+func fieldValueOf(v interface{}, typ string) (interface{}, error) {
+	switch x := v.(type) {
+	case json.Number:
+		switch typ {
+		case "integer":
+			return x.Int64()
+		case "unsigned":
+			return strconv.ParseUint(x.String(), 10, 64)
+		}
+		return x.Float64()
+	case bool, string:
+		return x, nil
+	}
+	return nil, fmt.Errorf("unexpected value %v", v)
+}
+
+// commit records the windows read in the checkpoint, once they are written to the sink and flushed.
+func (r *onlineShardReader) commit() error {
+	return r.source.checkpoint.set(r.shard, r.done)
+}
+
+func (r *onlineShardReader) Close() error {
+	if r.resp != nil {
+		r.resp.Close()
+		r.resp = nil
+	}
+	return nil
+}
+
+// valuesCursor iterates the values in memory.
+type valuesCursor struct {
+	values []tsm1.Value
+}
+
+func (c *valuesCursor) Peek() (tsm1.Value, error) {
+	if len(c.values) == 0 {
+		return nil, nil
+	}
+	return c.values[0], nil
+}
+
+func (c *valuesCursor) Next() (tsm1.Value, error) {
+	if len(c.values) == 0 {
+		return nil, nil
+	}
+	v := c.values[0]
+	c.values = c.values[1:]
+	return v, nil
+}
+
+// checkpoint records the time till which every measurement of every shard is migrated.
+// It is saved to the file after every shard, nothing is recorded if the path is empty.
+type checkpoint struct {
+	path string
+	mu   sync.Mutex
+	// shard key to measurement to the end of the windows migrated (exclusive)
+	done map[string]map[string]int64
+}
+
+func loadCheckpoint(path string) (*checkpoint, error) {
+	c := &checkpoint{path: path, done: make(map[string]map[string]int64)}
+	if path == "" {
+		return c, nil
+	}
+	buf, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if err := json.Unmarshal(buf, &c.done); err != nil {
+		return nil, fmt.Errorf("dataMigrate: invalid checkpoint %s: %s", path, err)
+	}
+	logger.LogString("Resuming from checkpoint "+path, TOCONSOLE|TOLOGFILE, LEVEL_INFO)
+	return c, nil
+}
+
+func (c *checkpoint) get(shard ShardInfo, measurement string) (int64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ts, ok := c.done[shard.key()][measurement]
+	return ts, ok
+}
+
+// set records the end of the windows migrated of the measurements of the shard.
+func (c *checkpoint) set(shard ShardInfo, done map[string]int64) error {
+	if c.path == "" || len(done) == 0 {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	m, ok := c.done[shard.key()]
+	if !ok {
+		m = make(map[string]int64)
+		c.done[shard.key()] = m
+	}
+	for mst, ts := range done {
+		m[mst] = ts
+	}
+	buf, err := json.Marshal(c.done)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	// write to a temp file first, so the checkpoint is never left half written
+	tmp := c.path + ".tmp"
+	if err := os.WriteFile(tmp, buf, 0644); err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(os.Rename(tmp, c.path))
+}
@@ -1,20 +1,65 @@
 package src
 
 type DataMigrateOptions struct {
-	DataDir         string
+	DataDir         string // the data dir of InfluxDB, the engine dir of InfluxDB 2.x or the dir of a portable backup
+	BoltPath        string // influxd.bolt of InfluxDB 2.x with the names of the buckets
+	TmpDir          string // the dir to extract the shards of a backup to
 	Out             string
 	Username        string
 	Password        string
 	Database        string
 	DestDatabase    string
 	RetentionPolicy string
+	Measurements    []string // the measurements to migrate, all if empty
+	Tags            []string // key=value, only the series with the tags are migrated
+	IgnoreIndex     bool     // read the series dropped, which are skipped by the TSI index by default
+	Mappings        []string // src_db[.src_rp] -> dst_db[.dst_rp]
+	MappingFile     string
 	Start           string // rfc3339 format
 	End             string // rfc3339 format
 	StartTime       int64  // timestamp
 	EndTime         int64  // timestamp
 	BatchSize       int
+	Balance         string   // round-robin or least-inflight
+	Compress        string   // none or gzip
+	Fanouts         []string // more destinations to write the same data to
+	DeadLetterDir   string   // the dir of the batches failed to write to the destinations with the dead-letter policy
+	MaxRetries      int      // the retries of a failed batch, 0 means retrying until it succeeds
+	CompressLevel   int      // the level of compress/gzip
+	Stream          bool     // iterate the series of a shard one at a time
+	SeriesMemLimit  int      // MB, the ceiling of the memory to collect the series of a shard, streaming is used once exceeded
+	Downsamples     []string // age:interval:aggs[:rp]
+	TimeShift       string   // duration added to all timestamps
+	Precision       string   // ns, us, ms or s
+	DedupPolicy     string   // first or last
 	Ssl             bool
 	UnsafeSsl       bool
 
+	// the source InfluxDB to read meta data from
+	MetaDir     string
+	SrcHost     string
+	SrcUsername string
+	SrcPassword string
+	SrcSsl      bool
+
+	// read the data from SrcHost through its HTTP API instead of DataDir
+	Online     bool
+	Window     string // the time range of every query
+	ChunkSize  int    // the points per chunk of the query responses
+	Checkpoint string // the file to record the windows migrated
+
+	CheckSchema bool
+
+	OnError string // fail, skip-shard or skip-file, on the shards and the TSM files which cannot be migrated
+	Report  string // the file to write the report of the migration to
+	Verify  string // fail or skip-block, on the corrupt blocks of the TSM files, which are not verified if empty
+
+	Incremental string // the file to record the TSM files migrated of every shard, a later run with it migrates only the new data
+
+	MigrateCQ        bool
+	MigrateUsers     bool
+	UserPasswordFile string // user:password per line
+	UsersOutput      string
+
 	Debug bool
 }
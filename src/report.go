@@ -0,0 +1,170 @@
+package src
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// the policies of --on-error on the shards and the TSM files which cannot be migrated
+const (
+	OnErrorSkipShard = "skip-shard"
+	OnErrorSkipFile  = "skip-file"
+)
+
+func checkOnError(policy string) error {
+	switch policy {
+	case "", OnErrorFail, OnErrorSkipShard, OnErrorSkipFile:
+		return nil
+	}
+	return fmt.Errorf("dataMigrate: invalid on-error %q, expect fail, skip-shard or skip-file", policy)
+}
+
+// SkippedUnit is a shard, or a TSM file of it, which is skipped by --on-error.
+type SkippedUnit struct {
+	Shard string `json:"shard"`
+	File  string `json:"file,omitempty"`
+	Error string `json:"error"`
+}
+
+// skippedUnits collects the units skipped by the workers.
+type skippedUnits struct {
+	mu    sync.Mutex
+	units []SkippedUnit
+}
+
+func (s *skippedUnits) add(u SkippedUnit) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.units = append(s.units, u)
+}
+
+// count returns the numbers of the shards and the files skipped.
+func (s *skippedUnits) count() (shards, files int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, u := range s.units {
+		if u.File == "" {
+			shards++
+		} else {
+			files++
+		}
+	}
+	return shards, files
+}
+
+func (s *skippedUnits) list() []SkippedUnit {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]SkippedUnit(nil), s.units...)
+}
+
+// summary describes the units skipped, e.g. ", 2 shards skipped, 1 files skipped".
+func (s *skippedUnits) summary() string {
+	shards, files := s.count()
+	msg := ""
+	if shards > 0 {
+		msg += ", " + strconv.Itoa(shards) + " shards skipped"
+	}
+	if files > 0 {
+		msg += ", " + strconv.Itoa(files) + " files skipped"
+	}
+	return msg
+}
+
+// skipShard records the shard failed to migrate and returns true if --on-error skips it,
+// otherwise the error fails the migration. The errors of the sink are never skipped.
+func (cmd *DataMigrateCommand) skipShard(shard ShardInfo, err error) bool {
+	if (cmd.opt.OnError != OnErrorSkipShard && cmd.opt.OnError != OnErrorSkipFile) || isSinkError(err) {
+		return false
+	}
+	logger.LogString(fmt.Sprintf("Shard %s is skipped: %s", shard.key(), err), TOCONSOLE|TOLOGFILE, LEVEL_WARNING, ShardField(shard.key()))
+	cmd.skipped.add(SkippedUnit{Shard: shard.key(), Error: err.Error()})
+	return true
+}
+
+// recordSkippedFiles records the files the shard reader skips with --on-error skip-file.
+func (cmd *DataMigrateCommand) recordSkippedFiles(shard ShardInfo, r ShardReader) {
+	fs, ok := r.(fileSkipper)
+	if !ok {
+		return
+	}
+	for _, f := range fs.skippedFiles() {
+		cmd.skipped.add(SkippedUnit{Shard: shard.key(), File: f.path, Error: f.err.Error()})
+	}
+}
+
+// RunReport is the result of a migration written to --report.
+type RunReport struct {
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end"`
+	Duration string    `json:"duration"`
+	// completed or failed
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+
+	Shards           int   `json:"shards"`
+	SeriesRead       int   `json:"seriesRead"`
+	SeriesSkipped    int   `json:"seriesSkipped"`
+	RowsRead         int   `json:"rowsRead"`
+	RowsWritten      int   `json:"rowsWritten"`
+	RowsDeduplicated int   `json:"rowsDeduplicated"`
+	RowsDownsampled  int   `json:"rowsDownsampled"`
+	RowsAggregated   int   `json:"rowsAggregated"`
+	RowsRejected     int   `json:"rowsRejected"`
+	BytesWritten     int64 `json:"bytesWritten"`
+
+	Skipped []SkippedUnit `json:"skipped"`
+	// the corrupt blocks found by --verify
+	CorruptBlocks []CorruptBlock `json:"corruptBlocks,omitempty"`
+}
+
+// writeReport writes the report of the migration started at st, which ends with err.
+func (cmd *DataMigrateCommand) writeReport(st time.Time, err error) error {
+	total := cmd.gstat.total()
+	end := time.Now()
+	report := RunReport{
+		Start:            st,
+		End:              end,
+		Duration:         end.Sub(st).String(),
+		Status:           "completed",
+		Shards:           len(cmd.shards),
+		SeriesRead:       total.seriesRead,
+		SeriesSkipped:    total.seriesSkipped,
+		RowsRead:         total.rowsRead,
+		RowsWritten:      total.rowsWritten,
+		RowsDeduplicated: total.rowsDeduplicated,
+		RowsDownsampled:  total.rowsDownsampled,
+		RowsAggregated:   total.rowsAggregated,
+		RowsRejected:     total.rowsRejected,
+		BytesWritten:     total.bytesWritten,
+		Skipped:          cmd.skipped.list(),
+		CorruptBlocks:    cmd.corrupt,
+	}
+	if err != nil {
+		report.Status, report.Error = "failed", err.Error()
+	}
+	if report.Skipped == nil {
+		report.Skipped = []SkippedUnit{}
+	}
+	buf, jerr := json.MarshalIndent(report, "", "  ")
+	if jerr != nil {
+		return errors.WithStack(jerr)
+	}
+	if dir := filepath.Dir(cmd.opt.Report); dir != "" {
+		if merr := os.MkdirAll(dir, 0755); merr != nil {
+			return errors.WithStack(merr)
+		}
+	}
+	if werr := os.WriteFile(cmd.opt.Report, append(buf, '\n'), 0644); werr != nil {
+		return fmt.Errorf("dataMigrate: write report %s: %s", cmd.opt.Report, werr)
+	}
+	logger.LogString("Report is written to "+cmd.opt.Report, TOCONSOLE|TOLOGFILE, LEVEL_INFO)
+	return nil
+}
@@ -0,0 +1,264 @@
+package src
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/influxdata/influxdb/models"
+	"github.com/influxdata/influxdb/tsdb/engine/tsm1"
+	"github.com/pkg/errors"
+)
+
+var blockTypeNames = map[byte]string{
+	tsm1.BlockFloat64:  "float",
+	tsm1.BlockInteger:  "integer",
+	tsm1.BlockBoolean:  "boolean",
+	tsm1.BlockString:   "string",
+	tsm1.BlockUnsigned: "unsigned",
+}
+
+func blockTypeName(typ byte) string {
+	if name, ok := blockTypeNames[typ]; ok {
+		return name
+	}
+	return fmt.Sprintf("unknown(%d)", typ)
+}
+
+// fieldSchema records the types of a field, and the shards each type is found in.
+type fieldSchema map[string][]string
+
+// measurementSchema maps the destination database and measurement to its fields.
+type measurementSchema map[string]map[string]map[string]fieldSchema
+
+func (s measurementSchema) add(db, measurement, field, typ, shard string) {
+	msts, ok := s[db]
+	if !ok {
+		msts = make(map[string]map[string]fieldSchema)
+		s[db] = msts
+	}
+	fields, ok := msts[measurement]
+	if !ok {
+		fields = make(map[string]fieldSchema)
+		msts[measurement] = fields
+	}
+	types, ok := fields[field]
+	if !ok {
+		types = make(fieldSchema)
+		fields[field] = types
+	}
+	shards := types[typ]
+	if len(shards) == 0 || shards[len(shards)-1] != shard {
+		types[typ] = append(shards, shard)
+	}
+}
+
+// aggTypeName returns the type of the field aggregated by agg from a field of typ, or "" if the
+// aggregation does not apply to the type, as fieldAgg.result does.
+func aggTypeName(agg, typ string) string {
+	numeric := typ != "boolean" && typ != "string"
+	switch agg {
+	case aggCount:
+		return "integer"
+	case aggFirst, aggLast:
+		return typ
+	}
+	if !numeric {
+		return ""
+	}
+	if agg == aggMean {
+		return "float"
+	}
+	return typ
+}
+
+// readFileSchema adds the field types of the TSM file to the schema. The types are read
+// from the block types of the index, so no block has to be decoded. The fields with points
+// older than the cutoff of a downsample rule are added as the fields aggregated by the rule,
+// and as they are if they have points newer than all the cutoffs.
+func readFileSchema(file, db, shard string, rules []*downsampleRule, schema measurementSchema) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer f.Close()
+
+	r, err := tsm1.NewTSMReader(f)
+	if err != nil {
+		return fmt.Errorf("unable to read %s: %s", file, err)
+	}
+	defer r.Close()
+
+	var lastSeries []byte
+	var measurement string
+	var entries []tsm1.IndexEntry
+	for i := 0; i < r.KeyCount(); i++ {
+		key, typ := r.KeyAt(i)
+		series, field := tsm1.SeriesAndFieldFromCompositeKey(key)
+		if !bytes.Equal(series, lastSeries) {
+			lastSeries = append(lastSeries[:0], series...)
+			measurement = string(models.ParseName(series))
+		}
+		typeName := blockTypeName(typ)
+		if len(rules) == 0 {
+			schema.add(db, measurement, string(field), typeName, shard)
+			continue
+		}
+
+		// the rules are sorted by age in descending order, so the cutoffs are in ascending order,
+		// and a rule aggregates the points from the cutoff of the previous rule to its own
+		entries = r.ReadEntries(key, &entries)
+		from := int64(math.MinInt64)
+		for _, rule := range rules {
+			if overlaps(entries, from, rule.cutoff) {
+				for _, agg := range rule.aggs {
+					if aggType := aggTypeName(agg, typeName); aggType != "" {
+						schema.add(db, measurement, agg+"_"+string(field), aggType, shard)
+					}
+				}
+			}
+			from = rule.cutoff
+		}
+		if overlaps(entries, from, math.MaxInt64) {
+			schema.add(db, measurement, string(field), typeName, shard)
+		}
+	}
+	return nil
+}
+
+// overlaps reports whether any block of the entries has points in [from, to).
+func overlaps(entries []tsm1.IndexEntry, from, to int64) bool {
+	for _, e := range entries {
+		if e.MaxTime >= from && e.MinTime < to {
+			return true
+		}
+	}
+	return false
+}
+
+// collectSchema reads the field types of all the TSM files to migrate, keyed by the destination database.
+func (cmd *DataMigrateCommand) collectSchema() (measurementSchema, error) {
+	schema := make(measurementSchema)
+	for _, info := range cmd.shards {
+		key := info.key()
+		dstDB, _ := cmd.mapping.resolve(info.Database, info.RetentionPolicy)
+		files, cleanup, err := tsmFilesOf(cmd.Source, info)
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			if err = readFileSchema(file, dstDB, key, cmd.downsampleRules, schema); err != nil {
+				break
+			}
+		}
+		cleanup()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return schema, nil
+}
+
+// tsmFilesOf returns the TSM files of the shard, and the function to remove them once read if they are extracted.
+func tsmFilesOf(source Source, shard ShardInfo) ([]string, func(), error) {
+	switch s := source.(type) {
+	case *TSMSource:
+		return s.Files(shard), func() {}, nil
+	case *BackupSource:
+		dir, files, err := s.extract(shard)
+		if err != nil {
+			return nil, nil, err
+		}
+		return files, func() { os.RemoveAll(dir) }, nil
+	}
+	return nil, nil, fmt.Errorf("dataMigrate: --check-schema only supports the TSM files as the source")
+}
+
+// checkSchema compares the field types of the TSM files with the ones in openGemini, and
+// returns an error listing every conflict before any data is written.
+func (cmd *DataMigrateCommand) checkSchema() error {
+	logger.LogString("Checking the schema of the data to migrate", TOCONSOLE|TOLOGFILE, LEVEL_INFO)
+	schema, err := cmd.collectSchema()
+	if err != nil {
+		return err
+	}
+
+	var conflicts []string
+	for _, db := range schema.databases() {
+		destFields, err := cmd.gs.GetFieldKeys(db)
+		if err != nil {
+			return err
+		}
+		for _, mst := range schema.measurements(db) {
+			for _, field := range schema.fields(db, mst) {
+				types := schema[db][mst][field]
+				if len(types) > 1 {
+					var desc []string
+					for _, typ := range types.types() {
+						desc = append(desc, fmt.Sprintf("%s in %s", typ, strings.Join(types[typ], ",")))
+					}
+					conflicts = append(conflicts, fmt.Sprintf("%s.%s field %q has different types in the source: %s",
+						db, mst, field, strings.Join(desc, "; ")))
+				}
+				destType, ok := destFields[mst][field]
+				if !ok {
+					continue
+				}
+				for _, typ := range types.types() {
+					if typ != destType {
+						conflicts = append(conflicts, fmt.Sprintf("%s.%s field %q is type %s in %s, but already exists as type %s in openGemini",
+							db, mst, field, typ, strings.Join(types[typ], ","), destType))
+					}
+				}
+			}
+		}
+	}
+
+	if len(conflicts) == 0 {
+		logger.LogString("No schema conflict found", TOCONSOLE|TOLOGFILE, LEVEL_INFO)
+		return nil
+	}
+	for _, c := range conflicts {
+		logger.LogString("Schema conflict: "+c, TOCONSOLE|TOLOGFILE, LEVEL_ERROR)
+	}
+	return fmt.Errorf("dataMigrate: found %d schema conflicts, nothing is migrated", len(conflicts))
+}
+
+func (s measurementSchema) databases() []string {
+	dbs := make([]string, 0, len(s))
+	for db := range s {
+		dbs = append(dbs, db)
+	}
+	sort.Strings(dbs)
+	return dbs
+}
+
+func (s measurementSchema) measurements(db string) []string {
+	msts := make([]string, 0, len(s[db]))
+	for mst := range s[db] {
+		msts = append(msts, mst)
+	}
+	sort.Strings(msts)
+	return msts
+}
+
+func (s measurementSchema) fields(db, measurement string) []string {
+	fields := make([]string, 0, len(s[db][measurement]))
+	for field := range s[db][measurement] {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	return fields
+}
+
+func (s fieldSchema) types() []string {
+	types := make([]string, 0, len(s))
+	for typ := range s {
+		types = append(types, typ)
+	}
+	sort.Strings(types)
+	return types
+}
@@ -0,0 +1,129 @@
+package src
+
+import (
+	"container/heap"
+	"sort"
+
+	"github.com/influxdata/influxdb/tsdb/engine/tsm1"
+)
+
+const (
+	// the estimated memory overhead of a series and a field in the series keys map
+	seriesKeyOverhead = 100
+	fieldKeyOverhead  = 40
+)
+
+// seriesIterator iterates the series of a shard along with their fields.
+type seriesIterator interface {
+	// next returns the next series key and its fields, ok is false if there is no more series.
+	// The returned fields are only valid until the next call.
+	next() (series string, fields []string, ok bool)
+}
+
+var _ seriesIterator = (*mapSeriesIterator)(nil)
+var _ seriesIterator = (*mergeSeriesIterator)(nil)
+
+// mapSeriesIterator iterates the series keys collected in memory in sorted order.
+type mapSeriesIterator struct {
+	serieskeys map[string]map[string]struct{}
+	keys       []string
+	fields     []string
+	pos        int
+}
+
+func newMapSeriesIterator(serieskeys map[string]map[string]struct{}) *mapSeriesIterator {
+	keys := make([]string, 0, len(serieskeys))
+	for k := range serieskeys {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return &mapSeriesIterator{serieskeys: serieskeys, keys: keys}
+}
+
+func (it *mapSeriesIterator) next() (string, []string, bool) {
+	if it.pos >= len(it.keys) {
+		return "", nil, false
+	}
+	series := it.keys[it.pos]
+	it.pos++
+	it.fields = it.fields[:0]
+	for f := range it.serieskeys[series] {
+		it.fields = append(it.fields, f)
+	}
+	sort.Strings(it.fields)
+	return series, it.fields, true
+}
+
+// keyCursor is the position in the sorted key index of a TSM file.
+type keyCursor struct {
+	r   tsm1.TSMFile
+	pos int
+	key []byte
+}
+
+type keyHeap []*keyCursor
+
+func (h keyHeap) Len() int           { return len(h) }
+func (h keyHeap) Less(i, j int) bool { return string(h[i].key) < string(h[j].key) }
+func (h keyHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+
+func (h *keyHeap) Push(x interface{}) {
+	*h = append(*h, x.(*keyCursor))
+}
+
+func (h *keyHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	item := old[n-1]
+	*h = old[0 : n-1]
+	return item
+}
+
+// mergeSeriesIterator merges the sorted key indexes of the TSM files of a shard, so only one
+// series is held in memory at a time. All the keys of a series are adjacent in the index
+// since they share the prefix of the series key.
+type mergeSeriesIterator struct {
+	h      keyHeap
+	fields []string
+}
+
+func newMergeSeriesIterator(files []tsm1.TSMFile) *mergeSeriesIterator {
+	it := &mergeSeriesIterator{h: make(keyHeap, 0, len(files))}
+	for _, r := range files {
+		if r.KeyCount() == 0 {
+			continue
+		}
+		key, _ := r.KeyAt(0)
+		it.h = append(it.h, &keyCursor{r: r, key: key})
+	}
+	heap.Init(&it.h)
+	return it
+}
+
+func (it *mergeSeriesIterator) next() (string, []string, bool) {
+	if len(it.h) == 0 {
+		return "", nil, false
+	}
+	s, _ := tsm1.SeriesAndFieldFromCompositeKey(it.h[0].key)
+	series := string(s)
+	it.fields = it.fields[:0]
+	for len(it.h) > 0 {
+		c := it.h[0]
+		s, f := tsm1.SeriesAndFieldFromCompositeKey(c.key)
+		if string(s) != series {
+			break
+		}
+		// the same key may exist in several files
+		if len(it.fields) == 0 || it.fields[len(it.fields)-1] != string(f) {
+			it.fields = append(it.fields, string(f))
+		}
+		c.pos++
+		if c.pos < c.r.KeyCount() {
+			c.key, _ = c.r.KeyAt(c.pos)
+			heap.Fix(&it.h, 0)
+		} else {
+			heap.Pop(&it.h)
+		}
+	}
+	return series, it.fields, true
+}
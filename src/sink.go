@@ -0,0 +1,476 @@
+package src
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/atomic"
+)
+
+// Batch is the line protocol of the points to write into a database and retention policy.
+type Batch struct {
+	Database        string
+	RetentionPolicy string
+	// the precision of the timestamps: ns, us, ms or s
+	Precision string
+	// the points, each of which ends with '\n'
+	Lines  []byte
+	Points int
+	// the points dropped by the destination, e.g. for field type conflicts, which is added by
+	// the sink on Write
+	Rejected int
+}
+
+var batchPool = sync.Pool{
+	New: func() interface{} {
+		return &Batch{Lines: make([]byte, 0, 64*1024)}
+	},
+}
+
+func getBatch(database, rp, precision string) *Batch {
+	b := batchPool.Get().(*Batch)
+	b.Database, b.RetentionPolicy, b.Precision = database, rp, precision
+	b.Lines = b.Lines[:0]
+	b.Points, b.Rejected = 0, 0
+	return b
+}
+
+func putBatch(b *Batch) {
+	batchPool.Put(b)
+}
+
+// firstLine returns the first point of the batch for logging.
+func (b *Batch) firstLine() string {
+	if i := bytes.IndexByte(b.Lines, '\n'); i >= 0 {
+		return string(b.Lines[:i])
+	}
+	return string(b.Lines)
+}
+
+// SinkStats is the statistics of the data written by a sink.
+type SinkStats struct {
+	PointsWritten  int64
+	PointsRejected int64
+	// the size of the line protocol written, and of the data sent after compression
+	BytesWritten int64
+	BytesSent    int64
+}
+
+// Sink is where the migrated data goes. Write is called by the migrators of all the shards
+// concurrently, and the batch must not be retained after Write returns.
+type Sink interface {
+	Write(b *Batch) error
+	// Flush writes out the data buffered.
+	Flush() error
+	Close() error
+	Stats() SinkStats
+}
+
+// sinkError is an error of the sink, which fails the migration even with --on-error: the shard
+// may be written partially, and the other shards fail the same way.
+type sinkError struct {
+	err error
+}
+
+func (e *sinkError) Error() string {
+	return e.err.Error()
+}
+
+// isSinkError reports whether the error is of the sink, see sinkError.
+func isSinkError(err error) bool {
+	_, ok := errors.Cause(err).(*sinkError)
+	return ok
+}
+
+var _ Sink = (*GeminiSink)(nil)
+var _ Sink = (*FileSink)(nil)
+var _ Sink = (*FanoutSink)(nil)
+
+// sinkStats is the counters of SinkStats.
+type sinkStats struct {
+	pointsWritten  atomic.Int64
+	pointsRejected atomic.Int64
+	bytesWritten   atomic.Int64
+	bytesSent      atomic.Int64
+}
+
+func (s *sinkStats) add(b *Batch, sent int) {
+	s.pointsWritten.Add(int64(b.Points))
+	s.bytesWritten.Add(int64(len(b.Lines)))
+	s.bytesSent.Add(int64(sent))
+}
+
+// addPartial adds a batch of which the rejected points are dropped by the destination.
+func (s *sinkStats) addPartial(b *Batch, sent int, rejected int) {
+	s.pointsWritten.Add(int64(b.Points - rejected))
+	s.pointsRejected.Add(int64(rejected))
+	s.bytesWritten.Add(int64(len(b.Lines)))
+	s.bytesSent.Add(int64(sent))
+}
+
+func (s *sinkStats) load() SinkStats {
+	return SinkStats{
+		PointsWritten:  s.pointsWritten.Load(),
+		PointsRejected: s.pointsRejected.Load(),
+		BytesWritten:   s.bytesWritten.Load(),
+		BytesSent:      s.bytesSent.Load(),
+	}
+}
+
+// FileSink appends the batches to a file in the format of influx_inspect export, which can be
+// imported by `influx -import`. The file is created on the first write.
+type FileSink struct {
+	mu   sync.Mutex
+	path string
+	f    *os.File
+	w    *bufio.Writer
+	// the context of the lines written last
+	db, rp string
+
+	stats sinkStats
+}
+
+func NewFileSink(path string) *FileSink {
+	return &FileSink{path: path}
+}
+
+func (s *FileSink) open() error {
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return errors.WithStack(err)
+	}
+	f, err := os.OpenFile(s.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	s.f, s.w = f, bufio.NewWriterSize(f, 1024*1024)
+	_, err = s.w.WriteString("# DML\n")
+	return errors.WithStack(err)
+}
+
+func (s *FileSink) Write(b *Batch) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.f == nil {
+		if err := s.open(); err != nil {
+			return err
+		}
+	}
+	if b.Database != s.db || b.RetentionPolicy != s.rp {
+		s.db, s.rp = b.Database, b.RetentionPolicy
+		if _, err := fmt.Fprintf(s.w, "# CONTEXT-DATABASE: %s\n# CONTEXT-RETENTION-POLICY: %s\n", s.db, s.rp); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	if _, err := s.w.Write(b.Lines); err != nil {
+		return errors.WithStack(err)
+	}
+	s.stats.add(b, len(b.Lines))
+	return nil
+}
+
+func (s *FileSink) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.f == nil {
+		return nil
+	}
+	return errors.WithStack(s.w.Flush())
+}
+
+func (s *FileSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.f == nil {
+		return nil
+	}
+	err := s.w.Flush()
+	if cerr := s.f.Close(); err == nil {
+		err = cerr
+	}
+	s.f = nil
+	return errors.WithStack(err)
+}
+
+func (s *FileSink) Stats() SinkStats {
+	return s.stats.load()
+}
+
+const (
+	OnErrorFail       = "fail"
+	OnErrorSkip       = "skip"
+	OnErrorDeadLetter = "dead-letter"
+)
+
+// FanoutTarget is a sink of FanoutSink, along with the policy on write failures.
+type FanoutTarget struct {
+	Name string
+	Sink Sink
+	// fail, skip or dead-letter
+	OnError string
+	// where the batches failed to write go with the dead-letter policy
+	DeadLetter Sink
+}
+
+type fanoutTarget struct {
+	FanoutTarget
+	pointsSkipped      atomic.Int64
+	pointsDeadLettered atomic.Int64
+}
+
+// FanoutSink writes every batch to all the targets, so the data is read only once.
+// A failed batch is retried every RetryInterval, until it succeeds or MaxRetries is reached,
+// then the policy of the target applies.
+type FanoutSink struct {
+	targets []*fanoutTarget
+	// 0 means retrying until it succeeds
+	MaxRetries    int
+	RetryInterval time.Duration
+}
+
+func NewFanoutSink(targets []FanoutTarget, maxRetries int) (*FanoutSink, error) {
+	f := &FanoutSink{MaxRetries: maxRetries, RetryInterval: 3 * time.Second}
+	for _, t := range targets {
+		switch t.OnError {
+		case OnErrorFail, OnErrorSkip:
+		case OnErrorDeadLetter:
+			if t.DeadLetter == nil {
+				return nil, fmt.Errorf("dataMigrate: no dead letter sink for %s", t.Name)
+			}
+		default:
+			return nil, fmt.Errorf("dataMigrate: invalid on-error %q of %s, expect fail, skip or dead-letter", t.OnError, t.Name)
+		}
+		f.targets = append(f.targets, &fanoutTarget{FanoutTarget: t})
+	}
+	if len(f.targets) == 0 {
+		return nil, fmt.Errorf("dataMigrate: no sink to write to")
+	}
+	return f, nil
+}
+
+// Write returns an error only if a target with the fail policy cannot be written. The points
+// rejected by the first target are added to the batch.
+func (f *FanoutSink) Write(b *Batch) error {
+	rejected := b.Rejected
+	defer func() {
+		b.Rejected = rejected
+	}()
+	for i, t := range f.targets {
+		b.Rejected = 0
+		err := f.retryWrite(t.Sink, b)
+		if i == 0 {
+			rejected += b.Rejected
+		}
+		if err == nil {
+			continue
+		}
+		switch t.OnError {
+		case OnErrorSkip:
+			logger.LogString(fmt.Sprintf("%d points to %s are skipped: %s", b.Points, t.Name, err), TOLOGFILE|TOCONSOLE, LEVEL_WARNING)
+			t.pointsSkipped.Add(int64(b.Points))
+		case OnErrorDeadLetter:
+			if derr := t.DeadLetter.Write(b); derr != nil {
+				return fmt.Errorf("dataMigrate: write dead letter of %s: %s", t.Name, derr)
+			}
+			t.pointsDeadLettered.Add(int64(b.Points))
+		default:
+			return fmt.Errorf("dataMigrate: write to %s: %s", t.Name, err)
+		}
+	}
+	return nil
+}
+
+// retryWrite writes the batch until it succeeds, is skipped, or runs out of retries.
+// The errors retrying cannot resolve, e.g. the batch is rejected for bad data, are returned at once.
+func (f *FanoutSink) retryWrite(s Sink, b *Batch) error {
+	for i := 1; ; i++ {
+		err := s.Write(b)
+		if err == nil {
+			return nil
+		}
+		logger.LogString("insert error: "+err.Error(), TOLOGFILE|TOCONSOLE, LEVEL_ERROR)
+		if !isRetryable(err) {
+			return err
+		}
+		if f.MaxRetries > 0 && i > f.MaxRetries {
+			return err
+		}
+		logger.LogString("retry for points like:"+b.firstLine(), TOLOGFILE|TOCONSOLE, LEVEL_ERROR)
+		time.Sleep(f.RetryInterval)
+	}
+}
+
+func (f *FanoutSink) Flush() error {
+	var err error
+	for _, t := range f.targets {
+		if ferr := t.Sink.Flush(); ferr != nil && err == nil {
+			err = ferr
+		}
+		if t.DeadLetter != nil {
+			if ferr := t.DeadLetter.Flush(); ferr != nil && err == nil {
+				err = ferr
+			}
+		}
+	}
+	return err
+}
+
+func (f *FanoutSink) Close() error {
+	var err error
+	for _, t := range f.targets {
+		if cerr := t.Sink.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+		if t.DeadLetter != nil {
+			if cerr := t.DeadLetter.Close(); cerr != nil && err == nil {
+				err = cerr
+			}
+		}
+	}
+	return err
+}
+
+// Stats returns the statistics of the first target.
+func (f *FanoutSink) Stats() SinkStats {
+	return f.targets[0].Sink.Stats()
+}
+
+// report describes the data written to every target.
+func (f *FanoutSink) report() []string {
+	var lines []string
+	for _, t := range f.targets {
+		stats := t.Sink.Stats()
+		msg := "Destination " + t.Name + ": " + strconv.FormatInt(stats.PointsWritten, 10) + " rows written"
+		if stats.PointsRejected > 0 {
+			msg += ", " + strconv.FormatInt(stats.PointsRejected, 10) + " rows rejected"
+		}
+		if n := t.pointsSkipped.Load(); n > 0 {
+			msg += ", " + strconv.FormatInt(n, 10) + " rows skipped"
+		}
+		if n := t.pointsDeadLettered.Load(); n > 0 {
+			msg += ", " + strconv.FormatInt(n, 10) + " rows dead-lettered"
+		}
+		lines = append(lines, msg)
+	}
+	return lines
+}
+
+// parseFanoutTarget parses the destination of --fanout:
+// `http[s]://[user:password@]host:port[,host:port...][?on-error=fail|skip|dead-letter&balance=...]`
+// or `file:/path/to/file[?on-error=...]`.
+func parseFanoutTarget(spec string, opt *DataMigrateOptions) (FanoutTarget, error) {
+	t := FanoutTarget{OnError: OnErrorFail}
+	rest, query := spec, ""
+	if i := strings.IndexByte(spec, '?'); i >= 0 {
+		rest, query = spec[:i], spec[i+1:]
+	}
+	params, err := parseQuery(query)
+	if err != nil {
+		return t, fmt.Errorf("dataMigrate: invalid destination %q: %s", spec, err)
+	}
+	if v := params["on-error"]; v != "" {
+		t.OnError = v
+	}
+
+	switch {
+	case strings.HasPrefix(rest, "http://"), strings.HasPrefix(rest, "https://"):
+		cfg := GeminiSinkConfig{
+			Ssl:           strings.HasPrefix(rest, "https://"),
+			Username:      opt.Username,
+			Password:      opt.Password,
+			Balance:       opt.Balance,
+			Compress:      opt.Compress,
+			CompressLevel: opt.CompressLevel,
+		}
+		hosts := rest[strings.Index(rest, "://")+3:]
+		if i := strings.LastIndexByte(hosts, '@'); i >= 0 {
+			cfg.Username, cfg.Password = hosts[:i], ""
+			if j := strings.IndexByte(cfg.Username, ':'); j >= 0 {
+				cfg.Username, cfg.Password = cfg.Username[:j], cfg.Username[j+1:]
+			}
+			hosts = hosts[i+1:]
+		}
+		if v := params["balance"]; v != "" {
+			cfg.Balance = v
+		}
+		cfg.Hosts = splitEndpoints(hosts)
+		sink, err := NewGeminiSink(cfg)
+		if err != nil {
+			return t, fmt.Errorf("dataMigrate: invalid destination %q: %s", spec, err)
+		}
+		t.Name, t.Sink = hosts, sink
+	case strings.HasPrefix(rest, "file:"):
+		path := strings.TrimPrefix(strings.TrimPrefix(rest, "file:"), "//")
+		if path == "" {
+			return t, fmt.Errorf("dataMigrate: no path in destination %q", spec)
+		}
+		t.Name, t.Sink = path, NewFileSink(path)
+	default:
+		return t, fmt.Errorf("dataMigrate: invalid destination %q, expect http://, https:// or file:", spec)
+	}
+
+	if t.OnError == OnErrorDeadLetter {
+		name := strings.Map(func(r rune) rune {
+			if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '.' {
+				return r
+			}
+			return '_'
+		}, t.Name)
+		t.DeadLetter = NewFileSink(filepath.Join(opt.DeadLetterDir, name+".lp"))
+	}
+	return t, nil
+}
+
+// parseQuery parses the parameters of a destination, which are not escaped.
+func parseQuery(query string) (map[string]string, error) {
+	params := make(map[string]string)
+	for _, kv := range strings.Split(query, "&") {
+		if kv == "" {
+			continue
+		}
+		i := strings.IndexByte(kv, '=')
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid parameter %q", kv)
+		}
+		params[kv[:i]] = kv[i+1:]
+	}
+	return params, nil
+}
+
+// newPrimarySink returns the sink of --to.
+func newPrimarySink(opt *DataMigrateOptions) (*GeminiSink, error) {
+	return NewGeminiSink(GeminiSinkConfig{
+		Hosts:         splitEndpoints(opt.Out),
+		Ssl:           opt.Ssl,
+		Username:      opt.Username,
+		Password:      opt.Password,
+		Balance:       opt.Balance,
+		Compress:      opt.Compress,
+		CompressLevel: opt.CompressLevel,
+	})
+}
+
+// newSink returns the sink built from the options: --to, which fails the run on errors,
+// followed by the destinations of --fanout.
+func newSink(opt *DataMigrateOptions) (*FanoutSink, error) {
+	primary, err := newPrimarySink(opt)
+	if err != nil {
+		return nil, err
+	}
+	targets := []FanoutTarget{{Name: opt.Out, Sink: primary, OnError: OnErrorFail}}
+	for _, spec := range opt.Fanouts {
+		t, err := parseFanoutTarget(spec, opt)
+		if err != nil {
+			return nil, err
+		}
+		targets = append(targets, t)
+	}
+	return NewFanoutSink(targets, opt.MaxRetries)
+}
@@ -0,0 +1,233 @@
+package src
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/influxdata/influxdb/models"
+	"github.com/influxdata/influxdb/tsdb/engine/tsm1"
+)
+
+// ShardInfo identifies a shard of the source.
+type ShardInfo struct {
+	Database        string
+	RetentionPolicy string
+	ID              string
+}
+
+// key returns db/rp/id, which identifies the shard in the logs.
+func (s ShardInfo) key() string {
+	return filepath.Join(s.Database, s.RetentionPolicy, s.ID)
+}
+
+// Source is where the data is migrated from. The shards are placed into the shard groups of
+// the destination by their min time, and the shard groups are migrated concurrently, so several
+// shards may be open at the same time.
+type Source interface {
+	// Shards returns the shards to migrate, in the order to migrate them.
+	Shards() ([]ShardInfo, error)
+	// TimeRange returns the min and max time of the data in the shard.
+	TimeRange(shard ShardInfo) (min, max int64, err error)
+	// Open opens the shard to read the data in the time range [start, end].
+	Open(shard ShardInfo, start, end int64) (ShardReader, error)
+	Close() error
+}
+
+// ShardReader iterates the series of a shard.
+type ShardReader interface {
+	// Next returns the next series, or nil if there is no more series.
+	Next() (*Series, error)
+	Close() error
+}
+
+// Series is a series of a shard with the cursors of its fields.
+type Series struct {
+	// the series key escaped as in line protocol, e.g. cpu,host=a
+	Key    string
+	Fields map[string]FieldCursor
+}
+
+// FieldCursor iterates the values of a field in ascending order of time, with no duplicate timestamps.
+type FieldCursor interface {
+	// Peek returns the next value without advancing the cursor, or nil if the cursor is exhausted.
+	Peek() (tsm1.Value, error)
+	// Next returns the next value and advances the cursor, or nil if the cursor is exhausted.
+	Next() (tsm1.Value, error)
+}
+
+// sortShards sorts the shards by db first, then by rp, then by id.
+func sortShards(shards []ShardInfo) {
+	sort.Slice(shards, func(i, j int) bool {
+		dbCmp := strings.Compare(shards[i].Database, shards[j].Database)
+		if dbCmp != 0 {
+			return dbCmp < 0
+		}
+		rpCmp := strings.Compare(shards[i].RetentionPolicy, shards[j].RetentionPolicy)
+		if rpCmp != 0 {
+			return rpCmp < 0
+		}
+		sid_i, _ := strconv.Atoi(shards[i].ID)
+		sid_j, _ := strconv.Atoi(shards[j].ID)
+		return sid_i < sid_j
+	})
+}
+
+// SeriesFilter selects the series to migrate by their measurements and tags.
+type SeriesFilter struct {
+	// the measurements to migrate, all if empty
+	Measurements map[string]struct{}
+	// tag key to values, a series is migrated only if it has one of the values of every key
+	Tags map[string]map[string]struct{}
+}
+
+// NewSeriesFilter returns the filter of the measurements and the tags in the format of key=value,
+// or nil if both are empty, which selects all the series.
+func NewSeriesFilter(measurements, tags []string) (*SeriesFilter, error) {
+	if len(measurements) == 0 && len(tags) == 0 {
+		return nil, nil
+	}
+	f := &SeriesFilter{
+		Measurements: make(map[string]struct{}, len(measurements)),
+		Tags:         make(map[string]map[string]struct{}, len(tags)),
+	}
+	for _, m := range measurements {
+		f.Measurements[m] = struct{}{}
+	}
+	for _, tag := range tags {
+		kv := strings.SplitN(tag, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("dataMigrate: invalid tag filter %q, expect key=value", tag)
+		}
+		values, ok := f.Tags[kv[0]]
+		if !ok {
+			values = make(map[string]struct{})
+			f.Tags[kv[0]] = values
+		}
+		values[kv[1]] = struct{}{}
+	}
+	return f, nil
+}
+
+// MatchMeasurement reports whether the series of the measurement may be selected.
+func (f *SeriesFilter) MatchMeasurement(name string) bool {
+	if f == nil || len(f.Measurements) == 0 {
+		return true
+	}
+	_, ok := f.Measurements[name]
+	return ok
+}
+
+// Match reports whether the series key, escaped as in line protocol, is selected.
+func (f *SeriesFilter) Match(series []byte) bool {
+	if f == nil {
+		return true
+	}
+	name, tags := models.ParseKeyBytes(series)
+	if !f.MatchMeasurement(string(name)) {
+		return false
+	}
+	for key, values := range f.Tags {
+		if _, ok := values[string(tags.Get([]byte(key)))]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// skipCounter is implemented by the shard readers which skip the series not selected by the
+// filter or dropped, to report them in the statistics.
+type skipCounter interface {
+	// seriesSkipped returns the number of the series skipped once all the series are read.
+	seriesSkipped() int
+}
+
+// skippedFile is a TSM file which cannot be read, skipped with --on-error skip-file.
+type skippedFile struct {
+	path string
+	err  error
+}
+
+// fileSkipper is implemented by the shard readers which skip the files they cannot read.
+type fileSkipper interface {
+	skippedFiles() []skippedFile
+}
+
+var _ Source = (*TSMSource)(nil)
+var _ ShardReader = (*tsmShardReader)(nil)
+var _ FieldCursor = (*Cursor)(nil)
+var _ skipCounter = (*tsmShardReader)(nil)
+var _ fileSkipper = (*tsmShardReader)(nil)
+var _ blockVerifier = (*TSMSource)(nil)
+var _ committer = (*incrementalShardReader)(nil)
+var _ committer = (*onlineShardReader)(nil)
+
+// newSource returns the source of the options, which is the running InfluxDB of --src-host if
+// --online is set, otherwise --from is the data dir of InfluxDB, the engine dir of InfluxDB 2.x or the
+// dir of a portable backup.
+func newSource(opt *DataMigrateOptions) (Source, error) {
+	filter, err := NewSeriesFilter(opt.Measurements, opt.Tags)
+	if err != nil {
+		return nil, err
+	}
+	if opt.Online {
+		window, err := parseDuration(opt.Window)
+		if err != nil {
+			return nil, fmt.Errorf("dataMigrate: invalid window %q: %s", opt.Window, err)
+		}
+		return NewOnlineSource(OnlineSourceConfig{
+			Host:            opt.SrcHost,
+			Ssl:             opt.SrcSsl,
+			Username:        opt.SrcUsername,
+			Password:        opt.SrcPassword,
+			Database:        opt.Database,
+			RetentionPolicy: opt.RetentionPolicy,
+			Window:          window,
+			ChunkSize:       opt.ChunkSize,
+			Checkpoint:      opt.Checkpoint,
+			Filter:          filter,
+		})
+	}
+	if isBackupDir(opt.DataDir) {
+		if opt.Incremental != "" {
+			return nil, fmt.Errorf("dataMigrate: --incremental is not supported with backups")
+		}
+		return NewBackupSource(BackupSourceConfig{
+			Dir:             opt.DataDir,
+			Database:        opt.Database,
+			RetentionPolicy: opt.RetentionPolicy,
+			TmpDir:          opt.TmpDir,
+			Stream:          opt.Stream,
+			SeriesMemLimit:  int64(opt.SeriesMemLimit) * 1024 * 1024,
+			Filter:          filter,
+			SkipFiles:       opt.OnError == OnErrorSkipFile,
+		})
+	}
+	if isEngineDir(opt.DataDir) {
+		return NewEngineSource(EngineSourceConfig{
+			Dir:             opt.DataDir,
+			BoltPath:        opt.BoltPath,
+			Database:        opt.Database,
+			RetentionPolicy: opt.RetentionPolicy,
+			Stream:          opt.Stream,
+			SeriesMemLimit:  int64(opt.SeriesMemLimit) * 1024 * 1024,
+			Filter:          filter,
+			IgnoreIndex:     opt.IgnoreIndex,
+			SkipFiles:       opt.OnError == OnErrorSkipFile,
+			State:           opt.Incremental,
+		})
+	}
+	return NewTSMSource(TSMSourceConfig{
+		DataDir:         opt.DataDir,
+		Database:        opt.Database,
+		RetentionPolicy: opt.RetentionPolicy,
+		Stream:          opt.Stream,
+		SeriesMemLimit:  int64(opt.SeriesMemLimit) * 1024 * 1024,
+		Filter:          filter,
+		IgnoreIndex:     opt.IgnoreIndex,
+		SkipFiles:       opt.OnError == OnErrorSkipFile,
+		State:           opt.Incremental,
+	}), nil
+}
@@ -0,0 +1,117 @@
+package src
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	dedupFirst = "first"
+	dedupLast  = "last"
+)
+
+var precisionUnits = map[string]int64{
+	"ns": int64(time.Nanosecond),
+	"us": int64(time.Microsecond),
+	"ms": int64(time.Millisecond),
+	"s":  int64(time.Second),
+}
+
+// timeTransform shifts and truncates the timestamps of the points to write.
+// A nil timeTransform keeps the timestamps as they are.
+type timeTransform struct {
+	shift     int64
+	precision string
+	unit      int64 // nanoseconds of the precision
+	keepLast  bool  // which value wins if the points collide after truncation
+}
+
+func newTimeTransform(shift, precision, dedup string) (*timeTransform, error) {
+	t := &timeTransform{precision: "ns", unit: 1, keepLast: true}
+	if shift != "" {
+		d, err := parseDuration(shift)
+		if err != nil {
+			return nil, fmt.Errorf("dataMigrate: invalid time shift %q: %s", shift, err)
+		}
+		t.shift = int64(d)
+	}
+	if precision != "" {
+		unit, ok := precisionUnits[precision]
+		if !ok {
+			return nil, fmt.Errorf("dataMigrate: invalid precision %q, expect one of ns, us, ms, s", precision)
+		}
+		t.precision, t.unit = precision, unit
+	}
+	switch dedup {
+	case "", dedupLast:
+	case dedupFirst:
+		t.keepLast = false
+	default:
+		return nil, fmt.Errorf("dataMigrate: invalid dedup policy %q, expect first or last", dedup)
+	}
+	return t, nil
+}
+
+func (t *timeTransform) String() string {
+	policy := dedupFirst
+	if t.keepLast {
+		policy = dedupLast
+	}
+	return fmt.Sprintf("shift %s, precision %s, dedup %s", time.Duration(t.shift), t.precision, policy)
+}
+
+// apply returns the shifted timestamp truncated to the precision.
+func (t *timeTransform) apply(ts int64) int64 {
+	if t == nil {
+		return ts
+	}
+	ts += t.shift
+	if t.unit > 1 {
+		rem := ts % t.unit
+		ts -= rem
+		if rem < 0 {
+			ts -= t.unit
+		}
+	}
+	return ts
+}
+
+// truncates reports whether different timestamps may collide after apply.
+func (t *timeTransform) truncates() bool {
+	return t != nil && t.unit > 1
+}
+
+func (t *timeTransform) getPrecision() string {
+	if t == nil {
+		return "ns"
+	}
+	return t.precision
+}
+
+// getUnit returns the nanoseconds of the precision.
+func (t *timeTransform) getUnit() int64 {
+	if t == nil {
+		return 1
+	}
+	return t.unit
+}
+
+// mergeRow merges the fields of src into dst which has the same timestamp,
+// the conflicting fields are resolved by the dedup policy.
+func (t *timeTransform) mergeRow(dst, src *row) {
+	for _, sf := range src.fields {
+		found := false
+		for i := range dst.fields {
+			if dst.fields[i].key == sf.key {
+				if t.keepLast {
+					dst.fields[i].value = sf.value
+				}
+				found = true
+				break
+			}
+		}
+		if !found {
+			dst.fields = append(dst.fields, sf)
+		}
+	}
+}
@@ -0,0 +1,214 @@
+package src
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/influxdata/influxdb/models"
+	"github.com/influxdata/influxdb/tsdb"
+	"github.com/influxdata/influxdb/tsdb/index/tsi1"
+	"github.com/pkg/errors"
+)
+
+// hasTSIIndex reports whether the shard has a TSI index, the shards of the inmem index have none
+// on disk.
+func hasTSIIndex(shardDir string) bool {
+	ok, _ := tsi1.IsIndexDir(filepath.Join(shardDir, "index"))
+	return ok
+}
+
+// seriesFileDir returns the dir of the series file of the database of the shard, which is
+// <db>/_series next to the dirs of the retention policies.
+func seriesFileDir(shardDir string) string {
+	return filepath.Join(filepath.Dir(filepath.Dir(shardDir)), tsdb.SeriesFileDirectory)
+}
+
+// openSeriesFile opens the series file of a database, which maps the series keys to the ids in
+// the TSI index.
+func openSeriesFile(dir string) (*tsdb.SeriesFile, error) {
+	if _, err := os.Stat(dir); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	sfile := tsdb.NewSeriesFile(dir)
+	if err := sfile.Open(); err != nil {
+		return nil, fmt.Errorf("dataMigrate: open series file %s: %s", dir, err)
+	}
+	return sfile, nil
+}
+
+// shardIndex reads the TSI index of a shard. The files of the partitions are opened directly,
+// since opening them through tsi1.Index compacts them and removes the files not in the manifests.
+type shardIndex struct {
+	sfile *tsdb.SeriesFile
+	files []tsi1.File
+	// the file set of every partition
+	fileSets []*tsi1.FileSet
+	// the series in the index, the ones dropped by DROP SERIES or DELETE are not in it
+	series *tsdb.SeriesIDSet
+	buf    []byte
+}
+
+func openShardIndex(shardDir string, sfile *tsdb.SeriesFile) (*shardIndex, error) {
+	dir := filepath.Join(shardDir, "index")
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	idx := &shardIndex{sfile: sfile, series: tsdb.NewSeriesIDSet()}
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		if err := idx.openPartition(filepath.Join(dir, e.Name())); err != nil {
+			idx.Close()
+			return nil, err
+		}
+	}
+	return idx, nil
+}
+
+// openPartition opens the files in the manifest of the partition, from the newest to the oldest.
+func (idx *shardIndex) openPartition(dir string) error {
+	m, _, err := tsi1.ReadManifestFile(filepath.Join(dir, tsi1.ManifestFileName))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("dataMigrate: read manifest of index %s: %s", dir, err)
+	}
+	var files []tsi1.File
+	for _, name := range m.Files {
+		path := filepath.Join(dir, name)
+		switch filepath.Ext(name) {
+		case tsi1.LogFileExt:
+			f := tsi1.NewLogFile(idx.sfile, path)
+			if err := f.Open(); err != nil {
+				return fmt.Errorf("dataMigrate: open index log file %s: %s", path, err)
+			}
+			files = append(files, f)
+		case tsi1.IndexFileExt:
+			f := tsi1.NewIndexFile(idx.sfile)
+			f.SetPath(path)
+			if err := f.Open(); err != nil {
+				return fmt.Errorf("dataMigrate: open index file %s: %s", path, err)
+			}
+			files = append(files, f)
+		}
+	}
+	idx.files = append(idx.files, files...)
+	fs, err := tsi1.NewFileSet(m.Levels, idx.sfile, files)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	idx.fileSets = append(idx.fileSets, fs)
+
+	// the series of the older files are dropped by the tombstones of the newer ones
+	series := tsdb.NewSeriesIDSet()
+	for i := len(files) - 1; i >= 0; i-- {
+		tombstones, err := files[i].TombstoneSeriesIDSet()
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		series.Diff(tombstones)
+		ss, err := files[i].SeriesIDSet()
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		series.Merge(ss)
+	}
+	idx.series.Merge(series)
+	return nil
+}
+
+// live reports whether the series is in the index, i.e. not dropped.
+func (idx *shardIndex) live(series []byte) bool {
+	name, tags := models.ParseKeyBytes(series)
+	id := idx.sfile.SeriesID(name, tags, idx.buf)
+	return id != 0 && idx.series.Contains(id)
+}
+
+// measurements returns the sorted names of the measurements with series in the index.
+func (idx *shardIndex) measurements() ([]string, error) {
+	names := make(map[string]struct{})
+	for _, fs := range idx.fileSets {
+		itr := fs.MeasurementIterator()
+		if itr == nil {
+			continue
+		}
+		for e := itr.Next(); e != nil; e = itr.Next() {
+			if e.Deleted() {
+				continue
+			}
+			if _, ok := names[string(e.Name())]; ok {
+				continue
+			}
+			ids, err := idx.measurementSeries(e.Name())
+			if err != nil {
+				return nil, err
+			}
+			if len(ids) > 0 {
+				names[string(e.Name())] = struct{}{}
+			}
+		}
+	}
+	measurements := make([]string, 0, len(names))
+	for name := range names {
+		measurements = append(measurements, name)
+	}
+	sort.Strings(measurements)
+	return measurements, nil
+}
+
+// measurementSeries returns the ids of the series of the measurement in the index.
+func (idx *shardIndex) measurementSeries(name []byte) ([]uint64, error) {
+	var ids []uint64
+	for _, fs := range idx.fileSets {
+		itr := fs.MeasurementSeriesIDIterator(name)
+		if itr == nil {
+			continue
+		}
+		for {
+			e, err := itr.Next()
+			if err != nil {
+				itr.Close()
+				return nil, errors.WithStack(err)
+			}
+			if e.SeriesID == 0 {
+				break
+			}
+			if idx.series.Contains(e.SeriesID) {
+				ids = append(ids, e.SeriesID)
+			}
+		}
+		itr.Close()
+	}
+	return ids, nil
+}
+
+// hasMeasurements reports whether any measurement of the filter has series in the index,
+// which is true if the filter selects all the measurements.
+func (idx *shardIndex) hasMeasurements(filter *SeriesFilter) (bool, error) {
+	if filter == nil || len(filter.Measurements) == 0 {
+		return true, nil
+	}
+	for name := range filter.Measurements {
+		ids, err := idx.measurementSeries([]byte(name))
+		if err != nil {
+			return false, err
+		}
+		if len(ids) > 0 {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (idx *shardIndex) Close() error {
+	for _, f := range idx.files {
+		f.Close()
+	}
+	idx.files, idx.fileSets = nil, nil
+	return nil
+}
@@ -0,0 +1,547 @@
+package src
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/influxdata/influxdb/tsdb"
+	"github.com/influxdata/influxdb/tsdb/engine/tsm1"
+	"github.com/pkg/errors"
+)
+
+var filesPool = sync.Pool{
+	New: func() interface{} {
+		files := make([]tsm1.TSMFile, 0, 100)
+		return &files
+	},
+}
+
+type TSMSourceConfig struct {
+	// the data dir of InfluxDB, which is laid out as db/rp/shard id/*.tsm
+	DataDir string
+	// the names of the databases by their dirs, e.g. the bucket names by the bucket ids of InfluxDB 2.x,
+	// the dirs not in it are skipped if set
+	Databases map[string]string
+	// only the shards of the database and retention policy are read if set
+	Database        string
+	RetentionPolicy string
+	// iterate the series by merging the key indexes instead of collecting them in memory
+	Stream bool
+	// the ceiling in bytes of the series keys collected for a shard, streaming is used once exceeded
+	SeriesMemLimit int64
+	// only the series selected are read if set
+	Filter *SeriesFilter
+	// read the series dropped as well, which are skipped by the TSI index of the shards by default
+	IgnoreIndex bool
+	// skip the TSM files which cannot be read, instead of failing the shard
+	SkipFiles bool
+	// the file to record the TSM files migrated of every shard, only the new data is read if set
+	State string
+}
+
+// TSMSource reads the TSM files in the data dir of InfluxDB.
+type TSMSource struct {
+	cfg    TSMSourceConfig
+	walked bool
+	shards []ShardInfo
+	// shard key to the TSM files of the shard
+	files map[string][]string
+	// the corrupt blocks found by Verify to skip
+	badBlocks blockSet
+	// loaded from cfg.State along with walking
+	state *incrementalState
+
+	mu sync.Mutex
+	// the dir to the series file of every database, which is shared by the indexes of its shards
+	sfiles map[string]*tsdb.SeriesFile
+}
+
+func NewTSMSource(cfg TSMSourceConfig) *TSMSource {
+	return &TSMSource{
+		cfg:    cfg,
+		files:  make(map[string][]string),
+		sfiles: make(map[string]*tsdb.SeriesFile),
+	}
+}
+
+// Shards walks the data dir once, and returns the shards sorted by db first, then by rp, then by id.
+func (s *TSMSource) Shards() ([]ShardInfo, error) {
+	if !s.walked {
+		if err := s.walk(); err != nil {
+			return nil, err
+		}
+		if s.cfg.State != "" {
+			state, err := loadIncrementalState(s.cfg.State)
+			if err != nil {
+				return nil, err
+			}
+			s.state = state
+		}
+		s.walked = true
+	}
+	return s.shards, nil
+}
+
+// Files returns the TSM files of the shard.
+func (s *TSMSource) Files(shard ShardInfo) []string {
+	return s.files[shard.key()]
+}
+
+// Verify checks the TSM files of the shards, see blockVerifier.
+func (s *TSMSource) Verify(skipBlocks bool) ([]CorruptBlock, error) {
+	shards, err := s.Shards()
+	if err != nil {
+		return nil, err
+	}
+	corrupt := verifyFiles(shards, s.files)
+	if skipBlocks {
+		s.badBlocks = newBlockSet(corrupt)
+	}
+	return corrupt, nil
+}
+
+func (s *TSMSource) walk() error {
+	err := filepath.Walk(s.cfg.DataDir, func(path string, f os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		// check to see if this is a tsm file
+		if filepath.Ext(path) != "."+tsm1.TSMFileExtension {
+			return nil
+		}
+
+		relPath, err := filepath.Rel(s.cfg.DataDir, path)
+		if err != nil {
+			return err
+		}
+		dirs := strings.Split(relPath, string(byte(os.PathSeparator)))
+		if len(dirs) < 4 {
+			return fmt.Errorf("invalid directory structure for %s", path)
+		}
+
+		db := dirs[0]
+		if s.cfg.Databases != nil {
+			name, ok := s.cfg.Databases[db]
+			if !ok {
+				return nil
+			}
+			db = name
+		}
+		if (db == s.cfg.Database || s.cfg.Database == "") &&
+			(dirs[1] == s.cfg.RetentionPolicy || s.cfg.RetentionPolicy == "") {
+			shard := ShardInfo{Database: db, RetentionPolicy: dirs[1], ID: dirs[2]}
+			key := shard.key()
+			s.files[key] = append(s.files[key], path)
+			if len(s.files[key]) == 1 {
+				s.shards = append(s.shards, shard)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	sortShards(s.shards)
+	return nil
+}
+
+func (s *TSMSource) TimeRange(shard ShardInfo) (min, max int64, err error) {
+	files := s.Files(shard)
+	if len(files) == 0 {
+		return 0, 0, fmt.Errorf("dataMigrate: no TSM file in shard %s", shard.key())
+	}
+	return filesTimeRange(files, s.cfg.SkipFiles)
+}
+
+// filesTimeRange returns the min time of the first TSM file and the max time of the last one.
+// The files which cannot be read are passed over if skipFiles is set.
+func filesTimeRange(files []string, skipFiles bool) (min, max int64, err error) {
+	sort.Strings(files)
+	first := -1
+	for i, f := range files {
+		if min, max, err = fileTimeRange(f); err == nil {
+			first = i
+			break
+		}
+		if !skipFiles {
+			return 0, 0, err
+		}
+	}
+	if first < 0 {
+		return 0, 0, err
+	}
+	for i := len(files) - 1; i > first; i-- {
+		_, last, err := fileTimeRange(files[i])
+		if err == nil {
+			return min, last, nil
+		}
+		if !skipFiles {
+			return 0, 0, err
+		}
+	}
+	return min, max, nil
+}
+
+func (s *TSMSource) Open(shard ShardInfo, start, end int64) (ShardReader, error) {
+	index, err := s.openIndex(shard)
+	if err != nil {
+		return nil, err
+	}
+	files := s.Files(shard)
+	if s.state != nil {
+		files = s.state.plan(shard, files)
+	}
+	r, err := openTSMShard(files, start, end, shardReadOptions{
+		stream:         s.cfg.Stream,
+		seriesMemLimit: s.cfg.SeriesMemLimit,
+		filter:         s.cfg.Filter,
+		index:          index,
+		skipFiles:      s.cfg.SkipFiles,
+		badBlocks:      s.badBlocks,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if s.state == nil {
+		return r, nil
+	}
+	return &incrementalShardReader{tsmShardReader: r, state: s.state, shard: shard, files: s.Files(shard)}, nil
+}
+
+// openIndex opens the TSI index of the shard, or returns nil if the shard has none.
+func (s *TSMSource) openIndex(shard ShardInfo) (*shardIndex, error) {
+	files := s.Files(shard)
+	if s.cfg.IgnoreIndex || len(files) == 0 {
+		return nil, nil
+	}
+	shardDir := filepath.Dir(files[0])
+	if !hasTSIIndex(shardDir) {
+		return nil, nil
+	}
+	sfile, err := s.seriesFile(seriesFileDir(shardDir))
+	if err != nil {
+		return nil, fmt.Errorf("dataMigrate: cannot read the index of shard %s, use --ignore-index to migrate without it: %s", shard.key(), err)
+	}
+	index, err := openShardIndex(shardDir, sfile)
+	if err != nil {
+		return nil, fmt.Errorf("dataMigrate: cannot read the index of shard %s, use --ignore-index to migrate without it: %s", shard.key(), err)
+	}
+	return index, nil
+}
+
+func (s *TSMSource) seriesFile(dir string) (*tsdb.SeriesFile, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if sfile, ok := s.sfiles[dir]; ok {
+		return sfile, nil
+	}
+	sfile, err := openSeriesFile(dir)
+	if err != nil {
+		return nil, err
+	}
+	s.sfiles[dir] = sfile
+	return sfile, nil
+}
+
+// Close closes the series files, after all the shards opened are closed.
+func (s *TSMSource) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for dir, sfile := range s.sfiles {
+		sfile.Close()
+		delete(s.sfiles, dir)
+	}
+	return nil
+}
+
+func fileTimeRange(file string) (min, max int64, err error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return 0, 0, errors.WithStack(err)
+	}
+	defer f.Close()
+
+	r, err := tsm1.NewTSMReader(f)
+	if err != nil {
+		return 0, 0, fmt.Errorf("dataMigrate: unable to read %s: %s", file, err)
+	}
+	defer r.Close()
+
+	min, max = r.TimeRange()
+	return
+}
+
+// tsmShardReader reads the series of the TSM files of a shard.
+type tsmShardReader struct {
+	startTime int64
+	endTime   int64
+
+	files *[]tsm1.TSMFile
+	// series to fields
+	serieskeys map[string]map[string]struct{}
+	// iterate the series by merging the key indexes instead of collecting them in serieskeys
+	streaming bool
+	// the ceiling of the estimated memory of serieskeys, streaming is used once exceeded
+	seriesMemLimit int64
+	seriesMem      int64
+	filter         *SeriesFilter
+	// the TSI index of the shard to skip the series dropped, nil if the shard has none
+	index *shardIndex
+	// the series skipped, collected along with serieskeys, or counted by Next if streaming
+	skippedKeys map[string]struct{}
+	skipped     int
+	// skip the files which cannot be read instead of failing, and the ones skipped
+	skipFiles    bool
+	filesSkipped []skippedFile
+	// the corrupt blocks not to read
+	badBlocks blockSet
+
+	it seriesIterator
+}
+
+// shardReadOptions are the options to read the TSM files of a shard.
+type shardReadOptions struct {
+	stream         bool
+	seriesMemLimit int64
+	filter         *SeriesFilter
+	// closed with the reader
+	index     *shardIndex
+	skipFiles bool
+	badBlocks blockSet
+}
+
+// openTSMShard opens the TSM files of a shard, and collects the series keys unless streaming.
+func openTSMShard(files []string, start, end int64, opt shardReadOptions) (*tsmShardReader, error) {
+	r := &tsmShardReader{
+		startTime:      start,
+		endTime:        end,
+		files:          filesPool.Get().(*[]tsm1.TSMFile),
+		serieskeys:     make(map[string]map[string]struct{}, 100),
+		skippedKeys:    make(map[string]struct{}),
+		streaming:      opt.stream,
+		seriesMemLimit: opt.seriesMemLimit,
+		filter:         opt.filter,
+		index:          opt.index,
+		skipFiles:      opt.skipFiles,
+		badBlocks:      opt.badBlocks,
+	}
+	*r.files = (*r.files)[:0]
+
+	// the TSM files are not read if the index has none of the measurements to migrate
+	if r.index != nil {
+		ok, err := r.index.hasMeasurements(r.filter)
+		if err != nil {
+			r.Close()
+			return nil, err
+		}
+		if !ok {
+			files = nil
+		}
+	}
+
+	// we need to make sure we write the same order that the files were written
+	sort.Strings(files)
+	for _, f := range files {
+		// read all the TSMFiles using TSMReader
+		logger.LogString(fmt.Sprintf("Dealing file: %s", f), TOCONSOLE|TOLOGFILE, LEVEL_INFO, FileField(f))
+		if err := r.readTSMFile(f); err != nil {
+			r.Close()
+			return nil, err
+		}
+	}
+	if r.streaming {
+		r.it = newMergeSeriesIterator(*r.files)
+	} else {
+		r.it = newMapSeriesIterator(r.serieskeys)
+	}
+	return r, nil
+}
+
+func (r *tsmShardReader) readTSMFile(tsmFilePath string) error {
+	f, err := os.Open(tsmFilePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			// removed by a compaction since the shard was walked
+			logger.LogString("readTSMFile: missing file skipped: "+tsmFilePath, TOLOGFILE, LEVEL_WARNING, FileField(tsmFilePath))
+			return nil
+		}
+		return r.skipFile(tsmFilePath, err)
+	}
+	defer f.Close()
+
+	tr, err := tsm1.NewTSMReader(f)
+	if err != nil {
+		return r.skipFile(tsmFilePath, fmt.Errorf("dataMigrate: unable to read %s: %s", tsmFilePath, err))
+	}
+
+	// If the time range of this file does not meet the conditions, abort reading.
+	if sgStart, sgEnd := tr.TimeRange(); sgStart > r.endTime || sgEnd < r.startTime {
+		tr.Close()
+		return nil
+	}
+
+	*r.files = append(*r.files, tr)
+	if r.streaming {
+		return nil
+	}
+
+	// collect the keys
+	var skipped []byte
+	for i := 0; i < tr.KeyCount(); i++ {
+		key, _ := tr.KeyAt(i)
+		series, field := tsm1.SeriesAndFieldFromCompositeKey(key)
+		if skipped != nil && bytes.Equal(series, skipped) {
+			continue
+		}
+		seriesStr := string(series)
+		if _, ok := r.serieskeys[seriesStr]; !ok {
+			if !r.accept(series) {
+				skipped = append(skipped[:0], series...)
+				if _, ok := r.skippedKeys[seriesStr]; !ok {
+					r.skippedKeys[seriesStr] = struct{}{}
+					r.seriesMem += int64(len(seriesStr)) + seriesKeyOverhead
+				}
+				continue
+			}
+			r.serieskeys[seriesStr] = make(map[string]struct{})
+			r.seriesMem += int64(len(seriesStr)) + seriesKeyOverhead
+		}
+		if _, ok := r.serieskeys[seriesStr][string(field)]; !ok {
+			r.serieskeys[seriesStr][string(field)] = struct{}{}
+			r.seriesMem += int64(len(field)) + fieldKeyOverhead
+		}
+		if r.seriesMemLimit > 0 && r.seriesMem > r.seriesMemLimit {
+			logger.LogString(fmt.Sprintf("series keys exceed the memory limit %d bytes at %s, switch to streaming mode",
+				r.seriesMemLimit, tsmFilePath), TOCONSOLE|TOLOGFILE, LEVEL_WARNING, FileField(tsmFilePath))
+			r.streaming = true
+			r.serieskeys = make(map[string]map[string]struct{})
+			r.skippedKeys = make(map[string]struct{})
+			r.seriesMem = 0
+			return nil
+		}
+	}
+	return nil
+}
+
+// accept reports whether the series is selected by the filter and not dropped.
+func (r *tsmShardReader) accept(series []byte) bool {
+	return r.filter.Match(series) && (r.index == nil || r.index.live(series))
+}
+
+func (r *tsmShardReader) Next() (*Series, error) {
+	series, fields, ok := r.it.next()
+	// the series collected are accepted already
+	for ok && r.streaming && !r.accept([]byte(series)) {
+		r.skipped++
+		series, fields, ok = r.it.next()
+	}
+	if !ok {
+		return nil, nil
+	}
+	s := &Series{Key: series, Fields: make(map[string]FieldCursor, len(fields))}
+	// construct field cursors
+	for _, f := range fields {
+		key := tsm1.SeriesFieldKeyBytes(series, f)
+		c := &Cursor{
+			et:     r.endTime,
+			readTs: r.startTime,
+			key:    key,
+			seeks:  r.locations(key, r.startTime, r.endTime),
+		}
+		if err := c.init(); err != nil {
+			return nil, err
+		}
+		s.Fields[f] = c
+	}
+	return s, nil
+}
+
+// skipFile records the file which cannot be read if skipping the files, otherwise returns err.
+func (r *tsmShardReader) skipFile(path string, err error) error {
+	if !r.skipFiles {
+		return err
+	}
+	logger.LogString(fmt.Sprintf("File %s is skipped: %s", path, err), TOLOGFILE|TOCONSOLE, LEVEL_WARNING, FileField(path))
+	r.filesSkipped = append(r.filesSkipped, skippedFile{path: path, err: err})
+	return nil
+}
+
+func (r *tsmShardReader) skippedFiles() []skippedFile {
+	return r.filesSkipped
+}
+
+func (r *tsmShardReader) seriesSkipped() int {
+	return len(r.skippedKeys) + r.skipped
+}
+
+func (r *tsmShardReader) Close() error {
+	for _, f := range *r.files {
+		f.Close()
+	}
+	*r.files = (*r.files)[:0]
+	filesPool.Put(r.files)
+	if r.index != nil {
+		r.index.Close()
+	}
+	return nil
+}
+
+// Referenced from the implementation of InfluxDB
+func (r *tsmShardReader) locations(key []byte, st int64, et int64) []*location {
+	var cache []tsm1.IndexEntry
+	var locations []*location
+	for _, fd := range *r.files {
+		tombstones := fd.TombstoneRange(key)
+
+		// This file could potential contain points we are looking for so find the blocks for
+		// the given key.
+		entries := fd.ReadEntries(key, &cache)
+	LOOP:
+		for i := 0; i < len(entries); i++ {
+			ie := entries[i]
+
+			// Skip any blocks only contain values that are tombstoned.
+			for _, t := range tombstones {
+				if t.Min <= ie.MinTime && t.Max >= ie.MaxTime {
+					continue LOOP
+				}
+			}
+
+			// If the max time of a block is before where we are looking, skip
+			// it since the data is out of our range
+			if ie.MaxTime < st {
+				continue
+			}
+
+			if ie.MinTime > et {
+				continue
+			}
+
+			if r.badBlocks.contains(fd.Path(), ie.Offset) {
+				continue
+			}
+
+			location := &location{
+				r:     fd,
+				entry: ie,
+			}
+
+			if st-1 < st {
+				// mark everything before the seek time as read
+				// so we can filter it out at query time
+				location.readMax = st - 1
+			} else {
+				location.readMax = st
+			}
+
+			// Otherwise, add this file and block location
+			locations = append(locations, location)
+		}
+	}
+	return locations
+}
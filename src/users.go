@@ -0,0 +1,171 @@
+package src
+
+import (
+	"bufio"
+	"crypto/rand"
+	"fmt"
+	"math/big"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type userInfo struct {
+	name  string
+	admin bool
+	// database to privilege: READ, WRITE or ALL PRIVILEGES
+	privileges map[string]string
+}
+
+const (
+	passwordLength = 16
+	lowerChars     = "abcdefghijklmnopqrstuvwxyz"
+	upperChars     = "ABCDEFGHIJKLMNOPQRSTUVWXYZ"
+	digitChars     = "0123456789"
+	specialChars   = "!@#%^&*_-+="
+)
+
+func randomChar(chars string) (byte, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(int64(len(chars))))
+	if err != nil {
+		return 0, err
+	}
+	return chars[n.Int64()], nil
+}
+
+// generatePassword returns a random password which meets the password complexity policy of openGemini:
+// at least one lowercase letter, uppercase letter, digit and special character.
+func generatePassword() (string, error) {
+	classes := []string{lowerChars, upperChars, digitChars, specialChars}
+	all := strings.Join(classes, "")
+	pw := make([]byte, passwordLength)
+	for i := range pw {
+		chars := all
+		if i < len(classes) {
+			chars = classes[i]
+		}
+		c, err := randomChar(chars)
+		if err != nil {
+			return "", err
+		}
+		pw[i] = c
+	}
+	// shuffle the mandatory characters
+	for i := len(pw) - 1; i > 0; i-- {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(i+1)))
+		if err != nil {
+			return "", err
+		}
+		j := n.Int64()
+		pw[i], pw[j] = pw[j], pw[i]
+	}
+	return string(pw), nil
+}
+
+// loadUserPasswords reads the passwords supplied for users, one `user:password` per line.
+func loadUserPasswords(file string) (map[string]string, error) {
+	passwords := make(map[string]string)
+	if file == "" {
+		return passwords, nil
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.IndexByte(line, ':')
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid line in %s, expect user:password", file)
+		}
+		passwords[line[:i]] = line[i+1:]
+	}
+	return passwords, scanner.Err()
+}
+
+// migrateUsers recreates the users of the source InfluxDB and their privileges in openGemini.
+// The password hashes of InfluxDB cannot be carried over, so every user gets the supplied or a
+// generated password, which is appended to the output file only readable by the owner.
+func (cmd *DataMigrateCommand) migrateUsers() error {
+	logger.LogString("Migrating users", TOCONSOLE|TOLOGFILE, LEVEL_INFO)
+	is, err := NewInfluxService(cmd)
+	if err != nil {
+		return err
+	}
+	users, err := is.GetUsers()
+	if err != nil {
+		return err
+	}
+	passwords, err := loadUserPasswords(cmd.opt.UserPasswordFile)
+	if err != nil {
+		return fmt.Errorf("dataMigrate: load user passwords: %s", err)
+	}
+
+	out, err := os.OpenFile(cmd.opt.UsersOutput, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("dataMigrate: open users output file: %s", err)
+	}
+	defer out.Close()
+	// the file may exist before with looser permissions
+	if err := out.Chmod(0600); err != nil {
+		return fmt.Errorf("dataMigrate: chmod users output file: %s", err)
+	}
+
+	var migrated, failed int
+	// the source database to the destination of the privileges
+	dstDBs := make(map[string]string)
+	for _, u := range users {
+		password, ok := passwords[u.name]
+		if !ok {
+			if password, err = generatePassword(); err != nil {
+				return err
+			}
+		}
+		if err := cmd.gs.CreateUser(u.name, password, u.admin); err != nil {
+			failed++
+			logger.LogString("User "+u.name+" cannot be created: "+err.Error(), TOCONSOLE|TOLOGFILE, LEVEL_WARNING)
+			continue
+		}
+		if _, err := fmt.Fprintf(out, "%s:%s\n", u.name, password); err != nil {
+			return fmt.Errorf("dataMigrate: write users output file: %s", err)
+		}
+
+		dbs := make([]string, 0, len(u.privileges))
+		for db := range u.privileges {
+			dbs = append(dbs, db)
+		}
+		sort.Strings(dbs)
+		for _, db := range dbs {
+			if cmd.opt.Database != "" && db != cmd.opt.Database {
+				continue
+			}
+			dstDB, ok := dstDBs[db]
+			if !ok {
+				// the database is mapped as its default retention policy, as the continuous queries are
+				rp, err := is.DefaultRetentionPolicy(db)
+				if err != nil {
+					return err
+				}
+				dstDB, _ = cmd.mapping.resolve(db, rp)
+				dstDBs[db] = dstDB
+			}
+			if err := cmd.gs.GrantPrivilege(u.name, dstDB, u.privileges[db]); err != nil {
+				logger.LogString("Privilege "+u.privileges[db]+" on "+dstDB+" cannot be granted to user "+u.name+": "+err.Error(),
+					TOCONSOLE|TOLOGFILE, LEVEL_WARNING)
+			}
+		}
+		migrated++
+		logger.LogString("User "+u.name+" migrated, admin: "+strconv.FormatBool(u.admin), TOLOGFILE, LEVEL_INFO)
+	}
+
+	logger.LogString("Users: "+strconv.Itoa(migrated)+" migrated, "+strconv.Itoa(failed)+" failed, passwords are written to "+
+		cmd.opt.UsersOutput+".", TOCONSOLE|TOLOGFILE, LEVEL_INFO)
+	return nil
+}
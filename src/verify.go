@@ -0,0 +1,225 @@
+package src
+
+import (
+	"bytes"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/influxdata/influxdb/tsdb/engine/tsm1"
+)
+
+// the policies of --verify on the corrupt blocks of the TSM files
+const (
+	VerifyFail      = "fail"
+	VerifySkipBlock = "skip-block"
+)
+
+// the header of a TSM file: 4 bytes of magic number and 1 byte of version
+const tsmHeaderSize = 5
+
+func checkVerify(policy string) error {
+	switch policy {
+	case "", VerifyFail, VerifySkipBlock:
+		return nil
+	}
+	return fmt.Errorf("dataMigrate: invalid verify %q, expect fail or skip-block", policy)
+}
+
+// CorruptBlock is a block of a TSM file which fails the verification. The key is empty if the
+// whole file cannot be read.
+type CorruptBlock struct {
+	Shard  string `json:"shard"`
+	File   string `json:"file"`
+	Key    string `json:"key,omitempty"`
+	Offset int64  `json:"offset"`
+	Size   uint32 `json:"size,omitempty"`
+	Error  string `json:"error"`
+}
+
+// blockVerifier is implemented by the sources which verify their TSM files before migrating.
+type blockVerifier interface {
+	// Verify returns the corrupt blocks of the TSM files of the shards, which are skipped by the
+	// shard readers if skipBlocks is set.
+	Verify(skipBlocks bool) ([]CorruptBlock, error)
+}
+
+// blockSet is the offsets of the blocks by the paths of their files.
+type blockSet map[string]map[int64]struct{}
+
+func newBlockSet(blocks []CorruptBlock) blockSet {
+	set := make(blockSet)
+	for _, b := range blocks {
+		if b.Key == "" {
+			continue
+		}
+		if set[b.File] == nil {
+			set[b.File] = make(map[int64]struct{})
+		}
+		set[b.File][b.Offset] = struct{}{}
+	}
+	return set
+}
+
+func (s blockSet) contains(path string, offset int64) bool {
+	_, ok := s[path][offset]
+	return ok
+}
+
+// verifyFiles verifies the TSM files concurrently, and returns the corrupt blocks in the order of
+// the files.
+func verifyFiles(shards []ShardInfo, files map[string][]string) []CorruptBlock {
+	type task struct {
+		shard string
+		path  string
+	}
+	var tasks []task
+	for _, shard := range shards {
+		for _, f := range files[shard.key()] {
+			tasks = append(tasks, task{shard: shard.key(), path: f})
+		}
+	}
+
+	results := make([][]CorruptBlock, len(tasks))
+	idx := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < runtime.GOMAXPROCS(0); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range idx {
+				results[i] = verifyTSMFile(tasks[i].shard, tasks[i].path)
+			}
+		}()
+	}
+	for i := range tasks {
+		idx <- i
+	}
+	close(idx)
+	wg.Wait()
+
+	var corrupt []CorruptBlock
+	for _, r := range results {
+		corrupt = append(corrupt, r...)
+	}
+	return corrupt
+}
+
+// verifyTSMFile checks the index and the CRC of every block of the TSM file, as influx_inspect
+// verify does. The index is consistent if the keys are sorted, and the blocks of every key are
+// sorted by time and lie in the data section of the file.
+func verifyTSMFile(shard, path string) []CorruptBlock {
+	fileError := func(err error) []CorruptBlock {
+		return []CorruptBlock{{Shard: shard, File: path, Error: err.Error()}}
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			// removed by a compaction since the shard was walked
+			return nil
+		}
+		return fileError(err)
+	}
+	defer f.Close()
+	r, err := tsm1.NewTSMReader(f)
+	if err != nil {
+		return fileError(fmt.Errorf("dataMigrate: unable to read %s: %s", path, err))
+	}
+	defer r.Close()
+
+	// the index is followed by the 8 bytes of its offset
+	dataEnd := int64(r.Size()) - int64(r.IndexSize()) - 8
+	var corrupt []CorruptBlock
+	var prev []byte
+	var entries []tsm1.IndexEntry
+	for i := 0; i < r.KeyCount(); i++ {
+		var key []byte
+		var typ byte
+		key, typ, entries = r.Key(i, &entries)
+		if prev != nil && bytes.Compare(prev, key) >= 0 {
+			return append(corrupt, CorruptBlock{Shard: shard, File: path, Error: fmt.Sprintf("index keys out of order at %q", key)})
+		}
+		prev = append(prev[:0], key...)
+
+		for j, e := range entries {
+			block := CorruptBlock{Shard: shard, File: path, Key: string(key), Offset: e.Offset, Size: e.Size}
+			if err := verifyBlock(r, &e, typ, dataEnd); err != nil {
+				block.Error = err.Error()
+			} else if e.MinTime > e.MaxTime {
+				block.Error = fmt.Sprintf("min time %d after max time %d", e.MinTime, e.MaxTime)
+			} else if j > 0 && e.MinTime < entries[j-1].MinTime {
+				block.Error = fmt.Sprintf("block out of order, min time %d before %d", e.MinTime, entries[j-1].MinTime)
+			} else {
+				continue
+			}
+			corrupt = append(corrupt, block)
+		}
+	}
+	return corrupt
+}
+
+// verifyBlock checks the block of the entry lies in the data section, and its checksum and type.
+func verifyBlock(r *tsm1.TSMReader, e *tsm1.IndexEntry, typ byte, dataEnd int64) error {
+	// a block has 4 bytes of checksum and 1 byte of type at least
+	if e.Offset < tsmHeaderSize || e.Size <= 5 || e.Offset+int64(e.Size) > dataEnd {
+		return fmt.Errorf("block out of the data section of %d bytes", dataEnd)
+	}
+	checksum, buf, err := r.ReadBytes(e, nil)
+	if err != nil {
+		return err
+	}
+	if crc := crc32.ChecksumIEEE(buf); crc != checksum {
+		return fmt.Errorf("checksum mismatch, expect %d, got %d", checksum, crc)
+	}
+	if buf[0] != typ {
+		return fmt.Errorf("block type %d, expect %d of the key", buf[0], typ)
+	}
+	return nil
+}
+
+// verify checks the TSM files of the shards with --verify before migrating, which fails on the
+// corrupt blocks, or makes the shard readers skip them.
+func (cmd *DataMigrateCommand) verify() error {
+	if cmd.opt.Verify == "" {
+		return nil
+	}
+	v, ok := cmd.Source.(blockVerifier)
+	if !ok {
+		logger.LogString("The source does not support --verify, the TSM files are not verified", TOCONSOLE|TOLOGFILE, LEVEL_WARNING)
+		return nil
+	}
+	logger.LogString("Verifying the TSM files", TOCONSOLE|TOLOGFILE, LEVEL_INFO)
+	st := time.Now()
+	corrupt, err := v.Verify(cmd.opt.Verify == VerifySkipBlock)
+	if err != nil {
+		return err
+	}
+	cmd.corrupt = corrupt
+
+	for _, b := range corrupt {
+		msg := fmt.Sprintf("Corrupt TSM file %s: %s", b.File, b.Error)
+		if b.Key != "" {
+			msg = fmt.Sprintf("Corrupt block of %s in %s at offset %d: %s", b.Key, b.File, b.Offset, b.Error)
+		}
+		logger.LogString(msg, TOCONSOLE|TOLOGFILE, LEVEL_WARNING, ShardField(b.Shard), FileField(b.File))
+	}
+	if len(corrupt) == 0 {
+		logger.LogString("TSM files verified in "+time.Since(st).String()+", no corrupt block found", TOCONSOLE|TOLOGFILE, LEVEL_INFO)
+		return nil
+	}
+	if cmd.opt.Verify == VerifyFail {
+		return fmt.Errorf("dataMigrate: %d corrupt blocks found in the TSM files, see the log or the report, use --verify skip-block to migrate without them", len(corrupt))
+	}
+	// the files which cannot be read are left to --on-error
+	skipped := newBlockSet(corrupt)
+	blocks := 0
+	for _, offsets := range skipped {
+		blocks += len(offsets)
+	}
+	logger.LogString(fmt.Sprintf("TSM files verified in %s, %d corrupt blocks in %d files are skipped", time.Since(st), blocks, len(skipped)),
+		TOCONSOLE|TOLOGFILE, LEVEL_WARNING)
+	return nil
+}
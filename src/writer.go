@@ -0,0 +1,284 @@
+package src
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	compressNone = "none"
+	compressGzip = "gzip"
+)
+
+func checkCompression(compress string, level int) error {
+	switch compress {
+	case "", compressNone:
+		return nil
+	case compressGzip:
+		if level < gzip.HuffmanOnly || level > gzip.BestCompression {
+			return fmt.Errorf("dataMigrate: invalid compression level %d, expect -2 to 9", level)
+		}
+		return nil
+	}
+	return fmt.Errorf("dataMigrate: invalid compression %q, expect none or gzip", compress)
+}
+
+// gzipBuffer compresses the line protocol, it is reused through a pool.
+type gzipBuffer struct {
+	buf bytes.Buffer
+	w   *gzip.Writer
+}
+
+// compress returns the gzipped data, which is valid until the next call.
+func (z *gzipBuffer) compress(data []byte) ([]byte, error) {
+	z.buf.Reset()
+	z.w.Reset(&z.buf)
+	if _, err := z.w.Write(data); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if err := z.w.Close(); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return z.buf.Bytes(), nil
+}
+
+type GeminiSinkConfig struct {
+	Hosts    []string // host:port of the ts-sql nodes
+	Ssl      bool
+	Username string
+	Password string
+	// round-robin or least-inflight
+	Balance string
+	// none or gzip, with the level of compress/gzip
+	Compress      string
+	CompressLevel int
+}
+
+// GeminiSink posts the line protocol to the /write endpoint of openGemini. The requests are
+// balanced among the hosts, and a batch fails over to another host if the one picked is unreachable.
+type GeminiSink struct {
+	pool     *endpointPool
+	username string
+	password string
+	client   *http.Client
+	// the bodies are gzipped if zpool is not nil
+	zpool *sync.Pool
+
+	stats sinkStats
+}
+
+func NewGeminiSink(cfg GeminiSinkConfig) (*GeminiSink, error) {
+	if len(cfg.Hosts) == 0 {
+		return nil, fmt.Errorf("dataMigrate: must specify the hosts to write to")
+	}
+	if err := checkBalance(cfg.Balance); err != nil {
+		return nil, err
+	}
+	if err := checkCompression(cfg.Compress, cfg.CompressLevel); err != nil {
+		return nil, err
+	}
+	s := &GeminiSink{
+		pool:     newEndpointPool(cfg.Hosts, cfg.Ssl, cfg.Balance),
+		username: cfg.Username,
+		password: cfg.Password,
+		client: &http.Client{
+			Timeout: time.Minute,
+			Transport: &http.Transport{
+				Proxy:           http.ProxyFromEnvironment,
+				TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+			},
+		},
+	}
+	if cfg.Compress == compressGzip {
+		level := cfg.CompressLevel
+		s.zpool = &sync.Pool{
+			New: func() interface{} {
+				w, _ := gzip.NewWriterLevel(nil, level)
+				return &gzipBuffer{w: w}
+			},
+		}
+	}
+	return s, nil
+}
+
+func (s *GeminiSink) Write(b *Batch) error {
+	body := b.Lines
+	if s.zpool != nil {
+		z := s.zpool.Get().(*gzipBuffer)
+		defer s.zpool.Put(z)
+		var err error
+		if body, err = z.compress(b.Lines); err != nil {
+			return err
+		}
+	}
+
+	tried := make(map[*endpoint]struct{}, 1)
+	var lastErr error
+	for {
+		ep := s.pool.pick(tried)
+		if ep == nil && len(tried) == 0 {
+			// all the endpoints are down, check whether any one is back
+			s.pool.checkHealth()
+			ep = s.pool.pick(tried)
+		}
+		if ep == nil {
+			if lastErr == nil {
+				lastErr = fmt.Errorf("no healthy endpoint to write to")
+			}
+			return lastErr
+		}
+		tried[ep] = struct{}{}
+
+		ep.inflight.Inc()
+		reachable, err := s.post(ep, b, body)
+		ep.inflight.Dec()
+		if err == nil {
+			s.stats.add(b, len(body))
+			return nil
+		}
+		if werr, ok := err.(*WriteError); ok && werr.Partial {
+			// the other points are written, and writing the dropped ones again fails the same way
+			s.stats.addPartial(b, len(body), werr.Dropped)
+			b.Rejected += werr.Dropped
+			logger.LogString(fmt.Sprintf("%d of %d points are rejected by %s (%s), points like: %s",
+				werr.Dropped, b.Points, ep.addr, werr.Reason, b.firstLine()), TOLOGFILE|TOCONSOLE, LEVEL_WARNING)
+			return nil
+		}
+		if reachable {
+			return err
+		}
+		s.pool.markDown(ep, err)
+		lastErr = err
+	}
+}
+
+// post sends the body to the endpoint, reachable is false if no response is received.
+func (s *GeminiSink) post(ep *endpoint, b *Batch, body []byte) (reachable bool, err error) {
+	params := url.Values{}
+	params.Set("db", b.Database)
+	params.Set("rp", b.RetentionPolicy)
+	params.Set("precision", b.Precision)
+	req, err := http.NewRequest(http.MethodPost, ep.addr+"/write?"+params.Encode(), bytes.NewReader(body))
+	if err != nil {
+		return true, errors.WithStack(err)
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if s.zpool != nil {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	if s.username != "" {
+		req.SetBasicAuth(s.username, s.password)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNoContent || resp.StatusCode == http.StatusOK {
+		_, _ = io.Copy(io.Discard, resp.Body)
+		return true, nil
+	}
+	msg, _ := io.ReadAll(resp.Body)
+	return true, parseWriteError(resp.StatusCode, resp.Status, msg, b.Points)
+}
+
+// WriteError is the error returned by openGemini for a write request. A partial write drops only
+// some points of the batch, e.g. the ones of conflicting field types, and writes the others.
+type WriteError struct {
+	StatusCode int
+	Message    string
+	Partial    bool
+	// the points dropped by a partial write, and why
+	Dropped int
+	Reason  string
+}
+
+func (e *WriteError) Error() string {
+	return e.Message
+}
+
+// Retryable reports whether writing the batch again may succeed. The requests rejected for the
+// data, the database or the credentials fail the same way every time.
+func (e *WriteError) Retryable() bool {
+	if e.Partial {
+		return false
+	}
+	switch e.StatusCode {
+	case http.StatusRequestTimeout, http.StatusTooManyRequests:
+		return true
+	}
+	return e.StatusCode >= http.StatusInternalServerError
+}
+
+// isRetryable reports whether the error of a write may be resolved by retrying, which is true
+// for the errors not reported by openGemini, e.g. the endpoints are unreachable.
+func isRetryable(err error) bool {
+	if werr, ok := errors.Cause(err).(*WriteError); ok {
+		return werr.Retryable()
+	}
+	return true
+}
+
+var droppedPattern = regexp.MustCompile(`dropped=(\d+)`)
+
+// parseWriteError parses the response of a failed write of a batch of n points. The body is
+// {"error": "..."} for the errors of openGemini, and the partial writes are reported as
+// `partial write: <reason> dropped=<n>`. The points with expired time are dropped as well.
+func parseWriteError(code int, status string, body []byte, n int) *WriteError {
+	e := &WriteError{StatusCode: code}
+	var result struct {
+		Err string `json:"error"`
+	}
+	if json.Unmarshal(body, &result) == nil && result.Err != "" {
+		e.Message = result.Err
+	} else {
+		e.Message = status + ": " + strings.TrimSpace(string(body))
+	}
+
+	switch {
+	case strings.HasPrefix(e.Message, "partial write"):
+		e.Partial = true
+		e.Reason = strings.TrimSpace(strings.TrimPrefix(strings.TrimPrefix(e.Message, "partial write"), ":"))
+	case strings.Contains(e.Message, "point time is expired"):
+		e.Partial, e.Reason = true, e.Message
+	default:
+		return e
+	}
+	// all the points are dropped if the number is not reported
+	e.Dropped = n
+	if m := droppedPattern.FindStringSubmatchIndex(e.Reason); m != nil {
+		if dropped, err := strconv.Atoi(e.Reason[m[2]:m[3]]); err == nil && dropped <= n {
+			e.Dropped = dropped
+		}
+		e.Reason = strings.TrimSpace(e.Reason[:m[0]] + e.Reason[m[1]:])
+	}
+	return e
+}
+
+// Flush does nothing since nothing is buffered.
+func (s *GeminiSink) Flush() error {
+	return nil
+}
+
+func (s *GeminiSink) Close() error {
+	s.client.CloseIdleConnections()
+	return nil
+}
+
+func (s *GeminiSink) Stats() SinkStats {
+	return s.stats.load()
+}